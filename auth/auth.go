@@ -0,0 +1,138 @@
+// Package auth authenticates WebSocket upgrade requests. An Authenticator
+// finds the credentials of a request, e.g. a bearer token, and a Verifier
+// checks them and tells who the user is.
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/samuel1992/ws-server-with-messagebus/messagebus"
+)
+
+var (
+	// ErrNoCredentials is returned (wrapped) when a request carries none of
+	// the credentials an Authenticator looks for.
+	ErrNoCredentials = errors.New("auth: no credentials")
+	// ErrInvalidCredentials is returned (wrapped) for credentials that are
+	// malformed, forged or expired.
+	ErrInvalidCredentials = errors.New("auth: invalid credentials")
+	// ErrForbidden is returned (wrapped) when the user is known but may not
+	// connect.
+	ErrForbidden = errors.New("auth: forbidden")
+)
+
+// Principal is an authenticated user.
+type Principal struct {
+	UserID string
+	Roles  []string
+	// Expires is when the credentials expire, if they do. Connections are
+	// closed then.
+	Expires time.Time
+}
+
+// HasRole reports whether p has role.
+func (p *Principal) HasRole(role string) bool {
+	return p != nil && slices.Contains(p.Roles, role)
+}
+
+// HasAnyRole reports whether p has one of roles, or whether roles is empty.
+func (p *Principal) HasAnyRole(roles ...string) bool {
+	return len(roles) == 0 || slices.ContainsFunc(roles, p.HasRole)
+}
+
+// Headers returns the message headers identifying p (see
+// messagebus.HeaderUserID).
+func (p *Principal) Headers() map[string]string {
+	return map[string]string{
+		messagebus.HeaderUserID:    p.UserID,
+		messagebus.HeaderUserRoles: strings.Join(p.Roles, ","),
+	}
+}
+
+// FromMessage returns the user a message was sent by, or nil if its
+// connection was not authenticated.
+func FromMessage(msg messagebus.Message) *Principal {
+	userID := msg.Header(messagebus.HeaderUserID)
+	if userID == "" {
+		return nil
+	}
+	var roles []string
+	if header := msg.Header(messagebus.HeaderUserRoles); header != "" {
+		roles = strings.Split(header, ",")
+	}
+	return &Principal{UserID: userID, Roles: roles}
+}
+
+// Authenticator identifies the user behind an upgrade request. It fails
+// with an error wrapping ErrNoCredentials, ErrInvalidCredentials (both
+// answered with 401) or ErrForbidden (403).
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Principal, error)
+}
+
+// AuthenticatorFunc adapts a function to Authenticator.
+type AuthenticatorFunc func(r *http.Request) (*Principal, error)
+
+func (f AuthenticatorFunc) Authenticate(r *http.Request) (*Principal, error) {
+	return f(r)
+}
+
+// Verifier checks a token and returns its user.
+type Verifier func(ctx context.Context, token string) (*Principal, error)
+
+// Bearer authenticates requests with an "Authorization: Bearer <token>"
+// header verified by verify. Browsers cannot set headers on WebSockets;
+// use Query or Cookie for them.
+func Bearer(verify Verifier) Authenticator {
+	return AuthenticatorFunc(func(r *http.Request) (*Principal, error) {
+		scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+		if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+			return nil, ErrNoCredentials
+		}
+		return verify(r.Context(), token)
+	})
+}
+
+// Query authenticates requests with a token in query parameter param,
+// verified by verify. Query strings end up in logs, so the tokens should be
+// short-lived.
+func Query(param string, verify Verifier) Authenticator {
+	return AuthenticatorFunc(func(r *http.Request) (*Principal, error) {
+		token := r.URL.Query().Get(param)
+		if token == "" {
+			return nil, ErrNoCredentials
+		}
+		return verify(r.Context(), token)
+	})
+}
+
+// Cookie authenticates requests with a token in the cookie called name,
+// verified by verify.
+func Cookie(name string, verify Verifier) Authenticator {
+	return AuthenticatorFunc(func(r *http.Request) (*Principal, error) {
+		cookie, err := r.Cookie(name)
+		if err != nil || cookie.Value == "" {
+			return nil, ErrNoCredentials
+		}
+		return verify(r.Context(), cookie.Value)
+	})
+}
+
+// Chain tries authenticators in order and returns the result of the first
+// that finds credentials, valid or not.
+func Chain(authenticators ...Authenticator) Authenticator {
+	return AuthenticatorFunc(func(r *http.Request) (*Principal, error) {
+		for _, authenticator := range authenticators {
+			principal, err := authenticator.Authenticate(r)
+			if !errors.Is(err, ErrNoCredentials) {
+				return principal, err
+			}
+		}
+		return nil, ErrNoCredentials
+	})
+}
@@ -0,0 +1,93 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/samuel1992/ws-server-with-messagebus/messagebus"
+)
+
+func TestHMACTokens(t *testing.T) {
+	secret := []byte("s3cret")
+	verify := HMAC(secret)
+	ctx := context.Background()
+
+	token := Sign(secret, Principal{UserID: "alice", Roles: []string{"admin"}}, time.Minute)
+	principal, err := verify(ctx, token)
+	if err != nil {
+		t.Fatalf("expected a valid token, got %v", err)
+	}
+	if principal.UserID != "alice" || !principal.HasRole("admin") {
+		t.Errorf("unexpected principal %+v", principal)
+	}
+
+	encoded, signature, _ := strings.Cut(token, ".")
+	forged := Sign([]byte("other"), Principal{UserID: "alice"}, time.Minute)
+	for name, token := range map[string]string{
+		"wrong secret": forged,
+		"tampered":     encoded + "x." + signature,
+		"no signature": encoded,
+		"expired":      Sign(secret, Principal{UserID: "alice"}, -time.Second),
+		"no subject":   Sign(secret, Principal{}, time.Minute),
+	} {
+		if _, err := verify(ctx, token); !errors.Is(err, ErrInvalidCredentials) {
+			t.Errorf("%s: expected ErrInvalidCredentials, got %v", name, err)
+		}
+	}
+}
+
+func TestAuthenticatorSources(t *testing.T) {
+	secret := []byte("s3cret")
+	verify := HMAC(secret)
+	token := Sign(secret, Principal{UserID: "bob"}, time.Minute)
+	authenticator := Chain(Bearer(verify), Query("token", verify), Cookie("session", verify))
+
+	request := func(modify func(r *http.Request)) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/ws/echo", nil)
+		modify(r)
+		return r
+	}
+	for name, r := range map[string]*http.Request{
+		"bearer": request(func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+token) }),
+		"query":  request(func(r *http.Request) { r.URL.RawQuery = "token=" + token }),
+		"cookie": request(func(r *http.Request) { r.AddCookie(&http.Cookie{Name: "session", Value: token}) }),
+	} {
+		principal, err := authenticator.Authenticate(r)
+		if err != nil || principal.UserID != "bob" {
+			t.Errorf("%s: expected bob, got %+v, %v", name, principal, err)
+		}
+	}
+
+	if _, err := authenticator.Authenticate(request(func(*http.Request) {})); !errors.Is(err, ErrNoCredentials) {
+		t.Errorf("expected ErrNoCredentials, got %v", err)
+	}
+	// An invalid bearer token is not made up for by a valid cookie.
+	r := request(func(r *http.Request) {
+		r.Header.Set("Authorization", "Bearer junk")
+		r.AddCookie(&http.Cookie{Name: "session", Value: token})
+	})
+	if _, err := authenticator.Authenticate(r); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("expected ErrInvalidCredentials, got %v", err)
+	}
+}
+
+func TestFromMessage(t *testing.T) {
+	if p := FromMessage(messagebus.Message{}); p != nil {
+		t.Errorf("expected no principal, got %+v", p)
+	}
+
+	principal := &Principal{UserID: "carol", Roles: []string{"a", "b"}}
+	got := FromMessage(messagebus.Message{Headers: principal.Headers()})
+	if got == nil || got.UserID != "carol" || !slices.Equal(got.Roles, principal.Roles) {
+		t.Errorf("expected %+v, got %+v", principal, got)
+	}
+	if !got.HasAnyRole() || !got.HasAnyRole("x", "b") || got.HasAnyRole("x") {
+		t.Error("unexpected HasAnyRole result")
+	}
+}
@@ -0,0 +1,201 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"sync"
+	"time"
+)
+
+// jwksCheckInterval is how often a JWKSFile looks for changes, at most.
+var jwksCheckInterval = time.Second
+
+// JWKSFile is a JSON Web Key Set (RFC 7517) read from a local file, reloaded
+// when the file changes so keys can be rotated without a restart. It holds
+// "RSA" keys for RS256, "EC" P-256 keys for ES256 and "oct" keys for HS256.
+type JWKSFile struct {
+	path string
+
+	mu      sync.Mutex
+	keys    []jwk
+	modTime time.Time
+	size    int64
+	checked time.Time
+}
+
+// jwk is a parsed key: a []byte, *rsa.PublicKey or *ecdsa.PublicKey.
+type jwk struct {
+	kid string
+	alg string
+	key any
+}
+
+// LoadJWKS reads the key set at path.
+func LoadJWKS(path string) (*JWKSFile, error) {
+	f := &JWKSFile{path: path}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.load(info); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *JWKSFile) load(info os.FileInfo) error {
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return err
+	}
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", f.path, err)
+	}
+	f.keys = keys
+	f.modTime, f.size = info.ModTime(), info.Size()
+	return nil
+}
+
+// keysFor returns the keys that may have signed a token with the kid and
+// alg of its header, reloading the file first if it changed. A token
+// without a kid may have been signed by any key of its algorithm.
+func (f *JWKSFile) keysFor(kid, alg string) []jwk {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if time.Since(f.checked) >= jwksCheckInterval {
+		f.checked = time.Now()
+		// A file that disappeared or no longer parses, e.g. while being
+		// rewritten, keeps serving the last keys.
+		if info, err := os.Stat(f.path); err == nil &&
+			(!info.ModTime().Equal(f.modTime) || info.Size() != f.size) {
+			if err := f.load(info); err != nil {
+				log.Printf("auth: keeping the previous keys: %v", err)
+				f.modTime, f.size = info.ModTime(), info.Size()
+			} else {
+				log.Printf("auth: reloaded %d keys from %s", len(f.keys), f.path)
+			}
+		}
+	}
+
+	var keys []jwk
+	for _, key := range f.keys {
+		if (kid == "" || key.kid == kid) && (key.alg == "" || key.alg == alg) && keyFits(key.key, alg) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// keyFits reports whether key has the type alg needs, so that e.g. an RSA
+// public key is never used as an HMAC secret.
+func keyFits(key any, alg string) bool {
+	switch key.(type) {
+	case []byte:
+		return alg == "HS256"
+	case *rsa.PublicKey:
+		return alg == "RS256"
+	case *ecdsa.PublicKey:
+		return alg == "ES256"
+	}
+	return false
+}
+
+// parseJWKS parses a key set. Keys that are not for signatures are skipped,
+// and so are keys of other types and algorithms (RS384, PS256, EdDSA, ...),
+// with a log line: shared key sets often hold them. It fails if no usable
+// signing key is left.
+func parseJWKS(data []byte) ([]jwk, error) {
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Alg string `json:"alg"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+			K   string `json:"k"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("invalid key set: %w", err)
+	}
+
+	var keys []jwk
+	for i, raw := range set.Keys {
+		if raw.Use != "" && raw.Use != "sig" {
+			continue
+		}
+		var key any
+		var err error
+		switch raw.Kty {
+		case "RSA":
+			key, err = rsaKey(raw.N, raw.E)
+		case "EC":
+			key, err = ecKey(raw.Crv, raw.X, raw.Y)
+		case "oct":
+			key, err = base64.RawURLEncoding.DecodeString(raw.K)
+			if err == nil && len(key.([]byte)) < 32 {
+				err = errors.New("HMAC keys need at least 256 bits")
+			}
+		default:
+			err = fmt.Errorf("unsupported key type %q", raw.Kty)
+		}
+		if err == nil && raw.Alg != "" && !keyFits(key, raw.Alg) {
+			err = fmt.Errorf("unsupported alg %q for key type %q", raw.Alg, raw.Kty)
+		}
+		if err != nil {
+			log.Printf("auth: skipping key %d (kid %q): %v", i, raw.Kid, err)
+			continue
+		}
+		keys = append(keys, jwk{kid: raw.Kid, alg: raw.Alg, key: key})
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no usable signing keys")
+	}
+	return keys, nil
+}
+
+func rsaKey(n, e string) (*rsa.PublicKey, error) {
+	modulus, err := base64.RawURLEncoding.DecodeString(n)
+	if err != nil {
+		return nil, fmt.Errorf("invalid n: %w", err)
+	}
+	exponent, err := base64.RawURLEncoding.DecodeString(e)
+	if err != nil || len(exponent) == 0 || len(exponent) > 4 {
+		return nil, errors.New("invalid e")
+	}
+	key := &rsa.PublicKey{
+		N: new(big.Int).SetBytes(modulus),
+		E: int(new(big.Int).SetBytes(exponent).Int64()),
+	}
+	if key.N.BitLen() < 2048 {
+		return nil, errors.New("RSA keys need at least 2048 bits")
+	}
+	return key, nil
+}
+
+func ecKey(crv, x, y string) (*ecdsa.PublicKey, error) {
+	if crv != "P-256" {
+		return nil, fmt.Errorf("unsupported curve %q", crv)
+	}
+	xBytes, errX := base64.RawURLEncoding.DecodeString(x)
+	yBytes, errY := base64.RawURLEncoding.DecodeString(y)
+	if errX != nil || errY != nil || len(xBytes) != 32 || len(yBytes) != 32 {
+		return nil, errors.New("invalid x or y")
+	}
+	point := append(append([]byte{4}, xBytes...), yBytes...)
+	return ecdsa.ParseUncompressedPublicKey(elliptic.P256(), point)
+}
@@ -0,0 +1,196 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"slices"
+	"strings"
+	"time"
+)
+
+// JWTAlgorithms are the signature algorithms JWT supports.
+var JWTAlgorithms = []string{"HS256", "RS256", "ES256"}
+
+// JWTOptions are the checks JWT makes beyond the signature and expiry.
+type JWTOptions struct {
+	// Issuer, if set, must equal the "iss" claim.
+	Issuer string
+	// Audience, if set, must be one of the "aud" claim.
+	Audience string
+	// Algorithms restricts the accepted algorithms. Defaults to
+	// JWTAlgorithms.
+	Algorithms []string
+	// Leeway is the clock skew tolerated on "exp" and "nbf".
+	Leeway time.Duration
+	// RolesClaim names the claim holding the user's roles, an array or a
+	// space-separated string. Defaults to "roles".
+	RolesClaim string
+}
+
+// Validate checks that o only names supported algorithms.
+func (o JWTOptions) Validate() error {
+	var errs []error
+	for _, alg := range o.Algorithms {
+		if !slices.Contains(JWTAlgorithms, alg) {
+			errs = append(errs, fmt.Errorf("unsupported algorithm %q (supported: %v)", alg, JWTAlgorithms))
+		}
+	}
+	if o.Leeway < 0 {
+		errs = append(errs, errors.New("leeway must not be negative"))
+	}
+	return errors.Join(errs...)
+}
+
+// jwtClaims are the registered claims JWT checks.
+type jwtClaims struct {
+	Issuer    string   `json:"iss"`
+	Subject   string   `json:"sub"`
+	Audience  audience `json:"aud"`
+	Expires   *float64 `json:"exp"`
+	NotBefore *float64 `json:"nbf"`
+}
+
+// audience is the "aud" claim, a string or an array of strings.
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var one string
+	if err := json.Unmarshal(data, &one); err == nil {
+		*a = audience{one}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(a))
+}
+
+// JWT verifies JSON Web Tokens signed with one of the keys of keys. Tokens
+// must have a subject, which becomes the user ID, and an expiry, which
+// becomes Principal.Expires. The "none" algorithm is never accepted.
+func JWT(keys *JWKSFile, opts JWTOptions) Verifier {
+	algorithms := opts.Algorithms
+	if len(algorithms) == 0 {
+		algorithms = JWTAlgorithms
+	}
+	rolesClaim := opts.RolesClaim
+	if rolesClaim == "" {
+		rolesClaim = "roles"
+	}
+
+	return func(_ context.Context, token string) (*Principal, error) {
+		parts := strings.Split(token, ".")
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("%w: malformed token", ErrInvalidCredentials)
+		}
+		var header struct {
+			Alg string `json:"alg"`
+			Kid string `json:"kid"`
+		}
+		if err := decodeSegment(parts[0], &header); err != nil {
+			return nil, fmt.Errorf("%w: malformed header: %w", ErrInvalidCredentials, err)
+		}
+		if !slices.Contains(algorithms, header.Alg) {
+			return nil, fmt.Errorf("%w: algorithm %q not accepted", ErrInvalidCredentials, header.Alg)
+		}
+		signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+		if err != nil {
+			return nil, fmt.Errorf("%w: malformed signature", ErrInvalidCredentials)
+		}
+		signed := []byte(parts[0] + "." + parts[1])
+		if !slices.ContainsFunc(keys.keysFor(header.Kid, header.Alg), func(key jwk) bool {
+			return verifySignature(header.Alg, key.key, signed, signature)
+		}) {
+			return nil, fmt.Errorf("%w: bad signature (kid %q)", ErrInvalidCredentials, header.Kid)
+		}
+
+		var claims jwtClaims
+		var all map[string]json.RawMessage
+		if err := decodeSegment(parts[1], &claims); err != nil {
+			return nil, fmt.Errorf("%w: malformed claims: %w", ErrInvalidCredentials, err)
+		}
+		decodeSegment(parts[1], &all)
+
+		now := time.Now()
+		switch {
+		case claims.Subject == "":
+			return nil, fmt.Errorf("%w: token has no subject", ErrInvalidCredentials)
+		case claims.Expires == nil:
+			return nil, fmt.Errorf("%w: token has no expiry", ErrInvalidCredentials)
+		case opts.Issuer != "" && claims.Issuer != opts.Issuer:
+			return nil, fmt.Errorf("%w: issuer %q not accepted", ErrInvalidCredentials, claims.Issuer)
+		case opts.Audience != "" && !slices.Contains(claims.Audience, opts.Audience):
+			return nil, fmt.Errorf("%w: audience %q not accepted", ErrInvalidCredentials, claims.Audience)
+		}
+		expires := numericDate(*claims.Expires).Add(opts.Leeway)
+		if !now.Before(expires) {
+			return nil, fmt.Errorf("%w: token expired", ErrInvalidCredentials)
+		}
+		if claims.NotBefore != nil && now.Add(opts.Leeway).Before(numericDate(*claims.NotBefore)) {
+			return nil, fmt.Errorf("%w: token not valid yet", ErrInvalidCredentials)
+		}
+
+		roles, err := parseRoles(all[rolesClaim])
+		if err != nil {
+			return nil, fmt.Errorf("%w: claim %q: %w", ErrInvalidCredentials, rolesClaim, err)
+		}
+		return &Principal{UserID: claims.Subject, Roles: roles, Expires: expires}, nil
+	}
+}
+
+func decodeSegment(segment string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// numericDate converts seconds since the epoch, possibly fractional.
+func numericDate(seconds float64) time.Time {
+	whole, frac := math.Modf(seconds)
+	return time.Unix(int64(whole), int64(frac*1e9))
+}
+
+func parseRoles(raw json.RawMessage) ([]string, error) {
+	if raw == nil {
+		return nil, nil
+	}
+	var roles []string
+	if err := json.Unmarshal(raw, &roles); err == nil {
+		return roles, nil
+	}
+	var spaced string
+	if err := json.Unmarshal(raw, &spaced); err != nil {
+		return nil, errors.New("want an array of strings or a space-separated string")
+	}
+	return strings.Fields(spaced), nil
+}
+
+func verifySignature(alg string, key any, signed, signature []byte) bool {
+	digest := sha256.Sum256(signed)
+	switch alg {
+	case "HS256":
+		secret, ok := key.([]byte)
+		return ok && hmac.Equal(signature, mac(secret, string(signed)))
+	case "RS256":
+		public, ok := key.(*rsa.PublicKey)
+		return ok && rsa.VerifyPKCS1v15(public, crypto.SHA256, digest[:], signature) == nil
+	case "ES256":
+		public, ok := key.(*ecdsa.PublicKey)
+		if !ok || len(signature) != 64 {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		return ecdsa.Verify(public, digest[:], r, s)
+	}
+	return false
+}
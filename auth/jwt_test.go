@@ -0,0 +1,239 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var b64 = base64.RawURLEncoding.EncodeToString
+
+// testKeys are a key of each supported type and their key set.
+type testKeys struct {
+	rsa    *rsa.PrivateKey
+	ec     *ecdsa.PrivateKey
+	secret []byte
+}
+
+func newTestKeys(t *testing.T) *testKeys {
+	t.Helper()
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testKeys{rsa: rsaKey, ec: ecKey, secret: []byte(strings.Repeat("k", 32))}
+}
+
+func (k *testKeys) jwks(t *testing.T) []byte {
+	t.Helper()
+
+	point, err := k.ec.PublicKey.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := json.Marshal(map[string]any{"keys": []map[string]string{
+		{"kty": "RSA", "kid": "rsa", "use": "sig", "n": b64(k.rsa.N.Bytes()), "e": b64([]byte{1, 0, 1})},
+		{"kty": "EC", "kid": "ec", "crv": "P-256", "x": b64(point[1:33]), "y": b64(point[33:])},
+		{"kty": "oct", "kid": "hs", "alg": "HS256", "k": b64(k.secret)},
+		{"kty": "RSA", "kid": "enc", "use": "enc", "n": "", "e": ""},
+	}})
+	return data
+}
+
+// sign makes a token with claims, signed by the key of alg.
+func (k *testKeys) sign(t *testing.T, alg, kid string, claims map[string]any) string {
+	t.Helper()
+
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := b64(header) + "." + b64(payload)
+	digest := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	switch alg {
+	case "RS256":
+		signature, _ = rsa.SignPKCS1v15(rand.Reader, k.rsa, crypto.SHA256, digest[:])
+	case "ES256":
+		r, s, err := ecdsa.Sign(rand.Reader, k.ec, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature = make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+	case "HS256":
+		signature = mac(k.secret, signed)
+	}
+	return signed + "." + b64(signature)
+}
+
+func writeJWKS(t *testing.T, data []byte) *JWKSFile {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := LoadJWKS(path)
+	if err != nil {
+		t.Fatalf("LoadJWKS failed: %v", err)
+	}
+	return keys
+}
+
+func TestJWT(t *testing.T) {
+	keys := newTestKeys(t)
+	verify := JWT(writeJWKS(t, keys.jwks(t)), JWTOptions{Issuer: "https://issuer", Audience: "ws"})
+	ctx := context.Background()
+
+	exp := time.Now().Add(time.Minute).Unix()
+	claims := func(overrides map[string]any) map[string]any {
+		c := map[string]any{"iss": "https://issuer", "aud": []string{"api", "ws"}, "sub": "alice", "exp": exp, "roles": []string{"admin"}}
+		for name, value := range overrides {
+			if value == nil {
+				delete(c, name)
+			} else {
+				c[name] = value
+			}
+		}
+		return c
+	}
+
+	for _, alg := range []string{"RS256", "ES256", "HS256"} {
+		principal, err := verify(ctx, keys.sign(t, alg, "", claims(nil)))
+		if err != nil {
+			t.Errorf("%s: expected a valid token, got %v", alg, err)
+			continue
+		}
+		if principal.UserID != "alice" || !principal.HasRole("admin") || principal.Expires.Unix() != exp {
+			t.Errorf("%s: unexpected principal %+v", alg, principal)
+		}
+	}
+
+	principal, err := verify(ctx, keys.sign(t, "ES256", "ec", claims(map[string]any{"aud": "ws", "roles": "a b"})))
+	if err != nil || len(principal.Roles) != 2 {
+		t.Errorf("expected a single audience and space-separated roles to be accepted, got %+v, %v", principal, err)
+	}
+
+	for name, token := range map[string]string{
+		"wrong issuer":   keys.sign(t, "RS256", "", claims(map[string]any{"iss": "https://other"})),
+		"wrong audience": keys.sign(t, "RS256", "", claims(map[string]any{"aud": "api"})),
+		"expired":        keys.sign(t, "RS256", "", claims(map[string]any{"exp": time.Now().Add(-time.Second).Unix()})),
+		"no expiry":      keys.sign(t, "RS256", "", claims(map[string]any{"exp": nil})),
+		"not yet valid":  keys.sign(t, "RS256", "", claims(map[string]any{"nbf": time.Now().Add(time.Hour).Unix()})),
+		"no subject":     keys.sign(t, "RS256", "", claims(map[string]any{"sub": nil})),
+		"unknown kid":    keys.sign(t, "RS256", "other", claims(nil)),
+		"kid of another": keys.sign(t, "RS256", "ec", claims(nil)),
+		"none":           keys.sign(t, "none", "", claims(nil)),
+		"malformed":      "a.b",
+		// An RSA public key must not be usable as an HMAC secret.
+		"confusion": func() string {
+			header, _ := json.Marshal(map[string]string{"alg": "HS256", "kid": "rsa"})
+			payload, _ := json.Marshal(claims(nil))
+			signed := b64(header) + "." + b64(payload)
+			return signed + "." + b64(mac(keys.rsa.N.Bytes(), signed))
+		}(),
+	} {
+		if _, err := verify(ctx, token); !errors.Is(err, ErrInvalidCredentials) {
+			t.Errorf("%s: expected ErrInvalidCredentials, got %v", name, err)
+		}
+	}
+
+	token := keys.sign(t, "RS256", "", claims(nil))
+	parts := strings.Split(token, ".")
+	payload, _ := json.Marshal(claims(map[string]any{"sub": "mallory"}))
+	if _, err := verify(ctx, parts[0]+"."+b64(payload)+"."+parts[2]); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("expected a tampered payload to be rejected, got %v", err)
+	}
+
+	restricted := JWT(writeJWKS(t, keys.jwks(t)), JWTOptions{Algorithms: []string{"ES256"}})
+	if _, err := restricted(ctx, keys.sign(t, "RS256", "", claims(nil))); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("expected RS256 to be refused, got %v", err)
+	}
+
+	leeway := JWT(writeJWKS(t, keys.jwks(t)), JWTOptions{Leeway: time.Minute})
+	expired := claims(map[string]any{"exp": time.Now().Add(-time.Second).Unix()})
+	if _, err := leeway(ctx, keys.sign(t, "RS256", "", expired)); err != nil {
+		t.Errorf("expected the leeway to accept a just expired token, got %v", err)
+	}
+}
+
+func TestJWKSFileReloads(t *testing.T) {
+	defer func(interval time.Duration) { jwksCheckInterval = interval }(jwksCheckInterval)
+	jwksCheckInterval = 0
+
+	old, rotated := newTestKeys(t), newTestKeys(t)
+	keys := writeJWKS(t, old.jwks(t))
+	verify := JWT(keys, JWTOptions{})
+	ctx := context.Background()
+	claims := map[string]any{"sub": "alice", "exp": time.Now().Add(time.Minute).Unix()}
+
+	if _, err := verify(ctx, old.sign(t, "ES256", "ec", claims)); err != nil {
+		t.Fatalf("expected the old key to be accepted, got %v", err)
+	}
+
+	os.WriteFile(keys.path, rotated.jwks(t), 0o644)
+	// Make sure the change is visible even with a coarse mtime.
+	os.Chtimes(keys.path, time.Now(), time.Now().Add(time.Second))
+	if _, err := verify(ctx, rotated.sign(t, "ES256", "ec", claims)); err != nil {
+		t.Errorf("expected the rotated key to be accepted, got %v", err)
+	}
+	if _, err := verify(ctx, old.sign(t, "ES256", "ec", claims)); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("expected the old key to be refused, got %v", err)
+	}
+
+	// A broken file keeps the last keys.
+	os.WriteFile(keys.path, []byte("{"), 0o644)
+	os.Chtimes(keys.path, time.Now(), time.Now().Add(2*time.Second))
+	if _, err := verify(ctx, rotated.sign(t, "ES256", "ec", claims)); err != nil {
+		t.Errorf("expected the last keys to be kept, got %v", err)
+	}
+}
+
+func TestParseJWKSSkipsUnusableKeys(t *testing.T) {
+	secret := `{"kty": "oct", "kid": "hs", "k": "` + b64(make([]byte, 32)) + `"}`
+	unusable := []string{
+		`{"kty": "oct", "kid": "short", "k": "c2hvcnQ"}`,
+		`{"kty": "EC", "kid": "p384", "crv": "P-384", "x": "", "y": ""}`,
+		`{"kty": "RSA", "kid": "small", "n": "AQAB", "e": "AQAB"}`,
+		`{"kty": "oct", "kid": "rs", "alg": "RS256", "k": "` + b64(make([]byte, 32)) + `"}`,
+		`{"kty": "RSA", "kid": "ps", "alg": "PS256", "n": "AQAB", "e": "AQAB"}`,
+		`{"kty": "OKP", "kid": "ed", "crv": "Ed25519", "x": ""}`,
+	}
+
+	keys, err := parseJWKS([]byte(`{"keys": [` + strings.Join(append(unusable, secret), ", ") + `]}`))
+	if err != nil {
+		t.Fatalf("expected the usable key to be kept, got %v", err)
+	}
+	if len(keys) != 1 || keys[0].kid != "hs" {
+		t.Errorf("expected only the hs key, got %+v", keys)
+	}
+
+	for name, jwks := range map[string]string{
+		"not json":   `{`,
+		"empty":      `{"keys": []}`,
+		"no usable":  `{"keys": [` + strings.Join(unusable, ", ") + `]}`,
+		"encryption": `{"keys": [{"kty": "oct", "use": "enc", "k": "` + b64(make([]byte, 32)) + `"}]}`,
+	} {
+		if _, err := parseJWKS([]byte(jwks)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/samuel1992/ws-server-with-messagebus/auth"
+)
+
+// Auth makes every endpoint require an authenticated user, identified by a
+// JWT or by a token signed with auth.Sign. Tokens are accepted as a bearer
+// token, and optionally in a query parameter or a cookie, which browsers
+// can send.
+type Auth struct {
+	// HMACSecretFile holds the auth.Sign secret. Surrounding whitespace is
+	// ignored.
+	HMACSecretFile string `json:"hmac_secret_file,omitempty"`
+	// JWT verifies JSON Web Tokens.
+	JWT *JWT `json:"jwt,omitempty"`
+	// QueryParam and Cookie, if set, name the query parameter and cookie
+	// that may carry the token too.
+	QueryParam string `json:"query_param,omitempty"`
+	Cookie     string `json:"cookie,omitempty"`
+}
+
+// JWT configures auth.JWT.
+type JWT struct {
+	// JWKSFile is the key set, reloaded when it changes.
+	JWKSFile   string   `json:"jwks_file"`
+	Issuer     string   `json:"issuer,omitempty"`
+	Audience   string   `json:"audience,omitempty"`
+	Algorithms []string `json:"algorithms,omitempty"`
+	Leeway     Duration `json:"leeway,omitempty"`
+	RolesClaim string   `json:"roles_claim,omitempty"`
+}
+
+func (j *JWT) options() auth.JWTOptions {
+	return auth.JWTOptions{
+		Issuer:     j.Issuer,
+		Audience:   j.Audience,
+		Algorithms: j.Algorithms,
+		Leeway:     time.Duration(j.Leeway),
+		RolesClaim: j.RolesClaim,
+	}
+}
+
+func (a *Auth) validate() error {
+	if a.HMACSecretFile == "" && a.JWT == nil {
+		return errors.New("hmac_secret_file or jwt is required")
+	}
+	if a.JWT != nil {
+		if a.JWT.JWKSFile == "" {
+			return errors.New("jwt: jwks_file is required")
+		}
+		if err := a.JWT.options().Validate(); err != nil {
+			return fmt.Errorf("jwt: %w", err)
+		}
+	}
+	return nil
+}
+
+// Authenticator reads the secret and keys and returns the authenticator a
+// describes, or nil if a is nil.
+func (a *Auth) Authenticator() (auth.Authenticator, error) {
+	if a == nil {
+		return nil, nil
+	}
+
+	var signed, jwt auth.Verifier
+	if a.HMACSecretFile != "" {
+		secret, err := os.ReadFile(a.HMACSecretFile)
+		if err != nil {
+			return nil, fmt.Errorf("auth: %w", err)
+		}
+		secret = bytes.TrimSpace(secret)
+		if len(secret) == 0 {
+			return nil, fmt.Errorf("auth: %s is empty", a.HMACSecretFile)
+		}
+		signed = auth.HMAC(secret)
+	}
+	if a.JWT != nil {
+		keys, err := auth.LoadJWKS(a.JWT.JWKSFile)
+		if err != nil {
+			return nil, fmt.Errorf("auth: %w", err)
+		}
+		jwt = auth.JWT(keys, a.JWT.options())
+	}
+
+	verify := signed
+	switch {
+	case jwt != nil && signed != nil:
+		// JWTs have three dot-separated parts, auth.Sign tokens two.
+		verify = func(ctx context.Context, token string) (*auth.Principal, error) {
+			if strings.Count(token, ".") == 2 {
+				return jwt(ctx, token)
+			}
+			return signed(ctx, token)
+		}
+	case jwt != nil:
+		verify = jwt
+	}
+
+	authenticators := []auth.Authenticator{auth.Bearer(verify)}
+	if a.QueryParam != "" {
+		authenticators = append(authenticators, auth.Query(a.QueryParam, verify))
+	}
+	if a.Cookie != "" {
+		authenticators = append(authenticators, auth.Cookie(a.Cookie, verify))
+	}
+	return auth.Chain(authenticators...), nil
+}
@@ -0,0 +1,378 @@
+// Package config loads the declarative server configuration: where to
+// listen, which message bus to use and which endpoints to serve with which
+// registered service types.
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/samuel1992/ws-server-with-messagebus/handlers"
+	"github.com/samuel1992/ws-server-with-messagebus/messagebus"
+	"github.com/samuel1992/ws-server-with-messagebus/services"
+	"github.com/samuel1992/ws-server-with-messagebus/ws"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// ErrInvalid is returned (wrapped) for a configuration that does not
+// validate.
+var ErrInvalid = errors.New("config: invalid configuration")
+
+// Duration is a time.Duration written as a string such as "5s" in JSON.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"5s\": %w", err)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+type Config struct {
+	// Listen are the addresses to serve on. Defaults to ":3000".
+	Listen []string `json:"listen"`
+	// TLS, if set, serves HTTPS and WSS on every address.
+	TLS *TLS `json:"tls,omitempty"`
+	// ShutdownTimeout bounds the drain of connections on SIGTERM.
+	ShutdownTimeout Duration `json:"shutdown_timeout"`
+	// Linger is how long an idle service keeps running for reconnecting
+	// clients, unless its endpoint says otherwise.
+	Linger Duration `json:"linger"`
+	// Origins are the web origins allowed to connect besides the server's
+	// own (see handlers.OriginPolicy).
+	Origins []string `json:"origins,omitempty"`
+	// Auth, if set, requires every connection to be authenticated.
+	Auth      *Auth      `json:"auth,omitempty"`
+	Bus       Bus        `json:"bus"`
+	Endpoints []Endpoint `json:"endpoints"`
+}
+
+type TLS struct {
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+}
+
+// Bus selects the message bus backend and its options.
+type Bus struct {
+	// Backend is "memory" (the default), "redis", "redis-streams" or "file".
+	Backend string `json:"backend"`
+	Redis   Redis  `json:"redis"`
+	// GroupQueueLen caps each group queue of the redis backend.
+	GroupQueueLen int64 `json:"group_queue_len,omitempty"`
+	// StreamMaxLen caps each stream of the redis-streams backend.
+	StreamMaxLen int64 `json:"stream_max_len,omitempty"`
+	// Dir and Retention configure the file backend.
+	Dir       string   `json:"dir,omitempty"`
+	Retention Duration `json:"retention,omitempty"`
+}
+
+type Redis struct {
+	Addr     string `json:"addr"`
+	Password string `json:"password,omitempty"`
+	DB       int    `json:"db,omitempty"`
+}
+
+// Endpoint maps a route to a registered service type.
+type Endpoint struct {
+	// Path is a route pattern such as "/ws/rooms/{room}".
+	Path string `json:"path"`
+	// Name defaults to handlers.EndpointName(Path).
+	Name string `json:"name,omitempty"`
+	// Service is the service type, as registered with services.Register.
+	Service string `json:"service"`
+	// Scope is "shared" (the default), "connection" or "key".
+	Scope    string `json:"scope,omitempty"`
+	KeyParam string `json:"key_param,omitempty"`
+	// Restart is the supervisor strategy: "permanent" (the default),
+	// "transient" or "temporary".
+	Restart string `json:"restart,omitempty"`
+	// Linger overrides Config.Linger for this endpoint.
+	Linger       *Duration        `json:"linger,omitempty"`
+	Options      services.Options `json:"options,omitempty"`
+	QueryOptions []string         `json:"query_options,omitempty"`
+	Client       ClientOptions    `json:"client,omitzero"`
+	// Origins, if present, replace Config.Origins for this endpoint; an
+	// empty list allows the server's own origin only.
+	Origins []string `json:"origins,omitempty"`
+	// Roles, if set, restrict the endpoint to users with one of them. They
+	// require Config.Auth.
+	Roles []string `json:"roles,omitempty"`
+}
+
+// ClientOptions are the WebSocket connection limits of an endpoint (see
+// ws.ClientOptions). Zero fields take their default.
+type ClientOptions struct {
+	ReadLimit       int64    `json:"read_limit,omitempty"`
+	PongWait        Duration `json:"pong_wait,omitempty"`
+	PingPeriod      Duration `json:"ping_period,omitempty"`
+	WriteWait       Duration `json:"write_wait,omitempty"`
+	ReadBufferSize  int      `json:"read_buffer_size,omitempty"`
+	WriteBufferSize int      `json:"write_buffer_size,omitempty"`
+	SendQueueLen    int      `json:"send_queue_len,omitempty"`
+}
+
+func (o ClientOptions) ws() ws.ClientOptions {
+	return ws.ClientOptions{
+		ReadLimit:       o.ReadLimit,
+		PongWait:        time.Duration(o.PongWait),
+		PingPeriod:      time.Duration(o.PingPeriod),
+		WriteWait:       time.Duration(o.WriteWait),
+		ReadBufferSize:  o.ReadBufferSize,
+		WriteBufferSize: o.WriteBufferSize,
+		SendQueueLen:    o.SendQueueLen,
+	}
+}
+
+// Default is the configuration used without a configuration file.
+func Default() *Config {
+	return &Config{
+		Listen:          []string{":3000"},
+		ShutdownTimeout: Duration(15 * time.Second),
+		Linger:          Duration(5 * time.Second),
+		Bus: Bus{
+			Backend:      "memory",
+			Redis:        Redis{Addr: "localhost:6379"},
+			StreamMaxLen: 10000,
+			Dir:          "data",
+			Retention:    Duration(24 * time.Hour),
+		},
+		Endpoints: []Endpoint{
+			{Path: "/ws/echo", Service: "echo"},
+			{Path: "/ws/timenow", Service: "timenow"},
+			// A private clock per connection, e.g.
+			// /ws/clock?timezone=Asia/Tokyo&interval=1s.
+			{Path: "/ws/clock", Service: "timenow", Scope: "connection",
+				QueryOptions: []string{"interval", "timezone", "format"}},
+			// One echo instance, and topic namespace, per room.
+			{Path: "/ws/rooms/{room}", Service: "echo", Scope: "key", KeyParam: "room"},
+		},
+	}
+}
+
+// Load reads and validates the JSON configuration file at path.
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// Parse decodes and validates a JSON configuration. Settings it leaves out
+// take their value from Default, except the endpoints.
+func Parse(data []byte) (*Config, error) {
+	cfg := Default()
+	cfg.Endpoints = nil
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(cfg); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalid, err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+var scopes = map[string]handlers.Scope{
+	"":           handlers.ScopeShared,
+	"shared":     handlers.ScopeShared,
+	"connection": handlers.ScopeConnection,
+	"key":        handlers.ScopeKey,
+}
+
+var strategies = map[string]services.RestartStrategy{
+	"":          services.Permanent,
+	"permanent": services.Permanent,
+	"transient": services.Transient,
+	"temporary": services.Temporary,
+}
+
+// Validate checks every setting, including the options of each endpoint
+// against its service type, and reports all problems at once.
+func (c *Config) Validate() error {
+	var errs []error
+	if len(c.Listen) == 0 {
+		errs = append(errs, errors.New("listen: no address"))
+	}
+	if err := c.OriginPolicy().Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("origins: %w", err))
+	}
+	if c.TLS != nil && (c.TLS.CertFile == "" || c.TLS.KeyFile == "") {
+		errs = append(errs, errors.New("tls: cert_file and key_file are required"))
+	}
+	if c.Auth != nil {
+		if err := c.Auth.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("auth: %w", err))
+		}
+	}
+	switch c.Bus.Backend {
+	case "memory", "file":
+	case "redis", "redis-streams":
+		if c.Bus.Redis.Addr == "" {
+			errs = append(errs, errors.New("bus: redis.addr is required"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("bus: unknown backend %q", c.Bus.Backend))
+	}
+
+	// Register the routes on a scratch mux to catch invalid and conflicting
+	// patterns, which http.ServeMux reports by panicking.
+	mux := http.NewServeMux()
+	names := make(map[string]string)
+	for _, endpoint := range c.Endpoints {
+		if err := register(mux, endpoint.Path); err != nil {
+			errs = append(errs, fmt.Errorf("endpoint %s: %w", endpoint.Path, err))
+			continue
+		}
+		if err := endpoint.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("endpoint %s: %w", endpoint.Path, err))
+			continue
+		}
+		if len(endpoint.Roles) > 0 && c.Auth == nil {
+			errs = append(errs, fmt.Errorf("endpoint %s: roles require auth", endpoint.Path))
+		}
+		name := endpoint.name()
+		if other, dup := names[name]; dup {
+			errs = append(errs, fmt.Errorf("endpoint %s: name %q already used by %s", endpoint.Path, name, other))
+		}
+		names[name] = endpoint.Path
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("%w:\n%w", ErrInvalid, err)
+	}
+	return nil
+}
+
+func register(mux *http.ServeMux, pattern string) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("%v", p)
+		}
+	}()
+	mux.HandleFunc(pattern, func(http.ResponseWriter, *http.Request) {})
+	return nil
+}
+
+func (e Endpoint) name() string {
+	if e.Name != "" {
+		return e.Name
+	}
+	return handlers.EndpointName(e.Path)
+}
+
+func (e Endpoint) validate() error {
+	if e.Path == "" {
+		return errors.New("path is required")
+	}
+	if e.name() == "" {
+		return errors.New("name is required when the path has no literal segment after /ws/")
+	}
+	if strings.ContainsAny(e.name(), ".:*") {
+		return fmt.Errorf("name %q must not contain '.', ':' or '*'", e.name())
+	}
+	scope, ok := scopes[e.Scope]
+	if !ok {
+		return fmt.Errorf("unknown scope %q", e.Scope)
+	}
+	if scope == handlers.ScopeKey && e.KeyParam == "" {
+		return errors.New("key_param is required with scope key")
+	}
+	if _, ok := strategies[e.Restart]; !ok {
+		return fmt.Errorf("unknown restart strategy %q", e.Restart)
+	}
+	if err := e.Client.ws().Validate(); err != nil {
+		return err
+	}
+	if err := (handlers.OriginPolicy{Allowed: e.Origins}).Validate(); err != nil {
+		return err
+	}
+	constructor, err := services.Lookup(e.Service)
+	if err != nil {
+		return fmt.Errorf("%w (registered: %v)", err, services.Types())
+	}
+	// Constructors have no side effects before Start.
+	if _, err := constructor(nil, "", "", e.Options); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Handler returns the handlers.Endpoint serving e, supervised with its
+// restart strategy. e must have been validated.
+func (e Endpoint) Handler() handlers.Endpoint {
+	constructor, _ := services.Lookup(e.Service)
+	factory := handlers.Construct(constructor)
+	strategy := strategies[e.Restart]
+
+	endpoint := handlers.Endpoint{
+		Name: e.name(),
+		Factory: func(cfg handlers.ServiceConfig) (services.Service, error) {
+			service, err := factory(cfg)
+			if err != nil {
+				return nil, err
+			}
+			return services.Supervise(cfg.Instance, service, services.SupervisorOptions{Strategy: strategy}), nil
+		},
+		Scope:        scopes[e.Scope],
+		KeyParam:     e.KeyParam,
+		Options:      e.Options,
+		QueryOptions: e.QueryOptions,
+		Client:       e.Client.ws(),
+		Roles:        e.Roles,
+	}
+	if e.Origins != nil {
+		endpoint.Origins = &handlers.OriginPolicy{Allowed: e.Origins}
+	}
+	return endpoint
+}
+
+// OriginPolicy is the origin policy of endpoints without their own.
+func (c *Config) OriginPolicy() handlers.OriginPolicy {
+	return handlers.OriginPolicy{Allowed: c.Origins}
+}
+
+// Open creates the configured message bus.
+func (b Bus) Open() (messagebus.MessageBus, error) {
+	redisOptions := &redis.Options{Addr: b.Redis.Addr, Password: b.Redis.Password, DB: b.Redis.DB}
+	switch b.Backend {
+	case "memory":
+		return messagebus.NewInMemoryMessageBus(), nil
+	case "redis":
+		return messagebus.NewRedisMessageBusWithOptions(redisOptions,
+			messagebus.RedisOptions{GroupQueueLen: b.GroupQueueLen}), nil
+	case "redis-streams":
+		return messagebus.NewRedisStreamsMessageBus(redisOptions,
+			messagebus.RedisStreamsOptions{MaxLen: b.StreamMaxLen}), nil
+	case "file":
+		return messagebus.NewFileMessageBus(messagebus.FileOptions{
+			Dir:          b.Dir,
+			RetentionAge: time.Duration(b.Retention),
+		})
+	default:
+		return nil, fmt.Errorf("%w: unknown bus backend %q", ErrInvalid, b.Backend)
+	}
+}
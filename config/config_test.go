@@ -0,0 +1,174 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/samuel1992/ws-server-with-messagebus/auth"
+	"github.com/samuel1992/ws-server-with-messagebus/handlers"
+	"github.com/samuel1992/ws-server-with-messagebus/messagebus"
+	"github.com/samuel1992/ws-server-with-messagebus/services"
+)
+
+func TestLoadExample(t *testing.T) {
+	cfg, err := Load("../config.example.json")
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if len(cfg.Endpoints) != 4 {
+		t.Fatalf("expected 4 endpoints, got %d", len(cfg.Endpoints))
+	}
+	rooms := cfg.Endpoints[3]
+	if rooms.Linger == nil || time.Duration(*rooms.Linger) != 30*time.Second {
+		t.Errorf("expected rooms to linger 30s, got %v", rooms.Linger)
+	}
+
+	echo := cfg.Endpoints[0].Handler()
+	if echo.Client.ReadLimit != 1<<20 || echo.Client.PingPeriod != 20*time.Second {
+		t.Errorf("unexpected client options %+v", echo.Client)
+	}
+
+	endpoint := rooms.Handler()
+	if endpoint.Name != "rooms" || endpoint.Scope != handlers.ScopeKey || endpoint.KeyParam != "room" {
+		t.Errorf("unexpected endpoint %+v", endpoint)
+	}
+}
+
+func TestParseKeepsDefaults(t *testing.T) {
+	cfg, err := Parse([]byte(`{"bus": {"backend": "redis"}, "endpoints": [{"path": "/ws/echo", "service": "echo"}]}`))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if cfg.Bus.Redis.Addr != "localhost:6379" || cfg.Listen[0] != ":3000" {
+		t.Errorf("expected defaults to be kept, got %+v", cfg)
+	}
+	if time.Duration(cfg.ShutdownTimeout) != 15*time.Second {
+		t.Errorf("expected the default shutdown timeout, got %v", time.Duration(cfg.ShutdownTimeout))
+	}
+}
+
+func TestParseRejectsInvalid(t *testing.T) {
+	for name, tc := range map[string]struct {
+		json string
+		want string
+	}{
+		"unknown field":   {`{"listen": [":3000"], "port": 3000}`, "unknown field"},
+		"bad duration":    {`{"linger": "soon"}`, "invalid duration"},
+		"unknown backend": {`{"bus": {"backend": "kafka"}}`, "unknown backend"},
+		"unknown service": {`{"endpoints": [{"path": "/ws/x", "service": "nope"}]}`, `unknown service type "nope"`},
+		"bad options":     {`{"endpoints": [{"path": "/ws/t", "service": "timenow", "options": {"interval": "1ms"}}]}`, "interval"},
+		"key scope":       {`{"endpoints": [{"path": "/ws/c", "service": "echo", "scope": "key"}]}`, "key_param"},
+		"scope":           {`{"endpoints": [{"path": "/ws/c", "service": "echo", "scope": "global"}]}`, "unknown scope"},
+		"restart":         {`{"endpoints": [{"path": "/ws/c", "service": "echo", "restart": "never"}]}`, "unknown restart"},
+		"bad pattern":     {`{"endpoints": [{"path": "/ws/{a", "service": "echo"}]}`, "bad wildcard"},
+		"conflict": {`{"endpoints": [{"path": "/ws/echo", "service": "echo"}, {"path": "/ws/echo", "service": "echo", "name": "other"}]}`,
+			"conflicts"},
+		"duplicate name": {`{"endpoints": [{"path": "/ws/echo", "service": "echo"}, {"path": "/ws/echo/{id}", "service": "echo"}]}`,
+			`name "echo" already used`},
+		"ping period": {`{"endpoints": [{"path": "/ws/e", "service": "echo", "client": {"pong_wait": "5s", "ping_period": "10s"}}]}`,
+			"ping period 10s must be shorter than pong wait 5s"},
+		"origins":          {`{"origins": ["https://a.com/app"]}`, "without a path"},
+		"endpoint origins": {`{"endpoints": [{"path": "/ws/e", "service": "echo", "origins": ["ftp://a.com"]}]}`, "scheme"},
+		"name separator":   {`{"endpoints": [{"path": "/ws/e", "service": "echo", "name": "a.b"}]}`, "must not contain"},
+		"auth secret":      {`{"auth": {"query_param": "token"}}`, "hmac_secret_file or jwt is required"},
+		"jwt algorithm":    {`{"auth": {"jwt": {"jwks_file": "keys.json", "algorithms": ["none"]}}}`, "unsupported algorithm \"none\""},
+		"roles without auth": {`{"endpoints": [{"path": "/ws/e", "service": "echo", "roles": ["admin"]}]}`,
+			"roles require auth"},
+	} {
+		_, err := Parse([]byte(tc.json))
+		if !errors.Is(err, ErrInvalid) {
+			t.Errorf("%s: expected ErrInvalid, got %v", name, err)
+			continue
+		}
+		if !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: expected %q in %v", name, tc.want, err)
+		}
+	}
+}
+
+func TestServiceTypesAreRegistered(t *testing.T) {
+	for _, name := range []string{"echo", "timenow"} {
+		if _, err := services.Lookup(name); err != nil {
+			t.Errorf("Lookup(%q) failed: %v", name, err)
+		}
+	}
+}
+
+func TestOpenMemoryBus(t *testing.T) {
+	bus, err := Default().Bus.Open()
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if err := bus.Close(); err != nil {
+		t.Errorf("Close failed: %v", err)
+	}
+}
+
+func TestAuthAuthenticator(t *testing.T) {
+	dir := t.TempDir()
+	secretFile := filepath.Join(dir, "secret")
+	jwksFile := filepath.Join(dir, "jwks.json")
+	os.WriteFile(secretFile, []byte("s3cret\n"), 0o644)
+	os.WriteFile(jwksFile, []byte(`{"keys": [{"kty": "oct", "k": "`+strings.Repeat("A", 43)+`"}]}`), 0o644)
+
+	authenticator, err := (&Auth{HMACSecretFile: secretFile, JWT: &JWT{JWKSFile: jwksFile}, QueryParam: "token"}).Authenticator()
+	if err != nil {
+		t.Fatalf("Authenticator failed: %v", err)
+	}
+	request := func(token string) *http.Request {
+		return httptest.NewRequest(http.MethodGet, "/ws/echo?token="+token, nil)
+	}
+	token := auth.Sign([]byte("s3cret"), auth.Principal{UserID: "alice"}, time.Minute)
+	if principal, err := authenticator.Authenticate(request(token)); err != nil || principal.UserID != "alice" {
+		t.Errorf("expected a signed token to be accepted, got %+v, %v", principal, err)
+	}
+	if _, err := authenticator.Authenticate(request("a.b.c")); !errors.Is(err, auth.ErrInvalidCredentials) {
+		t.Errorf("expected a bad JWT to be refused, got %v", err)
+	}
+
+	if _, err := (&Auth{JWT: &JWT{JWKSFile: filepath.Join(dir, "missing.json")}}).Authenticator(); err == nil {
+		t.Error("expected an error for a missing key set")
+	}
+	if authenticator, err := (*Auth)(nil).Authenticator(); authenticator != nil || err != nil {
+		t.Errorf("expected no authenticator without auth, got %v, %v", authenticator, err)
+	}
+}
+
+func TestEndpointHandlerServiceIsReadyOnStart(t *testing.T) {
+	bus := messagebus.NewInMemoryMessageBus()
+	ctx := context.Background()
+	endpoint := Endpoint{Path: "/ws/echo", Service: "echo"}.Handler()
+
+	for i := range 50 {
+		service, err := endpoint.Factory(handlers.ServiceConfig{
+			Bus:             bus,
+			Endpoint:        "echo",
+			Instance:        "echo",
+			FromWsToService: "echo:from-ws-to-service",
+			FromServiceToWs: "echo:from-service-to-ws",
+		})
+		if err != nil {
+			t.Fatalf("Factory failed: %v", err)
+		}
+		out, _ := bus.Subscribe(ctx, "echo:from-service-to-ws")
+		if err := service.Start(ctx); err != nil {
+			t.Fatalf("Start failed: %v", err)
+		}
+		bus.Publish(ctx, "echo:from-ws-to-service", messagebus.NewMessage([]byte("first")))
+
+		select {
+		case <-out:
+		case <-time.After(time.Second):
+			t.Fatalf("run %d: the message published right after Start was lost", i)
+		}
+		service.Stop()
+		bus.Unsubscribe("echo:from-service-to-ws", out)
+	}
+}
@@ -0,0 +1,135 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/samuel1992/ws-server-with-messagebus/handlers"
+	"github.com/samuel1992/ws-server-with-messagebus/services"
+)
+
+// Routes keeps the endpoints served by a router in line with the
+// configuration, so that it can be reloaded without a restart.
+type Routes struct {
+	router   *handlers.Router
+	handler  *handlers.WS
+	registry *services.ServiceRegistry
+
+	mu sync.Mutex
+	// current are the endpoints being served, by path.
+	current map[string]Endpoint
+}
+
+func NewRoutes(router *handlers.Router, handler *handlers.WS, registry *services.ServiceRegistry) *Routes {
+	return &Routes{
+		router:   router,
+		handler:  handler,
+		registry: registry,
+		current:  make(map[string]Endpoint),
+	}
+}
+
+// Apply serves endpoints, which must have been validated. Endpoints that
+// did not change keep their connections and services. Removed endpoints stop
+// being routed, and their clients are closed with CloseGoingAway and their
+// services stopped. Changed endpoints go through the same, answering 503
+// meanwhile, and are then served with their new settings, so reconnecting
+// clients get fresh services. Connections still open when ctx expires are
+// cut off; Apply then returns ctx.Err() but still serves the new endpoints.
+func (rt *Routes) Apply(ctx context.Context, endpoints []Endpoint) error {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	next := make(map[string]Endpoint, len(endpoints))
+	for _, endpoint := range endpoints {
+		next[endpoint.Path] = endpoint
+	}
+
+	var stale []Endpoint
+	for path, old := range rt.current {
+		endpoint, kept := next[path]
+		switch {
+		case kept && reflect.DeepEqual(old, endpoint):
+			continue
+		case kept:
+			log.Printf("Reloading endpoint %s", path)
+			rt.router.Suspend(path)
+		default:
+			log.Printf("Removing endpoint %s", path)
+			rt.router.Remove(path)
+		}
+		stale = append(stale, old)
+		delete(rt.current, path)
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(stale))
+	for i, old := range stale {
+		wg.Go(func() {
+			name := old.name()
+			errs[i] = rt.handler.CloseEndpoint(ctx, name)
+			rt.registry.StopIdle(name)
+			rt.registry.ClearLinger(name)
+		})
+	}
+	wg.Wait()
+
+	for _, endpoint := range endpoints {
+		if _, ok := rt.current[endpoint.Path]; ok {
+			continue
+		}
+		handler := endpoint.Handler()
+		if endpoint.Linger != nil {
+			rt.registry.SetLinger(handler.Name, time.Duration(*endpoint.Linger))
+		}
+		rt.router.Handle(endpoint.Path, handler)
+		rt.current[endpoint.Path] = endpoint
+		log.Printf("Serving %s (%s) on %s", handler.Name, endpoint.Service, endpoint.Path)
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("closing connections: %w", err)
+	}
+	return nil
+}
+
+// Watch polls the file at path every interval and sends on the returned
+// channel when its modification time or size changes, until ctx is done.
+// Changes in quick succession may be reported once.
+func Watch(ctx context.Context, path string, interval time.Duration) <-chan struct{} {
+	changes := make(chan struct{}, 1)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		last, _ := os.Stat(path)
+		for {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+
+			info, err := os.Stat(path)
+			if err != nil {
+				// Editors often replace the file; wait for it to reappear.
+				continue
+			}
+			if last != nil && info.ModTime().Equal(last.ModTime()) && info.Size() == last.Size() {
+				continue
+			}
+			last = info
+			select {
+			case changes <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return changes
+}
@@ -0,0 +1,168 @@
+package config
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/samuel1992/ws-server-with-messagebus/handlers"
+	"github.com/samuel1992/ws-server-with-messagebus/messagebus"
+	"github.com/samuel1992/ws-server-with-messagebus/services"
+
+	"github.com/gorilla/websocket"
+)
+
+func newRoutesServer(t *testing.T) (*Routes, *services.ServiceRegistry, *httptest.Server) {
+	t.Helper()
+
+	bus := messagebus.NewInMemoryMessageBus()
+	registry := services.NewServiceRegistry(bus)
+	registry.SetDefaultLinger(time.Hour)
+	handler := handlers.NewWSHandler(registry, bus)
+	router := handlers.NewRouter(handler)
+	server := httptest.NewServer(router)
+	t.Cleanup(func() {
+		server.Close()
+		registry.StopAll()
+	})
+	return NewRoutes(router, handler, registry), registry, server
+}
+
+func dial(t *testing.T, server *httptest.Server, path string) *websocket.Conn {
+	t.Helper()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + path
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("Dial %s failed: %v", path, err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// echoes checks that conn is still served by an echo service.
+func echoes(t *testing.T, conn *websocket.Conn) {
+	t.Helper()
+
+	conn.WriteMessage(websocket.TextMessage, []byte("ping"))
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, payload, err := conn.ReadMessage()
+	if err != nil || string(payload) != "ping" {
+		t.Fatalf("expected the echo, got '%s', %v", payload, err)
+	}
+}
+
+func expectGoingAway(t *testing.T, conn *websocket.Conn) {
+	t.Helper()
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err := conn.ReadMessage()
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != websocket.CloseGoingAway {
+		t.Fatalf("expected CloseGoingAway, got %v", err)
+	}
+}
+
+func status(t *testing.T, server *httptest.Server, path string) int {
+	t.Helper()
+
+	resp, err := http.Get(server.URL + path)
+	if err != nil {
+		t.Fatalf("GET %s failed: %v", path, err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestRoutesApplyAddsAndRemovesEndpoints(t *testing.T) {
+	routes, registry, server := newRoutesServer(t)
+	ctx := t.Context()
+
+	kept := Endpoint{Path: "/ws/echo", Service: "echo"}
+	removed := Endpoint{Path: "/ws/old", Service: "echo"}
+	if err := routes.Apply(ctx, []Endpoint{kept, removed}); err != nil {
+		t.Fatalf("Apply failed: %v", err)
+	}
+	keptConn := dial(t, server, "/ws/echo")
+	echoes(t, keptConn)
+	removedConn := dial(t, server, "/ws/old")
+	echoes(t, removedConn)
+
+	// Apply waits for the client to answer the close frame.
+	added := Endpoint{Path: "/ws/new", Service: "echo"}
+	applied := make(chan error, 1)
+	go func() { applied <- routes.Apply(ctx, []Endpoint{kept, added}) }()
+	expectGoingAway(t, removedConn)
+	if err := <-applied; err != nil {
+		t.Fatalf("Apply failed: %v", err)
+	}
+
+	if state, _ := registry.State("old"); state != services.Stopped {
+		t.Errorf("expected the removed endpoint's service to stop, got %s", state)
+	}
+	if code := status(t, server, "/ws/old"); code != http.StatusNotFound {
+		t.Errorf("expected 404 for the removed endpoint, got %d", code)
+	}
+	echoes(t, keptConn)
+	echoes(t, dial(t, server, "/ws/new"))
+}
+
+func TestRoutesApplyRestartsChangedEndpoints(t *testing.T) {
+	routes, _, server := newRoutesServer(t)
+	ctx := t.Context()
+
+	clock := Endpoint{Path: "/ws/clock", Service: "timenow", Options: services.Options{"interval": "1h"}}
+	if err := routes.Apply(ctx, []Endpoint{clock}); err != nil {
+		t.Fatalf("Apply failed: %v", err)
+	}
+	conn := dial(t, server, "/ws/clock")
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err := conn.ReadMessage(); err != nil {
+		t.Fatalf("expected the first tick right away, got %v", err)
+	}
+
+	clock.Options = services.Options{"interval": "100ms", "format": "unix"}
+	applied := make(chan error, 1)
+	go func() { applied <- routes.Apply(ctx, []Endpoint{clock}) }()
+	expectGoingAway(t, conn)
+	if err := <-applied; err != nil {
+		t.Fatalf("Apply failed: %v", err)
+	}
+
+	// The reconnecting client gets a service with the new settings rather
+	// than the lingering old one.
+	conn = dial(t, server, "/ws/clock")
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, payload, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("expected a tick at the new interval, got %v", err)
+	}
+	if strings.Contains(string(payload), "T") {
+		t.Errorf("expected a unix timestamp, got '%s'", payload)
+	}
+}
+
+func TestWatchReportsChanges(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	os.WriteFile(path, []byte(`{}`), 0o644)
+
+	changes := Watch(t.Context(), path, 10*time.Millisecond)
+
+	select {
+	case <-changes:
+		t.Fatal("unexpected change before writing")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	os.WriteFile(path, []byte(`{"listen": [":3001"]}`), 0o644)
+	select {
+	case <-changes:
+	case <-time.After(time.Second):
+		t.Fatal("expected a change after writing")
+	}
+}
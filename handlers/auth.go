@@ -0,0 +1,56 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/samuel1992/ws-server-with-messagebus/auth"
+)
+
+// SetAuthenticator makes every endpoint identify its users with
+// authenticator before upgrading, refusing those it does not accept. nil,
+// the default, lets anybody connect.
+func (h *WS) SetAuthenticator(authenticator auth.Authenticator) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.authenticator = authenticator
+}
+
+// authenticate identifies the user of r with authenticator and checks that
+// they have one of the endpoint's roles. It answers 401 or 403 and returns
+// false if they may not connect. The principal is nil without an
+// authenticator.
+func (e Endpoint) authenticate(w http.ResponseWriter, r *http.Request, authenticator auth.Authenticator) (*auth.Principal, bool) {
+	if authenticator == nil {
+		return nil, true
+	}
+
+	principal, err := authenticator.Authenticate(r)
+	if err == nil && principal == nil {
+		err = auth.ErrNoCredentials
+	}
+	if err == nil && !principal.HasAnyRole(e.Roles...) {
+		err = fmt.Errorf("%w: %s needs one of the roles %q", auth.ErrForbidden, principal.UserID, e.Roles)
+	}
+	if err == nil {
+		return principal, true
+	}
+
+	log.Printf("Endpoint %s: refused upgrade from %s: %v", e.Name, r.RemoteAddr, err)
+	if errors.Is(err, auth.ErrForbidden) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return nil, false
+	}
+	// Only say whether credentials were missing or wrong; the details are
+	// in the log.
+	w.Header().Set("WWW-Authenticate", `Bearer realm="websocket"`)
+	message := "authentication required"
+	if errors.Is(err, auth.ErrInvalidCredentials) {
+		message = "invalid credentials"
+	}
+	http.Error(w, message, http.StatusUnauthorized)
+	return nil, false
+}
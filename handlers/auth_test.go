@@ -0,0 +1,80 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/samuel1992/ws-server-with-messagebus/auth"
+	"github.com/samuel1992/ws-server-with-messagebus/messagebus"
+	"github.com/samuel1992/ws-server-with-messagebus/services"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestHandleAuthenticates(t *testing.T) {
+	secret := []byte("s3cret")
+	bus := messagebus.NewInMemoryMessageBus()
+	handler := NewWSHandler(services.NewServiceRegistry(bus), bus)
+	handler.SetAuthenticator(auth.Chain(auth.Bearer(auth.HMAC(secret)), auth.Query("token", auth.HMAC(secret))))
+	router := NewRouter(handler)
+	router.Handle("/ws/echo", Endpoint{Factory: Adapt(services.NewEchoService)})
+	router.Handle("/ws/admin", Endpoint{Factory: Adapt(services.NewEchoService), Roles: []string{"admin"}})
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+
+	dialAs := func(path, token string) (*websocket.Conn, *http.Response) {
+		url := "ws" + strings.TrimPrefix(server.URL, "http") + path
+		header := http.Header{}
+		if token != "" {
+			header.Set("Authorization", "Bearer "+token)
+		}
+		conn, resp, err := websocket.DefaultDialer.Dial(url, header)
+		if err != nil {
+			if resp == nil {
+				t.Fatalf("Dial failed: %v", err)
+			}
+			return nil, resp
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn, resp
+	}
+
+	alice := auth.Sign(secret, auth.Principal{UserID: "alice", Roles: []string{"user"}}, time.Minute)
+	root := auth.Sign(secret, auth.Principal{UserID: "root", Roles: []string{"admin"}}, time.Minute)
+
+	_, resp := dialAs("/ws/echo", "")
+	if resp.StatusCode != http.StatusUnauthorized || resp.Header.Get("WWW-Authenticate") == "" {
+		t.Errorf("expected 401 with a challenge without credentials, got %d", resp.StatusCode)
+	}
+	if _, resp := dialAs("/ws/echo", alice+"x"); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected 401 for a forged token, got %d", resp.StatusCode)
+	}
+	if _, resp := dialAs("/ws/admin", alice); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected 403 without the endpoint's role, got %d", resp.StatusCode)
+	}
+	if conn, _ := dialAs("/ws/admin", root); conn == nil {
+		t.Error("expected the admin to connect")
+	}
+	if conn, _ := dialAs("/ws/echo?token="+alice, ""); conn == nil {
+		t.Error("expected a query token to be accepted")
+	}
+
+	// Services see who sent each message.
+	sent, err := bus.Subscribe(t.Context(), "echo:from-ws-to-service")
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	conn, _ := dialAs("/ws/echo", alice)
+	roundTrip(t, conn, "hi")
+	select {
+	case msg := <-sent:
+		if p := auth.FromMessage(msg); p == nil || p.UserID != "alice" || !p.HasRole("user") {
+			t.Errorf("expected alice's headers, got %v", msg.Headers)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the message on the bus")
+	}
+}
@@ -1,10 +1,20 @@
 package handlers
 
 import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
 	"log"
+	"maps"
 	"net/http"
-	"strings"
+	"regexp"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
 
+	"github.com/samuel1992/ws-server-with-messagebus/auth"
 	"github.com/samuel1992/ws-server-with-messagebus/messagebus"
 	"github.com/samuel1992/ws-server-with-messagebus/services"
 	"github.com/samuel1992/ws-server-with-messagebus/ws"
@@ -12,10 +22,32 @@ import (
 	"github.com/gorilla/websocket"
 )
 
+// lateDrainTimeout bounds the shutdown of a client upgraded while the
+// connections were already being closed.
+const lateDrainTimeout = 10 * time.Second
+
 type WS struct {
 	registry *services.ServiceRegistry
 	bus      messagebus.MessageBus
 	upgrader websocket.Upgrader
+
+	// clientSubscribeOptions configure the subscription each WebSocket
+	// client uses to receive messages from its service.
+	clientSubscribeOptions []messagebus.SubscribeOption
+
+	mu           sync.Mutex
+	clients      map[*ws.Client]*connection
+	shuttingDown bool
+	// origins decides which web pages may connect, unless an endpoint has
+	// its own policy.
+	origins OriginPolicy
+	// authenticator identifies users before upgrading, if set.
+	authenticator auth.Authenticator
+	// closing counts the CloseEndpoint calls in progress per endpoint.
+	closing map[string]int
+	// active counts running Handle calls so Shutdown can wait for them to
+	// release their services.
+	active sync.WaitGroup
 }
 
 func NewWSHandler(registry *services.ServiceRegistry, bus messagebus.MessageBus) *WS {
@@ -23,51 +55,413 @@ func NewWSHandler(registry *services.ServiceRegistry, bus messagebus.MessageBus)
 		registry: registry,
 		bus:      bus,
 		upgrader: websocket.Upgrader{
-			ReadBufferSize:  1024,
-			WriteBufferSize: 1024,
-			CheckOrigin:     func(r *http.Request) bool { return true },
+			// HandleEndpoint checks the origin itself, before the upgrade, to
+			// answer with a clear rejection.
+			CheckOrigin: func(r *http.Request) bool { return true },
 		},
+		// A client that cannot keep up is evicted rather than silently
+		// missing messages; it can reconnect and resume from a clean state.
+		clientSubscribeOptions: []messagebus.SubscribeOption{
+			messagebus.WithOverflowPolicy(messagebus.DisconnectSlowConsumer),
+		},
+		clients: make(map[*ws.Client]*connection),
+		closing: make(map[string]int),
+	}
+}
+
+// connection is what the handler tracks of a connected client.
+type connection struct {
+	endpoint string
+	// released is closed once the client's service reference is given back.
+	released chan struct{}
+}
+
+// SetOriginPolicy sets which web pages may open WebSockets to endpoints
+// without their own policy. It defaults to the server's own origin only.
+func (h *WS) SetOriginPolicy(policy OriginPolicy) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.origins = policy
+}
+
+// SetClientSubscribeOptions replaces the subscription options used for the
+// bus-to-WebSocket direction of every new connection.
+func (h *WS) SetClientSubscribeOptions(opts ...messagebus.SubscribeOption) {
+	h.clientSubscribeOptions = opts
+}
+
+// subscribeOptions returns the client subscription options for r. A "from"
+// query parameter ("earliest", "latest" or an offset) lets a reconnecting
+// client replay what it missed on backends that keep a log; such clients
+// get the offset of each message (see ws.Client.SetSendOffsets).
+func (h *WS) subscribeOptions(r *http.Request) ([]messagebus.SubscribeOption, error) {
+	from := r.URL.Query().Get("from")
+	if from == "" {
+		return h.clientSubscribeOptions, nil
+	}
+
+	var offset int64
+	switch from {
+	case "earliest":
+		offset = messagebus.OffsetEarliest
+	case "latest":
+		offset = messagebus.OffsetLatest
+	default:
+		var err error
+		offset, err = strconv.ParseInt(from, 10, 64)
+		if err != nil || offset < 0 {
+			return nil, fmt.Errorf("invalid from %q: want earliest, latest or an offset", from)
+		}
+	}
+
+	opts := slices.Clone(h.clientSubscribeOptions)
+	return append(opts, messagebus.WithStartOffset(offset)), nil
+}
+
+// CloseEndpoint closes the connections of the endpoint named name like
+// Shutdown does, with CloseGoingAway so clients reconnect, and waits until
+// their handlers have released their service instances. Connections
+// upgraded meanwhile are closed too. New connections are not refused;
+// remove or suspend the endpoint's route first.
+func (h *WS) CloseEndpoint(ctx context.Context, name string) error {
+	h.mu.Lock()
+	h.closing[name]++
+	var clients []*ws.Client
+	var released []chan struct{}
+	for client, conn := range h.clients {
+		if conn.endpoint == name {
+			clients = append(clients, client)
+			released = append(released, conn.released)
+		}
+	}
+	h.mu.Unlock()
+	defer func() {
+		h.mu.Lock()
+		if h.closing[name]--; h.closing[name] == 0 {
+			delete(h.closing, name)
+		}
+		h.mu.Unlock()
+	}()
+
+	log.Printf("Closing %d WebSocket connections of %s", len(clients), name)
+
+	var wg sync.WaitGroup
+	for _, client := range clients {
+		wg.Go(func() {
+			client.Shutdown(ctx)
+		})
+	}
+	wg.Wait()
+
+	for _, done := range released {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 	}
+	return nil
 }
 
+// Shutdown refuses new connections with 503, asks every connected client to
+// flush what is queued for it and close with CloseGoingAway, and waits until
+// their handlers have released their services. Connections still open when
+// ctx expires are closed abruptly.
+func (h *WS) Shutdown(ctx context.Context) error {
+	h.mu.Lock()
+	h.shuttingDown = true
+	clients := slices.Collect(maps.Keys(h.clients))
+	h.mu.Unlock()
+
+	log.Printf("Closing %d WebSocket connections", len(clients))
+
+	var wg sync.WaitGroup
+	for _, client := range clients {
+		wg.Go(func() {
+			client.Shutdown(ctx)
+		})
+	}
+	wg.Wait()
+
+	done := make(chan struct{})
+	go func() {
+		h.active.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// ServiceFactory creates a service that only needs its topics.
 type ServiceFactory func(bus messagebus.MessageBus, fromWsToService, fromServiceToWs string) services.Service
 
+// ServiceConfig describes the service instance an EndpointFactory creates.
+type ServiceConfig struct {
+	Bus messagebus.MessageBus
+	// Endpoint is the endpoint name and Instance the registry key of the
+	// instance, which prefixes its topics.
+	Endpoint        string
+	Instance        string
+	FromWsToService string
+	FromServiceToWs string
+	// Params are those of the connection that created the instance.
+	Params Params
+	// Options are the endpoint's options with the connection's overrides.
+	Options services.Options
+	// Principal is the authenticated user of the connection, or nil if the
+	// handler has no Authenticator. Shared instances serve other users too;
+	// use the user headers of each message (see auth.FromMessage) there.
+	Principal *auth.Principal
+}
+
+// EndpointFactory creates the service instance described by cfg, or fails
+// if cfg.Options do not validate. It is called for every connection to
+// check its options, but the service is only started if the connection
+// creates the instance, so creating a service must not have side effects.
+type EndpointFactory func(cfg ServiceConfig) (services.Service, error)
+
+// Construct serves an Endpoint with services made by constructor, usually
+// one registered with services.Register.
+func Construct(constructor services.Constructor) EndpointFactory {
+	return func(cfg ServiceConfig) (services.Service, error) {
+		return constructor(cfg.Bus, cfg.FromWsToService, cfg.FromServiceToWs, cfg.Options)
+	}
+}
+
+// Adapt lets factory, which only needs its topics, serve an Endpoint.
+func Adapt(factory ServiceFactory) EndpointFactory {
+	return func(cfg ServiceConfig) (services.Service, error) {
+		if err := cfg.Options.Allow(); err != nil {
+			return nil, err
+		}
+		return factory(cfg.Bus, cfg.FromWsToService, cfg.FromServiceToWs), nil
+	}
+}
+
+// Scope decides which connections of an endpoint share a service instance.
+type Scope int
+
+const (
+	// ScopeShared serves every connection with one instance.
+	ScopeShared Scope = iota
+	// ScopeConnection gives each connection an instance of its own, for
+	// stateful conversations.
+	ScopeConnection
+	// ScopeKey shares an instance between the connections that name the same
+	// key in Endpoint.KeyParam, e.g. one instance per chat room.
+	ScopeKey
+)
+
+// Endpoint describes a WebSocket endpoint and the service behind it.
+type Endpoint struct {
+	// Name prefixes the endpoint's topics and registry entries. Defaults to
+	// the literal segments after "/ws/" of the route pattern, or of the
+	// request path outside a Router.
+	Name    string
+	Factory EndpointFactory
+	Scope   Scope
+	// KeyParam is the path or query parameter holding the instance key when
+	// Scope is ScopeKey, e.g. "room" for /ws/rooms/{room} or /ws/chat?room=.
+	KeyParam string
+	// Options configure the service. A connection may override those named
+	// in QueryOptions with query parameters of the same name. Overrides only
+	// shape an instance the connection creates, so they are meant for
+	// ScopeConnection and ScopeKey endpoints.
+	Options      services.Options
+	QueryOptions []string
+	// Client sets the limits and timeouts of the endpoint's connections.
+	Client ws.ClientOptions
+	// Origins, if set, replaces the handler's origin policy for this
+	// endpoint.
+	Origins *OriginPolicy
+	// Roles, if set, restrict the endpoint to authenticated users with one
+	// of them. They require an authenticator (see WS.SetAuthenticator).
+	Roles []string
+}
+
+// options returns the endpoint's options with the overrides of params.
+func (e Endpoint) options(params Params) services.Options {
+	overrides := make(services.Options)
+	for _, name := range e.QueryOptions {
+		if params.Query.Has(name) {
+			overrides[name] = params.Query.Get(name)
+		}
+	}
+	return e.Options.With(overrides)
+}
+
+// validKey limits scope keys to what is safe inside topics and registry
+// keys: no separators or wildcards.
+var validKey = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// scopeKey returns the scope key of the service instance serving params:
+// empty for shared endpoints, a fresh ID per connection, or the key
+// parameter.
+func (e Endpoint) scopeKey(params Params) (string, error) {
+	switch e.Scope {
+	case ScopeConnection:
+		return messagebus.NewID(), nil
+	case ScopeKey:
+		key := params.Get(e.KeyParam)
+		if !validKey.MatchString(key) {
+			return "", fmt.Errorf("invalid %s %q: want 1 to 64 letters, digits, '-' or '_'", e.KeyParam, key)
+		}
+		return key, nil
+	default:
+		return "", nil
+	}
+}
+
+// Handle serves a shared endpoint named after the request's route.
 func (h *WS) Handle(w http.ResponseWriter, r *http.Request, serviceFactory ServiceFactory) {
-	endpoint := strings.TrimPrefix(r.URL.Path, "/ws/")
+	h.HandleEndpoint(w, r, Endpoint{Factory: Adapt(serviceFactory)})
+}
+
+// HandleEndpoint upgrades r and connects it to the instance of endpoint's
+// service chosen by its scope, creating the instance if needed. Topics are
+// "<instance>:from-ws-to-service" and "<instance>:from-service-to-ws", where
+// instance is the endpoint name, followed by "." and the scope key for
+// endpoints that are not shared. Before the upgrade, requests from origins
+// the endpoint does not allow are refused with 403, users the authenticator
+// does not accept with 401 or 403, and connections whose options do not
+// validate with 400.
+func (h *WS) HandleEndpoint(w http.ResponseWriter, r *http.Request, endpoint Endpoint) {
+	h.mu.Lock()
+	if h.shuttingDown {
+		h.mu.Unlock()
+		http.Error(w, "server shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	h.active.Add(1)
+	origins := h.origins
+	authenticator := h.authenticator
+	h.mu.Unlock()
+	defer h.active.Done()
+
+	if endpoint.Name == "" {
+		endpoint.Name = EndpointName(cmp.Or(r.Pattern, r.URL.Path))
+	}
+
+	if endpoint.Origins != nil {
+		origins = *endpoint.Origins
+	}
+	if err := origins.Check(r); err != nil {
+		log.Printf("Endpoint %s: refused upgrade from %s: %v", endpoint.Name, r.RemoteAddr, err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if len(endpoint.Roles) > 0 && authenticator == nil {
+		log.Printf("Endpoint %s: roles are set but there is no authenticator", endpoint.Name)
+		http.Error(w, "endpoint misconfigured", http.StatusInternalServerError)
+		return
+	}
+	principal, ok := endpoint.authenticate(w, r, authenticator)
+	if !ok {
+		return
+	}
+
+	params := requestParams(r)
+	key, err := endpoint.scopeKey(params)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	instance := services.InstanceKey(endpoint.Name, key)
 
-	fromWsToService := endpoint + ":from-ws-to-service"
-	fromServiceToWs := endpoint + ":from-service-to-ws"
+	cfg := ServiceConfig{
+		Bus:             h.bus,
+		Endpoint:        endpoint.Name,
+		Instance:        instance,
+		FromWsToService: instance + ":from-ws-to-service",
+		FromServiceToWs: instance + ":from-service-to-ws",
+		Params:          params,
+		Options:         endpoint.options(params),
+		Principal:       principal,
+	}
+	service, err := endpoint.Factory(cfg)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, services.ErrInvalidOptions) {
+			status = http.StatusBadRequest
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
 
-	conn, err := h.upgrader.Upgrade(w, r, nil)
+	subscribeOptions, err := h.subscribeOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	clientOptions := endpoint.Client.WithDefaults()
+	if err := clientOptions.Validate(); err != nil {
+		log.Printf("Endpoint %s: %v", endpoint.Name, err)
+		http.Error(w, "endpoint misconfigured", http.StatusInternalServerError)
+		return
+	}
+	upgrader := h.upgrader
+	upgrader.ReadBufferSize = clientOptions.ReadBufferSize
+	upgrader.WriteBufferSize = clientOptions.WriteBufferSize
+
+	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Println(err)
 		return
 	}
 
-	service, err := h.registry.Get(endpoint)
+	_, err = h.registry.AcquireInstance(endpoint.Name, key, func() services.Service {
+		return service
+	})
 	if err != nil {
-		log.Println("Error getting service:", err)
+		log.Println("Error starting service:", err)
 		conn.Close()
 		return
 	}
-	if service == nil {
-		newService := serviceFactory(h.bus, fromWsToService, fromServiceToWs)
-		h.registry.Add(endpoint, newService)
-	}
 
-	wsClient := ws.NewClient(conn, h.bus, fromServiceToWs, fromWsToService)
+	wsClient := ws.NewClientWithOptions(conn, h.bus, cfg.FromServiceToWs, cfg.FromWsToService, clientOptions, subscribeOptions...)
+	wsClient.SetPrincipal(principal)
+	wsClient.SetSendOffsets(r.URL.Query().Has("from"))
+
+	tracked := &connection{endpoint: endpoint.Name, released: make(chan struct{})}
+	h.mu.Lock()
+	h.clients[wsClient] = tracked
+	// Upgraded while Shutdown or CloseEndpoint was collecting the clients to
+	// close.
+	late := h.shuttingDown || h.closing[endpoint.Name] > 0
+	h.mu.Unlock()
+	if late {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), lateDrainTimeout)
+			defer cancel()
+			wsClient.Shutdown(ctx)
+		}()
+	}
 
 	defer func() {
 		log.Println("Cleaning up service resources")
 		wsClient.Stop()
-		h.registry.Release(endpoint)
+		if endpoint.Scope == ScopeConnection {
+			// Nobody else can reacquire it, lingering would be pointless.
+			h.registry.Discard(instance)
+		} else {
+			h.registry.Release(instance)
+		}
+
+		h.mu.Lock()
+		delete(h.clients, wsClient)
+		h.mu.Unlock()
+		close(tracked.released)
 	}()
 
-	err = wsClient.Start()
+	err = wsClient.Start(r.Context())
 	if err != nil {
-		log.Println("Error starting WS client:", err)
-		wsClient.Stop()
-		h.registry.Release(endpoint)
-		return
+		log.Println("Error running WS client:", err)
 	}
 }
@@ -0,0 +1,479 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/samuel1992/ws-server-with-messagebus/messagebus"
+	"github.com/samuel1992/ws-server-with-messagebus/services"
+
+	"github.com/gorilla/websocket"
+)
+
+// newTestServer serves handler on /ws/<endpoint> with EchoService behind it.
+func newTestServer(t *testing.T, handler *WS) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.Handle(w, r, services.NewEchoService)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func dial(t *testing.T, server *httptest.Server, path string) *websocket.Conn {
+	t.Helper()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + path
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestHandleEchoes(t *testing.T) {
+	bus := messagebus.NewInMemoryMessageBus()
+	handler := NewWSHandler(services.NewServiceRegistry(bus), bus)
+	conn := dial(t, newTestServer(t, handler), "/ws/echo")
+
+	conn.WriteMessage(websocket.TextMessage, []byte("hello"))
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, payload, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage failed: %v", err)
+	}
+	if string(payload) != "hello" {
+		t.Errorf("expected 'hello', got '%s'", payload)
+	}
+}
+
+func TestReplayLargerThanTheBuffer(t *testing.T) {
+	bus, err := messagebus.NewFileMessageBus(messagebus.FileOptions{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("NewFileMessageBus failed: %v", err)
+	}
+	defer bus.Close()
+
+	backlog := 4 * messagebus.DefaultBufferSize
+	for i := range backlog {
+		bus.Publish(context.Background(), "echo:from-service-to-ws", messagebus.NewMessage([]byte(strconv.Itoa(i))))
+	}
+
+	handler := NewWSHandler(services.NewServiceRegistry(bus), bus)
+	conn := dial(t, newTestServer(t, handler), "/ws/echo?from=earliest")
+
+	for i := range backlog {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, payload, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("expected message %d of the replay, got %v", i, err)
+		}
+		if want := fmt.Sprintf("%d %d", i, i); string(payload) != want {
+			t.Fatalf("expected '%s', got '%s'", want, payload)
+		}
+	}
+}
+
+func TestResumeFromDeliveredOffset(t *testing.T) {
+	bus, err := messagebus.NewFileMessageBus(messagebus.FileOptions{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("NewFileMessageBus failed: %v", err)
+	}
+	defer bus.Close()
+	server := newTestServer(t, NewWSHandler(services.NewServiceRegistry(bus), bus))
+
+	read := func(conn *websocket.Conn) (string, string) {
+		t.Helper()
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, frame, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("ReadMessage failed: %v", err)
+		}
+		offset, payload, ok := strings.Cut(string(frame), " ")
+		if !ok {
+			t.Fatalf("expected an offset before the payload, got '%s'", frame)
+		}
+		return offset, payload
+	}
+
+	publish := func(payload string) {
+		bus.Publish(context.Background(), "echo:from-service-to-ws", messagebus.NewMessage([]byte(payload)))
+	}
+
+	publish("first")
+	conn := dial(t, server, "/ws/echo?from=earliest")
+	offset, payload := read(conn)
+	if payload != "first" {
+		t.Fatalf("expected 'first', got '%s'", payload)
+	}
+	conn.Close()
+
+	// Published while the client was away, e.g. during a deploy.
+	publish("second")
+	last, err := strconv.ParseInt(offset, 10, 64)
+	if err != nil {
+		t.Fatalf("invalid offset %q: %v", offset, err)
+	}
+	conn = dial(t, server, fmt.Sprintf("/ws/echo?from=%d", last+1))
+	if _, payload := read(conn); payload != "second" {
+		t.Errorf("expected 'second', got '%s'", payload)
+	}
+
+	// Without from, payloads are sent as they are.
+	plain := dial(t, server, "/ws/echo")
+	plain.WriteMessage(websocket.TextMessage, []byte("ping"))
+	plain.SetReadDeadline(time.Now().Add(time.Second))
+	if _, frame, err := plain.ReadMessage(); err != nil || string(frame) != "ping" {
+		t.Errorf("expected 'ping', got '%s' (%v)", frame, err)
+	}
+}
+
+func TestShutdownDrainsAndSendsGoingAway(t *testing.T) {
+	bus := messagebus.NewInMemoryMessageBus()
+	registry := services.NewServiceRegistry(bus)
+	handler := NewWSHandler(registry, bus)
+	server := newTestServer(t, handler)
+	conn := dial(t, server, "/ws/echo")
+
+	// Make sure the client is subscribed before queueing a broadcast.
+	conn.WriteMessage(websocket.TextMessage, []byte("ping"))
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err := conn.ReadMessage(); err != nil {
+		t.Fatalf("ReadMessage failed: %v", err)
+	}
+
+	bus.Publish(context.Background(), "echo:from-service-to-ws", messagebus.NewMessage([]byte("last words")))
+
+	shutdownErr := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		shutdownErr <- handler.Shutdown(ctx)
+	}()
+
+	_, payload, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("expected the queued message before closing, got %v", err)
+	}
+	if string(payload) != "last words" {
+		t.Errorf("expected 'last words', got '%s'", payload)
+	}
+
+	_, _, err = conn.ReadMessage()
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != websocket.CloseGoingAway {
+		t.Fatalf("expected CloseGoingAway, got %v", err)
+	}
+
+	if err := <-shutdownErr; err != nil {
+		t.Errorf("Shutdown failed: %v", err)
+	}
+	if state, _ := registry.State("echo"); state != services.Stopped {
+		t.Errorf("expected the service to be released, got %s", state)
+	}
+
+	// New upgrades are refused.
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws/echo"
+	_, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	if err == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 after Shutdown, got %v", err)
+	}
+}
+
+// countingFactory wraps EchoService and records the config of every
+// instance it starts. It accepts a "greeting" option.
+type countingFactory struct {
+	mu      sync.Mutex
+	configs []ServiceConfig
+}
+
+func (f *countingFactory) create(cfg ServiceConfig) (services.Service, error) {
+	if err := cfg.Options.Allow("greeting"); err != nil {
+		return nil, err
+	}
+	return &countedService{
+		Service: services.NewEchoService(cfg.Bus, cfg.FromWsToService, cfg.FromServiceToWs),
+		factory: f,
+		cfg:     cfg,
+	}, nil
+}
+
+type countedService struct {
+	services.Service
+	factory *countingFactory
+	cfg     ServiceConfig
+}
+
+func (s *countedService) Start(ctx context.Context) error {
+	s.factory.mu.Lock()
+	s.factory.configs = append(s.factory.configs, s.cfg)
+	s.factory.mu.Unlock()
+	return s.Service.Start(ctx)
+}
+
+// created returns the read topics of the instances started so far.
+func (f *countingFactory) created() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var topics []string
+	for _, cfg := range f.configs {
+		topics = append(topics, cfg.FromWsToService)
+	}
+	return topics
+}
+
+func newScopedServer(t *testing.T, endpoint Endpoint) (*httptest.Server, *services.ServiceRegistry) {
+	t.Helper()
+
+	bus := messagebus.NewInMemoryMessageBus()
+	registry := services.NewServiceRegistry(bus)
+	handler := NewWSHandler(registry, bus)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.HandleEndpoint(w, r, endpoint)
+	}))
+	t.Cleanup(server.Close)
+	return server, registry
+}
+
+// roundTrip sends payload on conn and waits for the echo, which also proves
+// the connection's service instance is up.
+func roundTrip(t *testing.T, conn *websocket.Conn, payload string) {
+	t.Helper()
+
+	conn.WriteMessage(websocket.TextMessage, []byte(payload))
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, got, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage failed: %v", err)
+	}
+	if string(got) != payload {
+		t.Errorf("expected '%s', got '%s'", payload, got)
+	}
+}
+
+func TestScopeConnectionCreatesInstancePerConnection(t *testing.T) {
+	factory := &countingFactory{}
+	server, _ := newScopedServer(t, Endpoint{Name: "session", Factory: factory.create, Scope: ScopeConnection})
+
+	roundTrip(t, dial(t, server, "/ws/session"), "a")
+	roundTrip(t, dial(t, server, "/ws/session"), "b")
+
+	topics := factory.created()
+	if len(topics) != 2 || topics[0] == topics[1] {
+		t.Fatalf("expected two distinct instances, got %v", topics)
+	}
+	if !strings.HasPrefix(topics[0], "session.") {
+		t.Errorf("expected topics under the endpoint name, got %s", topics[0])
+	}
+}
+
+func TestScopeKeySharesInstancePerKey(t *testing.T) {
+	factory := &countingFactory{}
+	server, registry := newScopedServer(t, Endpoint{Name: "chat", Factory: factory.create, Scope: ScopeKey, KeyParam: "room"})
+
+	roundTrip(t, dial(t, server, "/ws/chat?room=lobby"), "a")
+	roundTrip(t, dial(t, server, "/ws/chat?room=lobby"), "b")
+	roundTrip(t, dial(t, server, "/ws/chat?room=games"), "c")
+
+	topics := factory.created()
+	slices.Sort(topics)
+	want := []string{"chat.games:from-ws-to-service", "chat.lobby:from-ws-to-service"}
+	if !slices.Equal(topics, want) {
+		t.Errorf("expected instances %v, got %v", want, topics)
+	}
+	if state, _ := registry.State("chat.lobby"); state != services.Running {
+		t.Errorf("expected chat.lobby running, got %s", state)
+	}
+}
+
+func TestScopeKeyRejectsInvalidKey(t *testing.T) {
+	server, _ := newScopedServer(t, Endpoint{Name: "chat", Factory: Adapt(services.NewEchoService), Scope: ScopeKey, KeyParam: "room"})
+
+	for _, query := range []string{"", "?room=", "?room=a.b", "?room=*"} {
+		resp, err := http.Get(server.URL + "/ws/chat" + query)
+		if err != nil {
+			t.Fatalf("GET failed: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%q: expected 400, got %d", query, resp.StatusCode)
+		}
+	}
+}
+
+func newRouterServer(t *testing.T, pattern string, endpoint Endpoint) *httptest.Server {
+	t.Helper()
+
+	bus := messagebus.NewInMemoryMessageBus()
+	router := NewRouter(NewWSHandler(services.NewServiceRegistry(bus), bus))
+	router.Handle(pattern, endpoint)
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestRouterPassesParamsToFactory(t *testing.T) {
+	factory := &countingFactory{}
+	server := newRouterServer(t, "/ws/{tenant}/rooms/{room}", Endpoint{Factory: factory.create, Scope: ScopeKey, KeyParam: "room"})
+
+	roundTrip(t, dial(t, server, "/ws/acme/rooms/lobby?lang=en"), "hello")
+
+	factory.mu.Lock()
+	defer factory.mu.Unlock()
+	if len(factory.configs) != 1 {
+		t.Fatalf("expected one instance, got %d", len(factory.configs))
+	}
+	cfg := factory.configs[0]
+	if cfg.Endpoint != "rooms" || cfg.Instance != "rooms.lobby" {
+		t.Errorf("expected endpoint rooms, instance rooms.lobby, got %s, %s", cfg.Endpoint, cfg.Instance)
+	}
+	if cfg.FromWsToService != "rooms.lobby:from-ws-to-service" {
+		t.Errorf("unexpected topic %s", cfg.FromWsToService)
+	}
+	if cfg.Params.Get("tenant") != "acme" || cfg.Params.Get("room") != "lobby" || cfg.Params.Get("lang") != "en" {
+		t.Errorf("unexpected params %+v", cfg.Params)
+	}
+}
+
+func TestRouterSharesInstancePerPathKey(t *testing.T) {
+	factory := &countingFactory{}
+	server := newRouterServer(t, "/ws/rooms/{room}", Endpoint{Factory: factory.create, Scope: ScopeKey, KeyParam: "room"})
+
+	roundTrip(t, dial(t, server, "/ws/rooms/lobby"), "a")
+	roundTrip(t, dial(t, server, "/ws/rooms/lobby"), "b")
+	roundTrip(t, dial(t, server, "/ws/rooms/games"), "c")
+
+	topics := factory.created()
+	slices.Sort(topics)
+	want := []string{"rooms.games:from-ws-to-service", "rooms.lobby:from-ws-to-service"}
+	if !slices.Equal(topics, want) {
+		t.Errorf("expected instances %v, got %v", want, topics)
+	}
+
+	// Path keys are validated like query keys, unknown routes are not found.
+	for path, status := range map[string]int{"/ws/rooms/a.b": http.StatusBadRequest, "/ws/other": http.StatusNotFound} {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatalf("GET failed: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != status {
+			t.Errorf("%s: expected %d, got %d", path, status, resp.StatusCode)
+		}
+	}
+}
+
+func TestEndpointName(t *testing.T) {
+	for pattern, want := range map[string]string{
+		"/ws/echo":                  "echo",
+		"GET /ws/rooms/{room}":      "rooms",
+		"/ws/{tenant}/chat/{id...}": "chat",
+		"/ws/a/b/{$}":               "a/b",
+	} {
+		if got := EndpointName(pattern); got != want {
+			t.Errorf("EndpointName(%q) = %q, want %q", pattern, got, want)
+		}
+	}
+}
+
+func TestEndpointOptions(t *testing.T) {
+	factory := &countingFactory{}
+	server, _ := newScopedServer(t, Endpoint{
+		Name:         "session",
+		Factory:      factory.create,
+		Scope:        ScopeConnection,
+		Options:      services.Options{"greeting": "hi"},
+		QueryOptions: []string{"greeting"},
+	})
+
+	roundTrip(t, dial(t, server, "/ws/session"), "a")
+	roundTrip(t, dial(t, server, "/ws/session?greeting=hello&other=ignored"), "b")
+
+	factory.mu.Lock()
+	var greetings []string
+	for _, cfg := range factory.configs {
+		greetings = append(greetings, cfg.Options["greeting"])
+		if _, ok := cfg.Options["other"]; ok {
+			t.Error("expected query parameters not in QueryOptions to be ignored")
+		}
+	}
+	factory.mu.Unlock()
+	if !slices.Equal(greetings, []string{"hi", "hello"}) {
+		t.Errorf("expected greetings [hi hello], got %v", greetings)
+	}
+}
+
+func TestInvalidOptionsAreRejected(t *testing.T) {
+	server, _ := newScopedServer(t, Endpoint{
+		Name: "clock",
+		Factory: func(cfg ServiceConfig) (services.Service, error) {
+			opts, err := services.ParseTimeNowOptions(cfg.Options)
+			if err != nil {
+				return nil, err
+			}
+			return services.NewTimeNowServiceWithOptions(cfg.Bus, cfg.FromWsToService, cfg.FromServiceToWs, opts), nil
+		},
+		Scope:        ScopeConnection,
+		QueryOptions: []string{"interval", "timezone"},
+	})
+
+	for _, query := range []string{"?interval=soon", "?interval=1ms", "?timezone=Mars/Olympus"} {
+		resp, err := http.Get(server.URL + "/ws/clock" + query)
+		if err != nil {
+			t.Fatalf("GET failed: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%q: expected 400, got %d", query, resp.StatusCode)
+		}
+	}
+
+	conn := dial(t, server, "/ws/clock?interval=100ms&timezone=Asia/Tokyo")
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, payload, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage failed: %v", err)
+	}
+	if !strings.HasSuffix(string(payload), "+09:00") {
+		t.Errorf("expected a time in Tokyo, got %s", payload)
+	}
+}
+
+func TestRouterSuspendAndRemove(t *testing.T) {
+	server := newRouterServer(t, "/ws/echo", Endpoint{Factory: Adapt(services.NewEchoService)})
+	router := server.Config.Handler.(*Router)
+
+	get := func() int {
+		resp, err := http.Get(server.URL + "/ws/echo")
+		if err != nil {
+			t.Fatalf("GET failed: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	router.Suspend("/ws/echo")
+	if code := get(); code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 while suspended, got %d", code)
+	}
+	router.Handle("/ws/echo", Endpoint{Factory: Adapt(services.NewEchoService)})
+	roundTrip(t, dial(t, server, "/ws/echo"), "back")
+
+	router.Remove("/ws/echo")
+	if code := get(); code != http.StatusNotFound {
+		t.Errorf("expected 404 once removed, got %d", code)
+	}
+}
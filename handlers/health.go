@@ -0,0 +1,55 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/samuel1992/ws-server-with-messagebus/services"
+)
+
+type serviceStatus struct {
+	Endpoint string         `json:"endpoint"`
+	State    services.State `json:"state"`
+	Error    string         `json:"error,omitempty"`
+}
+
+type readiness struct {
+	Ready    bool            `json:"ready"`
+	Services []serviceStatus `json:"services"`
+}
+
+// Readiness reports whether every service of registry is healthy: 200 if so,
+// 503 otherwise, so a load balancer stops routing to this node. The body lists
+// each service's state and error. Checks taking longer than timeout fail.
+func Readiness(registry *services.ServiceRegistry, timeout time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+
+		body := readiness{Ready: true, Services: []serviceStatus{}}
+		for _, result := range registry.Health(ctx) {
+			status := serviceStatus{Endpoint: result.Endpoint, State: result.State}
+			if result.Err != nil {
+				body.Ready = false
+				status.Error = result.Err.Error()
+			}
+			body.Services = append(body.Services, status)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if !body.Ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		if err := json.NewEncoder(w).Encode(body); err != nil {
+			log.Println("Error writing readiness:", err)
+		}
+	}
+}
+
+// Liveness always answers 200: the process is up and serving HTTP.
+func Liveness(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+}
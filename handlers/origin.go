@@ -0,0 +1,133 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// ErrOriginNotAllowed is returned (wrapped) by OriginPolicy.Check for a
+// cross-origin request the policy does not allow.
+var ErrOriginNotAllowed = errors.New("origin not allowed")
+
+// OriginPolicy decides which web pages may open WebSockets to the server.
+// Browsers attach the user's cookies to upgrade requests from any page, so
+// without a check any website could talk to the server on their behalf.
+//
+// Requests from the server's own origin (the Origin host equals the request
+// Host) are always allowed, as are requests without an Origin header, which
+// do not come from browsers.
+type OriginPolicy struct {
+	// Allowed lists the other origins to accept:
+	//
+	//	"example.com"              that host, any scheme and port
+	//	"example.com:8443"         that host and port
+	//	"*.example.com"            any subdomain, but not example.com itself
+	//	"https://app.example.com"  that scheme and host
+	//	"null"                     opaque origins (sandboxed frames, files)
+	//	"*"                        any origin
+	Allowed []string
+}
+
+// Validate checks that every allowed origin is well-formed.
+func (p OriginPolicy) Validate() error {
+	var errs []error
+	for _, pattern := range p.Allowed {
+		if err := validateOrigin(pattern); err != nil {
+			errs = append(errs, fmt.Errorf("origin %q: %w", pattern, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func validateOrigin(pattern string) error {
+	if pattern == "*" || pattern == "null" {
+		return nil
+	}
+	host := pattern
+	if scheme, rest, ok := strings.Cut(pattern, "://"); ok {
+		if scheme != "http" && scheme != "https" {
+			return errors.New("scheme must be http or https")
+		}
+		host = rest
+	}
+	if host == "" || strings.ContainsAny(host, "/?#@") {
+		return errors.New("want a host, host:port or scheme://host, without a path")
+	}
+	if strings.Contains(strings.TrimPrefix(host, "*."), "*") {
+		return errors.New(`"*" is only allowed as the first label, as in "*.example.com"`)
+	}
+	return nil
+}
+
+// Check returns nil if r may be upgraded, or an error wrapping
+// ErrOriginNotAllowed that names the rejected origin.
+func (p OriginPolicy) Check(r *http.Request) error {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return nil
+	}
+	if origin == "null" {
+		if p.allows("null", nil) {
+			return nil
+		}
+		return fmt.Errorf("%w: %s", ErrOriginNotAllowed, origin)
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("%w: malformed origin %q", ErrOriginNotAllowed, origin)
+	}
+	if strings.EqualFold(u.Host, r.Host) || p.allows(origin, u) {
+		return nil
+	}
+	return fmt.Errorf("%w: %s", ErrOriginNotAllowed, origin)
+}
+
+// allows reports whether one of the allowed patterns matches origin, parsed
+// as u (nil for "null").
+func (p OriginPolicy) allows(origin string, u *url.URL) bool {
+	for _, pattern := range p.Allowed {
+		switch {
+		case pattern == "*":
+			return true
+		case pattern == "null" || u == nil:
+			if pattern == origin {
+				return true
+			}
+		default:
+			host := pattern
+			if scheme, rest, ok := strings.Cut(pattern, "://"); ok {
+				if !strings.EqualFold(scheme, u.Scheme) {
+					continue
+				}
+				host = rest
+			}
+			if matchHost(host, u) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchHost matches pattern, a host with an optional port and leading "*."
+// wildcard, against the host of u. Patterns without a port match any.
+func matchHost(pattern string, u *url.URL) bool {
+	hostname := strings.ToLower(u.Hostname())
+	if patternHost, port, err := net.SplitHostPort(pattern); err == nil {
+		if port != u.Port() {
+			return false
+		}
+		pattern = patternHost
+	}
+	pattern = strings.ToLower(pattern)
+
+	if suffix, ok := strings.CutPrefix(pattern, "*"); ok {
+		return strings.HasSuffix(hostname, suffix) && len(hostname) > len(suffix)
+	}
+	return hostname == pattern
+}
@@ -0,0 +1,117 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/samuel1992/ws-server-with-messagebus/messagebus"
+	"github.com/samuel1992/ws-server-with-messagebus/services"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestOriginPolicyCheck(t *testing.T) {
+	policy := OriginPolicy{Allowed: []string{
+		"partner.com",
+		"*.example.com",
+		"https://secure.org",
+		"dev.local:8080",
+	}}
+
+	for origin, allowed := range map[string]bool{
+		"":                          true, // not a browser
+		"http://ws.myapp.io":        true, // same origin
+		"https://WS.MyApp.io":       true,
+		"https://evil.com":          false,
+		"https://partner.com":       true,
+		"http://partner.com:9000":   true,
+		"https://notpartner.com":    false,
+		"https://app.example.com":   true,
+		"https://a.b.example.com":   true,
+		"https://example.com":       false,
+		"https://evilexample.com":   false,
+		"https://secure.org":        true,
+		"http://secure.org":         false,
+		"http://dev.local:8080":     true,
+		"http://dev.local:8081":     false,
+		"null":                      false,
+		"not a url":                 false,
+		"https://example.com.evil.": false,
+	} {
+		r := httptest.NewRequest(http.MethodGet, "http://ws.myapp.io/ws/echo", nil)
+		if origin != "" {
+			r.Header.Set("Origin", origin)
+		}
+		err := policy.Check(r)
+		if allowed && err != nil {
+			t.Errorf("%q: expected to be allowed, got %v", origin, err)
+		}
+		if !allowed && !errors.Is(err, ErrOriginNotAllowed) {
+			t.Errorf("%q: expected ErrOriginNotAllowed, got %v", origin, err)
+		}
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "http://ws.myapp.io/ws/echo", nil)
+	r.Header.Set("Origin", "null")
+	if err := (OriginPolicy{Allowed: []string{"null"}}).Check(r); err != nil {
+		t.Errorf("expected null to be allowed explicitly, got %v", err)
+	}
+	r.Header.Set("Origin", "https://anything.net")
+	if err := (OriginPolicy{Allowed: []string{"*"}}).Check(r); err != nil {
+		t.Errorf("expected * to allow any origin, got %v", err)
+	}
+}
+
+func TestOriginPolicyValidate(t *testing.T) {
+	valid := OriginPolicy{Allowed: []string{"*", "null", "a.com", "a.com:80", "*.a.com", "https://a.com"}}
+	if err := valid.Validate(); err != nil {
+		t.Errorf("expected valid, got %v", err)
+	}
+	for _, pattern := range []string{"", "ftp://a.com", "https://a.com/path", "a.*.com", "https://"} {
+		if err := (OriginPolicy{Allowed: []string{pattern}}).Validate(); err == nil {
+			t.Errorf("%q: expected an error", pattern)
+		}
+	}
+}
+
+func TestHandleRefusesCrossOriginUpgrades(t *testing.T) {
+	bus := messagebus.NewInMemoryMessageBus()
+	handler := NewWSHandler(services.NewServiceRegistry(bus), bus)
+	handler.SetOriginPolicy(OriginPolicy{Allowed: []string{"https://trusted.com"}})
+	router := NewRouter(handler)
+	router.Handle("/ws/echo", Endpoint{Factory: Adapt(services.NewEchoService)})
+	router.Handle("/ws/public", Endpoint{Factory: Adapt(services.NewEchoService), Origins: &OriginPolicy{Allowed: []string{"*"}}})
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+
+	dialFrom := func(path, origin string) (*websocket.Conn, int) {
+		url := "ws" + strings.TrimPrefix(server.URL, "http") + path
+		conn, resp, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {origin}})
+		if err != nil {
+			if resp == nil {
+				t.Fatalf("Dial failed: %v", err)
+			}
+			return nil, resp.StatusCode
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn, resp.StatusCode
+	}
+
+	if _, code := dialFrom("/ws/echo", "https://evil.com"); code != http.StatusForbidden {
+		t.Errorf("expected 403 for a foreign origin, got %d", code)
+	}
+	if conn, _ := dialFrom("/ws/echo", "https://trusted.com"); conn != nil {
+		roundTrip(t, conn, "trusted")
+	} else {
+		t.Error("expected the allowed origin to connect")
+	}
+	if conn, _ := dialFrom("/ws/echo", server.URL); conn == nil {
+		t.Error("expected the server's own origin to connect")
+	}
+	if conn, _ := dialFrom("/ws/public", "https://evil.com"); conn == nil {
+		t.Error("expected the endpoint's policy to override the handler's")
+	}
+}
@@ -0,0 +1,151 @@
+package handlers
+
+import (
+	"maps"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Params are the parameters of the request that selected a service instance:
+// the wildcards of its route pattern and its query string.
+type Params struct {
+	Path  map[string]string
+	Query url.Values
+}
+
+// Get returns the path parameter name or, if the route has no such wildcard,
+// the first value of the query parameter name.
+func (p Params) Get(name string) string {
+	if value, ok := p.Path[name]; ok {
+		return value
+	}
+	return p.Query.Get(name)
+}
+
+// requestParams collects the parameters of r. The path parameters are the
+// wildcards of the pattern r was routed by, if any.
+func requestParams(r *http.Request) Params {
+	params := Params{Path: make(map[string]string), Query: r.URL.Query()}
+	for _, name := range wildcards(r.Pattern) {
+		params.Path[name] = r.PathValue(name)
+	}
+	return params
+}
+
+// patternPath strips the optional method and host from a net/http pattern.
+func patternPath(pattern string) string {
+	if i := strings.Index(pattern, "/"); i >= 0 {
+		return pattern[i:]
+	}
+	return pattern
+}
+
+// wildcards returns the wildcard names of a net/http pattern in order, e.g.
+// ["tenant", "room"] for "/ws/{tenant}/rooms/{room}".
+func wildcards(pattern string) []string {
+	var names []string
+	for segment := range strings.SplitSeq(patternPath(pattern), "/") {
+		if !strings.HasPrefix(segment, "{") || !strings.HasSuffix(segment, "}") {
+			continue
+		}
+		name := strings.TrimSuffix(segment[1:len(segment)-1], "...")
+		if name != "$" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// EndpointName derives the default endpoint name from a route pattern or
+// request path: its literal segments after "/ws/", e.g. "rooms" for
+// "/ws/rooms/{room}".
+func EndpointName(pattern string) string {
+	var literals []string
+	path := strings.TrimPrefix(patternPath(pattern), "/ws/")
+	for segment := range strings.SplitSeq(path, "/") {
+		if segment != "" && !strings.HasPrefix(segment, "{") {
+			literals = append(literals, segment)
+		}
+	}
+	return strings.Join(literals, "/")
+}
+
+// Router dispatches WebSocket upgrades to endpoints by route pattern, so one
+// service implementation can serve many topic namespaces:
+//
+//	router.Handle("/ws/rooms/{room}", handlers.Endpoint{
+//		Factory:  newRoomService,
+//		Scope:    handlers.ScopeKey,
+//		KeyParam: "room",
+//	})
+//
+// The factory receives the route's path and query parameters in its
+// ServiceConfig. Routes may be changed while the router is serving.
+type Router struct {
+	handler *WS
+
+	mu     sync.Mutex
+	routes map[string]http.Handler
+	mux    atomic.Pointer[http.ServeMux]
+}
+
+func NewRouter(handler *WS) *Router {
+	rt := &Router{handler: handler, routes: make(map[string]http.Handler)}
+	rt.mux.Store(http.NewServeMux())
+	return rt
+}
+
+// Handle serves endpoint on pattern, a net/http pattern whose wildcards
+// become path parameters, replacing what pattern served before.
+// Endpoint.Name defaults to the literal segments of pattern after "/ws/".
+// Like http.ServeMux, it panics if pattern is invalid or conflicts with
+// another one.
+func (rt *Router) Handle(pattern string, endpoint Endpoint) {
+	if endpoint.Name == "" {
+		endpoint.Name = EndpointName(pattern)
+	}
+	rt.update(pattern, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rt.handler.HandleEndpoint(w, r, endpoint)
+	}))
+}
+
+// Suspend answers pattern with 503 until it is handled again, e.g. while
+// its endpoint is being reconfigured.
+func (rt *Router) Suspend(pattern string) {
+	rt.update(pattern, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "endpoint reloading, retry shortly", http.StatusServiceUnavailable)
+	}))
+}
+
+// Remove stops serving pattern.
+func (rt *Router) Remove(pattern string) {
+	rt.update(pattern, nil)
+}
+
+// update sets or, if handler is nil, removes the route of pattern. The
+// ServeMux is rebuilt since it cannot unregister patterns, and swapped in
+// only if every pattern registered.
+func (rt *Router) update(pattern string, handler http.Handler) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	routes := maps.Clone(rt.routes)
+	if handler == nil {
+		delete(routes, pattern)
+	} else {
+		routes[pattern] = handler
+	}
+	mux := http.NewServeMux()
+	for pattern, handler := range routes {
+		mux.Handle(pattern, handler)
+	}
+	rt.routes = routes
+	rt.mux.Store(mux)
+}
+
+func (rt *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rt.mux.Load().ServeHTTP(w, r)
+}
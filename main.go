@@ -1,39 +1,164 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
 
-	"github.com/samuel1992/ws-server-with-messagebus/messagebus"
+	"github.com/samuel1992/ws-server-with-messagebus/config"
 	"github.com/samuel1992/ws-server-with-messagebus/services"
 
 	"github.com/samuel1992/ws-server-with-messagebus/handlers"
 )
 
 func main() {
-	port := ":3000"
+	configPath := flag.String("config", "", "JSON configuration file; the built-in defaults are used without one")
+	watch := flag.Duration("watch", 0, "how often to check the configuration file for changes and reload it; 0 reloads on SIGHUP only")
+	flag.Parse()
 
-	// If you decide to use redis as message bus for example:
-	// options := &redis.Options{
-	// 	Addr: "localhost:6378",
-	// }
-	// messageBus := messagebus.NewRedisMessageBus(options)
+	cfg := config.Default()
+	if *configPath != "" {
+		var err error
+		cfg, err = config.Load(*configPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
 
-	messageBus := messagebus.NewInMemoryMessageBus()
+	messageBus, err := cfg.Bus.Open()
+	if err != nil {
+		log.Fatal("Opening message bus: ", err)
+	}
 	serviceRegistry := services.NewServiceRegistry(messageBus)
+	serviceRegistry.SetDefaultLinger(time.Duration(cfg.Linger))
 	handler := handlers.NewWSHandler(serviceRegistry, messageBus)
+	handler.SetOriginPolicy(cfg.OriginPolicy())
+	authenticator, err := cfg.Auth.Authenticator()
+	if err != nil {
+		log.Fatal(err)
+	}
+	handler.SetAuthenticator(authenticator)
+
+	router := handlers.NewRouter(handler)
+	routes := config.NewRoutes(router, handler, serviceRegistry)
+	if err := routes.Apply(ctx, cfg.Endpoints); err != nil {
+		log.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", handlers.Liveness)
+	mux.HandleFunc("/readyz", handlers.Readiness(serviceRegistry, 2*time.Second))
+	mux.Handle("/", router)
+
+	var servers []*http.Server
+	for _, addr := range cfg.Listen {
+		server := &http.Server{Addr: addr, Handler: mux}
+		servers = append(servers, server)
+		go func() {
+			log.Printf("Starting server on %v\n", addr)
+			var err error
+			if cfg.TLS != nil {
+				err = server.ListenAndServeTLS(cfg.TLS.CertFile, cfg.TLS.KeyFile)
+			} else {
+				err = server.ListenAndServe()
+			}
+			if !errors.Is(err, http.ErrServerClosed) {
+				log.Fatal("ListenAndServe: ", err)
+			}
+		}()
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	var changes <-chan struct{}
+	if *configPath != "" && *watch > 0 {
+		changes = config.Watch(ctx, *configPath, *watch)
+	}
 
-	http.HandleFunc("/ws/echo", func(w http.ResponseWriter, r *http.Request) {
-		handler.Handle(w, r, services.NewEchoService)
-	})
+serve:
+	for {
+		select {
+		case <-hup:
+			cfg = reload(*configPath, cfg, routes, handler, serviceRegistry)
+		case <-changes:
+			cfg = reload(*configPath, cfg, routes, handler, serviceRegistry)
+		case <-ctx.Done():
+			break serve
+		}
+	}
+	stop()
+	log.Println("Shutting down")
 
-	http.HandleFunc("/ws/timenow", func(w http.ResponseWriter, r *http.Request) {
-		handler.Handle(w, r, services.NewTimeNowService)
-	})
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.ShutdownTimeout))
+	defer cancel()
 
-	log.Printf("Starting server on %v\n", port)
-	err := http.ListenAndServe(port, nil)
+	// Stop accepting connections first; upgraded WebSockets are hijacked and
+	// not waited for by the servers, the handler takes care of them.
+	var wg sync.WaitGroup
+	for _, server := range servers {
+		wg.Go(func() {
+			if err := server.Shutdown(shutdownCtx); err != nil {
+				log.Println("Error shutting down HTTP server:", err)
+			}
+		})
+	}
+	wg.Wait()
+	if err := handler.Shutdown(shutdownCtx); err != nil {
+		log.Println("Error closing WebSocket connections:", err)
+	}
+	serviceRegistry.StopAll()
+	if err := messageBus.Close(); err != nil {
+		log.Println("Error closing message bus:", err)
+	}
+	log.Println("Shutdown complete")
+}
+
+// reload loads the configuration file and applies its endpoints, origin
+// policy, authentication and linger period, keeping the current
+// configuration if it does not validate. Listen addresses, TLS and the
+// message bus only change on restart.
+func reload(path string, current *config.Config, routes *config.Routes, handler *handlers.WS, registry *services.ServiceRegistry) *config.Config {
+	if path == "" {
+		log.Println("No configuration file to reload")
+		return current
+	}
+	next, err := config.Load(path)
 	if err != nil {
-		log.Fatal("ListenAndServe: ", err)
+		log.Println("Reload failed, keeping the current configuration:", err)
+		return current
+	}
+	log.Println("Reloading", path)
+
+	if !slices.Equal(next.Listen, current.Listen) || !reflect.DeepEqual(next.TLS, current.TLS) ||
+		!reflect.DeepEqual(next.Bus, current.Bus) {
+		log.Println("Listen addresses, TLS and bus settings take effect on restart")
+		next.Listen, next.TLS, next.Bus = current.Listen, current.TLS, current.Bus
+	}
+	authenticator, err := next.Auth.Authenticator()
+	if err != nil {
+		log.Println("Reload failed, keeping the current configuration:", err)
+		return current
+	}
+	registry.SetDefaultLinger(time.Duration(next.Linger))
+	handler.SetOriginPolicy(next.OriginPolicy())
+	handler.SetAuthenticator(authenticator)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(next.ShutdownTimeout))
+	defer cancel()
+	if err := routes.Apply(ctx, next.Endpoints); err != nil {
+		log.Println("Reload:", err)
 	}
+	return next
 }
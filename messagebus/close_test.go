@@ -0,0 +1,65 @@
+package messagebus
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestCloseEndsSubscriptions(t *testing.T) {
+	fileBus := newTestFileBus(t, FileOptions{})
+	streams, _ := newTestStreamsBus(t, RedisStreamsOptions{})
+	backends := map[string]MessageBus{
+		"inmemory":      NewInMemoryMessageBus(),
+		"redis":         newTestRedisBus(t),
+		"redis-streams": streams,
+		"file":          fileBus,
+	}
+
+	for name, bus := range backends {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+
+			ch, err := bus.Subscribe(ctx, "topic")
+			if err != nil {
+				t.Fatalf("Subscribe failed: %v", err)
+			}
+
+			if err := bus.Close(); err != nil {
+				t.Fatalf("Close failed: %v", err)
+			}
+
+			for range ch {
+			}
+			// Unsubscribing after Close is harmless.
+			if err := bus.Unsubscribe("topic", ch); err != nil {
+				t.Errorf("Unsubscribe after Close failed: %v", err)
+			}
+			if err := bus.Publish(ctx, "topic", NewMessage([]byte("late"))); err == nil {
+				t.Error("expected Publish after Close to fail")
+			}
+		})
+	}
+}
+
+func TestInMemoryCloseClosesPatternsAndGroups(t *testing.T) {
+	bus := NewInMemoryMessageBus()
+	ctx := context.Background()
+
+	pattern, _ := bus.Subscribe(ctx, "chat.>")
+	member, _ := bus.(GroupSubscriber).SubscribeGroup(ctx, "jobs", "workers")
+
+	bus.Close()
+
+	for _, ch := range []chan Message{pattern, member} {
+		if _, ok := <-ch; ok {
+			t.Error("expected channel to be closed")
+		}
+	}
+	if _, err := bus.Subscribe(ctx, "topic"); !errors.Is(err, ErrClosed) {
+		t.Errorf("expected ErrClosed, got %v", err)
+	}
+	if err := bus.Close(); err != nil {
+		t.Errorf("expected second Close to be a no-op, got %v", err)
+	}
+}
@@ -0,0 +1,779 @@
+package messagebus
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultSegmentBytes = 16 << 20
+
+	segmentSuffix = ".log"
+
+	// recordHeaderSize is the offset (8 bytes) plus the payload length
+	// (4 bytes) preceding every record.
+	recordHeaderSize = 12
+)
+
+// FileOptions configures a FileMessageBus.
+type FileOptions struct {
+	// Dir holds one sub-directory of segments per topic. Required.
+	Dir string
+	// SegmentBytes is the size at which the active segment of a topic is
+	// closed and a new one started. Defaults to 16 MiB.
+	SegmentBytes int64
+	// RetentionBytes deletes the oldest segments of a topic once the topic
+	// is larger than this. Zero keeps everything.
+	RetentionBytes int64
+	// RetentionAge deletes segments whose newest message is older than
+	// this. It is checked on every append and at least once a minute, so it
+	// applies to topics nobody publishes to as well. Zero keeps everything.
+	RetentionAge time.Duration
+}
+
+// FileMessageBus is a MessageBus that appends every message to a segmented
+// log per topic on disk before delivering it, so messages survive restarts.
+// Each message gets a monotonically increasing offset per topic, exposed in
+// its Offset header; subscribers choose where to start with WithStartOffset.
+//
+// The active segment is rolled once it reaches SegmentBytes, and whole
+// segments are deleted according to RetentionBytes and RetentionAge. Records
+// are written to the OS but not fsynced, so a machine crash (as opposed to a
+// process restart) can lose the most recent messages.
+//
+// A topic gets a directory once a message is published to it, and its
+// active segment is only kept open while the topic is in use. Transient
+// topics, i.e. connection topics (see ConnectionTopic) and Request inboxes,
+// are not kept: their log is deleted as soon as nobody subscribes to them,
+// and so is the directory of any topic that never received a message.
+type FileMessageBus struct {
+	opts FileOptions
+
+	mu            sync.Mutex
+	topics        map[string]*topicLog
+	subscriptions map[chan Message]*fileSubscription
+	drops         dropCounts
+	closed        bool
+
+	// stopSweep ends the retention sweep, which closes swept once done.
+	stopSweep chan struct{}
+	swept     chan struct{}
+}
+
+// maxRetentionSweep is the longest interval between two retention sweeps.
+const maxRetentionSweep = time.Minute
+
+type fileSubscription struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// topicLog is the on-disk log of a single topic.
+type topicLog struct {
+	dir  string
+	opts FileOptions
+	// refs counts the subscriptions and publishes using the log. It is
+	// guarded by FileMessageBus.mu.
+	refs int
+
+	mu       sync.Mutex
+	segments []*segment
+	// active is the last segment opened for appending, or nil while the
+	// log is idle or has no segments yet.
+	active *os.File
+	closed bool
+	next   int64
+	// appended is closed and replaced whenever a record is appended.
+	appended chan struct{}
+}
+
+type segment struct {
+	base    int64
+	path    string
+	size    int64
+	modTime time.Time
+	// created is when the segment was started, or its modTime when it was
+	// loaded from disk.
+	created time.Time
+}
+
+func NewFileMessageBus(options FileOptions) (MessageBus, error) {
+	if options.Dir == "" {
+		return nil, errors.New("messagebus: FileOptions.Dir is required")
+	}
+	if options.SegmentBytes <= 0 {
+		options.SegmentBytes = defaultSegmentBytes
+	}
+	if err := os.MkdirAll(options.Dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	mb := &FileMessageBus{
+		opts:          options,
+		topics:        make(map[string]*topicLog),
+		subscriptions: make(map[chan Message]*fileSubscription),
+		stopSweep:     make(chan struct{}),
+		swept:         make(chan struct{}),
+	}
+	if options.RetentionAge > 0 {
+		go mb.sweep(min(options.RetentionAge/2, maxRetentionSweep))
+	} else {
+		close(mb.swept)
+	}
+	return mb, nil
+}
+
+// sweep enforces RetentionAge every interval, so that topics nobody
+// publishes to expire too, until Close.
+func (mb *FileMessageBus) sweep(interval time.Duration) {
+	defer close(mb.swept)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			mb.enforceRetention()
+		case <-mb.stopSweep:
+			return
+		}
+	}
+}
+
+// enforceRetention applies the retention limits to every topic, including
+// those on disk that were not used since the bus started.
+func (mb *FileMessageBus) enforceRetention() {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	loaded := make(map[string]bool, len(mb.topics))
+	for _, tl := range mb.topics {
+		loaded[filepath.Base(tl.dir)] = true
+		tl.mu.Lock()
+		tl.enforceRetention()
+		tl.mu.Unlock()
+	}
+
+	// Nobody reads or writes the others, and topicLog cannot open them
+	// while mb.mu is held.
+	entries, err := os.ReadDir(mb.opts.Dir)
+	if err != nil {
+		log.Printf("Error listing topics in %s: %v", mb.opts.Dir, err)
+		return
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() || loaded[entry.Name()] {
+			continue
+		}
+		tl, err := openTopicLog(filepath.Join(mb.opts.Dir, entry.Name()), mb.opts)
+		if err != nil {
+			log.Printf("Error opening topic log %s: %v", entry.Name(), err)
+			continue
+		}
+		tl.enforceRetention()
+		tl.idle(false)
+	}
+}
+
+// topicDirName maps a topic to a directory name that cannot escape Dir.
+func topicDirName(topic string) string {
+	name := url.PathEscape(topic)
+	if strings.HasPrefix(name, ".") {
+		name = "%2E" + name[1:]
+	}
+	return name
+}
+
+// topicLog returns the log of topic, holding a reference to it until
+// release is called.
+func (mb *FileMessageBus) topicLog(topic string) (*topicLog, error) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	if mb.closed {
+		return nil, ErrClosed
+	}
+	tl, ok := mb.topics[topic]
+	if !ok {
+		var err error
+		tl, err = openTopicLog(filepath.Join(mb.opts.Dir, topicDirName(topic)), mb.opts)
+		if err != nil {
+			return nil, err
+		}
+		mb.topics[topic] = tl
+	}
+	tl.refs++
+	return tl, nil
+}
+
+// release drops a reference taken by topicLog. The last one closes the
+// active segment and deletes and forgets the log if it has no messages or
+// belongs to a transient topic.
+func (mb *FileMessageBus) release(topic string, tl *topicLog) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	tl.refs--
+	// After Close the log is no longer in topics and already closed.
+	if tl.refs > 0 || mb.topics[topic] != tl {
+		return
+	}
+	if tl.idle(isTransient(topic)) {
+		delete(mb.topics, topic)
+	}
+}
+
+// openTopicLog loads the log in dir. A missing dir is an empty log; it is
+// created by the first append.
+func openTopicLog(dir string, opts FileOptions) (*topicLog, error) {
+	tl := &topicLog{
+		dir:      dir,
+		opts:     opts,
+		appended: make(chan struct{}),
+	}
+
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return tl, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+		base, err := strconv.ParseInt(strings.TrimSuffix(name, segmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		tl.segments = append(tl.segments, &segment{
+			base:    base,
+			path:    filepath.Join(dir, name),
+			size:    info.Size(),
+			modTime: info.ModTime(),
+			created: info.ModTime(),
+		})
+	}
+	sort.Slice(tl.segments, func(i, j int) bool {
+		return tl.segments[i].base < tl.segments[j].base
+	})
+
+	if len(tl.segments) == 0 {
+		return tl, nil
+	}
+
+	if err := tl.recover(); err != nil {
+		return nil, err
+	}
+	return tl, nil
+}
+
+// idle closes the active segment of a log nobody uses. If discard is set or
+// the log has no messages, it is deleted too, and idle reports true so that
+// it is forgotten.
+func (tl *topicLog) idle(discard bool) bool {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+
+	if tl.active != nil {
+		tl.active.Close()
+		tl.active = nil
+	}
+	if tl.next > 0 && !discard {
+		return false
+	}
+
+	for _, seg := range tl.segments {
+		if err := os.Remove(seg.path); err != nil && !os.IsNotExist(err) {
+			log.Printf("Error removing segment %s: %v", seg.path, err)
+			return false
+		}
+	}
+	tl.segments = nil
+	if err := os.Remove(tl.dir); err != nil && !os.IsNotExist(err) {
+		log.Printf("Error removing topic directory %s: %v", tl.dir, err)
+	}
+	return true
+}
+
+// recover scans the last segment to find the next offset, truncating a
+// partially written record left by a crash, and opens it for appending.
+func (tl *topicLog) recover() error {
+	last := tl.segments[len(tl.segments)-1]
+
+	f, err := os.OpenFile(last.path, os.O_RDWR, 0o644)
+	if err != nil {
+		return err
+	}
+
+	next, valid := last.base, int64(0)
+	r := bufio.NewReader(f)
+	for {
+		offset, data, err := readRecord(r)
+		if err != nil {
+			break
+		}
+		next = offset + 1
+		valid += recordHeaderSize + int64(len(data))
+	}
+
+	if valid < last.size {
+		log.Printf("Truncating %d bytes of partial record in %s", last.size-valid, last.path)
+		if err := f.Truncate(valid); err != nil {
+			f.Close()
+			return err
+		}
+		last.size = valid
+	}
+	if _, err := f.Seek(valid, io.SeekStart); err != nil {
+		f.Close()
+		return err
+	}
+
+	tl.active = f
+	tl.next = next
+	return nil
+}
+
+// openActive opens the last segment for appending, creating the directory
+// and the first segment of a new log. tl.mu must be held.
+func (tl *topicLog) openActive() error {
+	if len(tl.segments) == 0 {
+		if err := os.MkdirAll(tl.dir, 0o755); err != nil {
+			return err
+		}
+		return tl.roll()
+	}
+
+	f, err := os.OpenFile(tl.segments[len(tl.segments)-1].path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	tl.active = f
+	return nil
+}
+
+// roll starts a new active segment at the next offset. tl.mu must be held.
+func (tl *topicLog) roll() error {
+	path := filepath.Join(tl.dir, fmt.Sprintf("%020d%s", tl.next, segmentSuffix))
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+
+	if tl.active != nil {
+		tl.active.Close()
+	}
+	tl.active = f
+	tl.segments = append(tl.segments, &segment{
+		base:    tl.next,
+		path:    path,
+		modTime: time.Now(),
+		created: time.Now(),
+	})
+	return nil
+}
+
+// append writes msg as the next record and returns its offset.
+func (tl *topicLog) append(msg Message) (int64, error) {
+	data, err := Encode(msg)
+	if err != nil {
+		return 0, err
+	}
+
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+
+	if tl.closed {
+		return 0, ErrClosed
+	}
+	if tl.active == nil {
+		if err := tl.openActive(); err != nil {
+			return 0, err
+		}
+	}
+	if last := tl.segments[len(tl.segments)-1]; last.size >= tl.opts.SegmentBytes ||
+		(tl.opts.RetentionAge > 0 && last.size > 0 && time.Since(last.created) >= tl.opts.RetentionAge) {
+		if err := tl.roll(); err != nil {
+			return 0, err
+		}
+	}
+
+	offset := tl.next
+	record := make([]byte, recordHeaderSize+len(data))
+	binary.BigEndian.PutUint64(record[0:8], uint64(offset))
+	binary.BigEndian.PutUint32(record[8:12], uint32(len(data)))
+	copy(record[recordHeaderSize:], data)
+
+	if _, err := tl.active.Write(record); err != nil {
+		return 0, err
+	}
+
+	active := tl.segments[len(tl.segments)-1]
+	active.size += int64(len(record))
+	active.modTime = time.Now()
+	tl.next++
+
+	tl.enforceRetention()
+
+	close(tl.appended)
+	tl.appended = make(chan struct{})
+
+	return offset, nil
+}
+
+// enforceRetention deletes the oldest segments that exceed the retention
+// limits. Once all messages of the active segment are too old, an empty
+// one is started at the next offset so that offsets keep counting up.
+// tl.mu must be held.
+func (tl *topicLog) enforceRetention() {
+	var total int64
+	for _, seg := range tl.segments {
+		total += seg.size
+	}
+
+	for len(tl.segments) > 0 {
+		oldest := tl.segments[0]
+		last := len(tl.segments) == 1
+		tooBig := !last && tl.opts.RetentionBytes > 0 && total > tl.opts.RetentionBytes
+		tooOld := tl.opts.RetentionAge > 0 && time.Since(oldest.modTime) > tl.opts.RetentionAge
+		if !tooBig && !tooOld {
+			return
+		}
+		if last {
+			if oldest.size == 0 {
+				return
+			}
+			if err := tl.roll(); err != nil {
+				log.Printf("Error rolling %s: %v", tl.dir, err)
+				return
+			}
+		}
+
+		// Readers that still have the file open keep reading it until they
+		// move on; the name just disappears.
+		if err := os.Remove(oldest.path); err != nil && !os.IsNotExist(err) {
+			log.Printf("Error removing segment %s: %v", oldest.path, err)
+			return
+		}
+		total -= oldest.size
+		tl.segments = tl.segments[1:]
+	}
+}
+
+// snapshot returns the segments, the next offset and the channel closed on
+// the next append, consistently.
+func (tl *topicLog) snapshot() ([]segment, int64, chan struct{}) {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+
+	segments := make([]segment, len(tl.segments))
+	for i, seg := range tl.segments {
+		segments[i] = *seg
+	}
+	return segments, tl.next, tl.appended
+}
+
+func readRecord(r io.Reader) (int64, []byte, error) {
+	var header [recordHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	offset := int64(binary.BigEndian.Uint64(header[0:8]))
+	data := make([]byte, binary.BigEndian.Uint32(header[8:12]))
+	if _, err := io.ReadFull(r, data); err != nil {
+		return 0, nil, err
+	}
+	return offset, data, nil
+}
+
+// logReader reads a topic log sequentially across segments.
+type logReader struct {
+	log  *topicLog
+	next int64
+
+	file    *os.File
+	r       *bufio.Reader
+	segBase int64
+}
+
+// startOffset resolves WithStartOffset against the current log.
+func (tl *topicLog) startOffset(requested int64) int64 {
+	segments, next, _ := tl.snapshot()
+	earliest := next
+	if len(segments) > 0 {
+		earliest = segments[0].base
+	}
+
+	switch {
+	case requested == OffsetEarliest:
+		return earliest
+	case requested < 0:
+		return next
+	case requested < earliest:
+		return earliest
+	case requested > next:
+		return next
+	default:
+		return requested
+	}
+}
+
+// readCommitted returns the records from r.next up to the current end of
+// the log. Only records below the committed next offset are read, so a
+// record that is still being written is never observed half-way.
+func (r *logReader) readCommitted(fn func(offset int64, data []byte) bool) (chan struct{}, error) {
+	segments, next, appended := r.log.snapshot()
+
+	for r.next < next {
+		idx := sort.Search(len(segments), func(i int) bool {
+			return segments[i].base > r.next
+		}) - 1
+		if idx < 0 {
+			// Everything up to the oldest segment was deleted by retention.
+			log.Printf("Skipping offsets %d-%d of %s removed by retention", r.next, segments[0].base-1, r.log.dir)
+			r.next = segments[0].base
+			continue
+		}
+
+		if r.file == nil || r.segBase != segments[idx].base {
+			if err := r.open(segments[idx]); err != nil {
+				return nil, err
+			}
+		}
+
+		offset, data, err := readRecord(r.r)
+		if err != nil {
+			if errors.Is(err, io.EOF) && idx+1 < len(segments) {
+				// Finished this segment, continue with the next one.
+				r.next = max(r.next, segments[idx+1].base)
+				r.closeFile()
+				continue
+			}
+			return nil, fmt.Errorf("reading %s: %w", segments[idx].path, err)
+		}
+		if offset < r.next {
+			continue
+		}
+		r.next = offset + 1
+		if !fn(offset, data) {
+			return nil, nil
+		}
+	}
+
+	return appended, nil
+}
+
+func (r *logReader) open(seg segment) error {
+	r.closeFile()
+
+	f, err := os.Open(seg.path)
+	if err != nil {
+		return err
+	}
+	r.file = f
+	r.r = bufio.NewReader(f)
+	r.segBase = seg.base
+	return nil
+}
+
+func (r *logReader) closeFile() {
+	if r.file != nil {
+		r.file.Close()
+		r.file = nil
+	}
+}
+
+// Subscribe starts delivering messages from the offset chosen with
+// WithStartOffset (OffsetLatest by default).
+func (mb *FileMessageBus) Subscribe(ctx context.Context, topic string, opts ...SubscribeOption) (chan Message, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if IsPattern(topic) {
+		return nil, fmt.Errorf("%w: pattern subscription %q on file bus", ErrNotSupported, topic)
+	}
+
+	tl, err := mb.topicLog(topic)
+	if err != nil {
+		return nil, fmt.Errorf("%w: topic %s: %w", ErrSubscribeFailed, topic, err)
+	}
+
+	o := newSubscribeOptions(opts)
+	ch := make(chan Message, o.bufferSize)
+	reader := &logReader{log: tl, next: tl.startOffset(o.startOffset)}
+	_, end, _ := tl.snapshot()
+
+	readCtx, cancel := context.WithCancel(context.Background())
+	sub := &fileSubscription{cancel: cancel, done: make(chan struct{})}
+
+	mb.mu.Lock()
+	mb.subscriptions[ch] = sub
+	mb.mu.Unlock()
+
+	go func() {
+		defer func() {
+			reader.closeFile()
+			mb.release(topic, tl)
+			close(sub.done)
+			close(ch)
+		}()
+
+		if mb.tail(readCtx, topic, reader, end, ch, o) {
+			log.Printf("Disconnecting slow subscriber on topic %s", topic)
+			mb.mu.Lock()
+			delete(mb.subscriptions, ch)
+			mb.mu.Unlock()
+		}
+	}()
+
+	return ch, nil
+}
+
+// tail delivers records to ch as they are appended until ctx is cancelled.
+// It reports whether it stopped because the subscriber was too slow.
+//
+// Records below end, which were in the log before the subscription, are a
+// replay the subscriber asked for: they wait for room in ch instead of
+// going through the overflow policy, which would drop or disconnect any
+// replay larger than the buffer.
+func (mb *FileMessageBus) tail(ctx context.Context, topic string, reader *logReader, end int64, ch chan Message, o subscribeOptions) bool {
+	disconnect := false
+
+	for {
+		appended, err := reader.readCommitted(func(offset int64, data []byte) bool {
+			msg, err := Decode(data)
+			if err != nil {
+				log.Printf("Error decoding offset %d on topic %s: %v", offset, topic, err)
+				return true
+			}
+			msg = msg.WithHeader(HeaderOffset, strconv.FormatInt(offset, 10))
+
+			if offset < end {
+				select {
+				case ch <- msg:
+					return true
+				case <-ctx.Done():
+					return false
+				}
+			}
+
+			var dropped bool
+			dropped, disconnect = o.deliver(ctx, ch, msg)
+			if dropped {
+				mb.drops.add(topic)
+				log.Printf("Warning: subscriber channel full on topic %s, dropping offset %d (policy %s)", topic, offset, o.policy)
+			}
+			return !disconnect && ctx.Err() == nil
+		})
+		if disconnect {
+			return true
+		}
+		if err != nil {
+			log.Printf("Error reading log for topic %s: %v", topic, err)
+			return false
+		}
+		if appended == nil {
+			return false
+		}
+
+		select {
+		case <-appended:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+func (mb *FileMessageBus) Unsubscribe(topic string, ch chan Message) error {
+	mb.mu.Lock()
+	sub, ok := mb.subscriptions[ch]
+	delete(mb.subscriptions, ch)
+	mb.mu.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	sub.cancel()
+	<-sub.done
+	return nil
+}
+
+// Publish appends msg to the topic log; subscribers pick it up from there.
+func (mb *FileMessageBus) Publish(ctx context.Context, topic string, msg Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if IsPattern(topic) {
+		return fmt.Errorf("%w: cannot publish to pattern %q", ErrInvalidTopic, topic)
+	}
+
+	tl, err := mb.topicLog(topic)
+	if err != nil {
+		return fmt.Errorf("%w: topic %s: %w", ErrPublishFailed, topic, err)
+	}
+	defer mb.release(topic, tl)
+	if _, err := tl.append(msg.stamp(topic)); err != nil {
+		return fmt.Errorf("%w: topic %s: %w", ErrPublishFailed, topic, err)
+	}
+	return nil
+}
+
+// Close ends every subscription and closes the topic logs. Later calls to
+// Subscribe and Publish fail with ErrClosed.
+func (mb *FileMessageBus) Close() error {
+	mb.mu.Lock()
+	if !mb.closed {
+		close(mb.stopSweep)
+	}
+	mb.closed = true
+	subs := mb.subscriptions
+	topics := mb.topics
+	mb.subscriptions = make(map[chan Message]*fileSubscription)
+	mb.topics = make(map[string]*topicLog)
+	mb.mu.Unlock()
+	<-mb.swept
+
+	for _, sub := range subs {
+		sub.cancel()
+		<-sub.done
+	}
+
+	var errs []error
+	for _, tl := range topics {
+		tl.mu.Lock()
+		if tl.active != nil {
+			errs = append(errs, tl.active.Close())
+			tl.active = nil
+		}
+		tl.closed = true
+		tl.mu.Unlock()
+	}
+	return errors.Join(errs...)
+}
+
+// Dropped returns how many messages on topic could not be handed to a
+// subscriber channel. They remain in the log and can be replayed.
+func (mb *FileMessageBus) Dropped(topic string) uint64 {
+	return mb.drops.Dropped(topic)
+}
@@ -0,0 +1,337 @@
+package messagebus
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func newTestFileBus(t *testing.T, opts FileOptions) MessageBus {
+	t.Helper()
+
+	if opts.Dir == "" {
+		opts.Dir = t.TempDir()
+	}
+	bus, err := NewFileMessageBus(opts)
+	if err != nil {
+		t.Fatalf("NewFileMessageBus failed: %v", err)
+	}
+	t.Cleanup(func() { bus.Close() })
+	return bus
+}
+
+func publishN(t *testing.T, bus MessageBus, topic string, from, to int) {
+	t.Helper()
+
+	for i := from; i < to; i++ {
+		if err := bus.Publish(context.Background(), topic, NewMessage([]byte(fmt.Sprint(i)))); err != nil {
+			t.Fatalf("Publish failed: %v", err)
+		}
+	}
+}
+
+func expectPayloads(t *testing.T, ch chan Message, from, to int) {
+	t.Helper()
+
+	for i := from; i < to; i++ {
+		msg := receive(t, ch)
+		if string(msg.Payload) != fmt.Sprint(i) {
+			t.Fatalf("expected '%d', got '%s'", i, msg.Payload)
+		}
+		if msg.Header(HeaderOffset) != strconv.Itoa(i) {
+			t.Fatalf("expected offset %d, got '%s'", i, msg.Header(HeaderOffset))
+		}
+	}
+}
+
+func TestFileBusLatestOnlySeesNewMessages(t *testing.T) {
+	bus := newTestFileBus(t, FileOptions{})
+	topic := "echo:from-service-to-ws"
+
+	publishN(t, bus, topic, 0, 3)
+
+	ch, err := bus.Subscribe(context.Background(), topic)
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	defer bus.Unsubscribe(topic, ch)
+
+	publishN(t, bus, topic, 3, 5)
+	expectPayloads(t, ch, 3, 5)
+}
+
+func TestFileBusReplayFromEarliestAndOffset(t *testing.T) {
+	bus := newTestFileBus(t, FileOptions{})
+	topic := "events"
+	ctx := context.Background()
+
+	publishN(t, bus, topic, 0, 5)
+
+	earliest, err := bus.Subscribe(ctx, topic, WithStartOffset(OffsetEarliest))
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	defer bus.Unsubscribe(topic, earliest)
+
+	fromThree, err := bus.Subscribe(ctx, topic, WithStartOffset(3))
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	defer bus.Unsubscribe(topic, fromThree)
+
+	// Catch-up and live messages arrive in one ordered stream.
+	publishN(t, bus, topic, 5, 7)
+
+	expectPayloads(t, earliest, 0, 7)
+	expectPayloads(t, fromThree, 3, 7)
+}
+
+func TestFileBusSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	topic := "events"
+
+	bus := newTestFileBus(t, FileOptions{Dir: dir})
+	publishN(t, bus, topic, 0, 3)
+
+	restarted := newTestFileBus(t, FileOptions{Dir: dir})
+	ch, err := restarted.Subscribe(context.Background(), topic, WithStartOffset(1))
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	defer restarted.Unsubscribe(topic, ch)
+
+	publishN(t, restarted, topic, 3, 4)
+	expectPayloads(t, ch, 1, 4)
+}
+
+func TestFileBusTruncatesPartialRecord(t *testing.T) {
+	dir := t.TempDir()
+	topic := "events"
+
+	bus := newTestFileBus(t, FileOptions{Dir: dir})
+	publishN(t, bus, topic, 0, 2)
+
+	// Simulate a crash in the middle of writing a record.
+	segment := filepath.Join(dir, topicDirName(topic), fmt.Sprintf("%020d%s", 0, segmentSuffix))
+	f, err := os.OpenFile(segment, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		t.Fatalf("open segment: %v", err)
+	}
+	f.Write([]byte{0, 0, 0, 0, 0, 0, 0, 2, 0, 0})
+	f.Close()
+
+	restarted := newTestFileBus(t, FileOptions{Dir: dir})
+	ch, err := restarted.Subscribe(context.Background(), topic, WithStartOffset(OffsetEarliest))
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	defer restarted.Unsubscribe(topic, ch)
+
+	publishN(t, restarted, topic, 2, 3)
+	expectPayloads(t, ch, 0, 3)
+}
+
+func TestFileBusSegmentRetention(t *testing.T) {
+	dir := t.TempDir()
+	topic := "metrics"
+
+	bus := newTestFileBus(t, FileOptions{Dir: dir, SegmentBytes: 512, RetentionBytes: 2048})
+	publishN(t, bus, topic, 0, 200)
+
+	entries, err := os.ReadDir(filepath.Join(dir, topicDirName(topic)))
+	if err != nil {
+		t.Fatalf("ReadDir failed: %v", err)
+	}
+	if len(entries) < 2 {
+		t.Fatalf("expected the log to be segmented, got %d segments", len(entries))
+	}
+
+	var total int64
+	for _, entry := range entries {
+		info, _ := entry.Info()
+		total += info.Size()
+	}
+	if total > 2048+512 {
+		t.Errorf("expected retention to cap the log near 2048 bytes, got %d", total)
+	}
+
+	// Earliest now means the oldest retained message, and it is followed by
+	// every message up to the newest one.
+	ch, err := bus.Subscribe(context.Background(), topic, WithStartOffset(OffsetEarliest))
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	defer bus.Unsubscribe(topic, ch)
+
+	first := receive(t, ch)
+	start, _ := strconv.Atoi(first.Header(HeaderOffset))
+	if start == 0 {
+		t.Fatal("expected the oldest segments to be deleted")
+	}
+	expectPayloads(t, ch, start+1, 200)
+}
+
+func TestFileBusRetentionByAge(t *testing.T) {
+	dir := t.TempDir()
+	topic := "metrics"
+
+	bus := newTestFileBus(t, FileOptions{Dir: dir, SegmentBytes: 256, RetentionAge: 50 * time.Millisecond})
+	publishN(t, bus, topic, 0, 20)
+
+	time.Sleep(100 * time.Millisecond)
+	publishN(t, bus, topic, 20, 21)
+
+	ch, err := bus.Subscribe(context.Background(), topic, WithStartOffset(0))
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	defer bus.Unsubscribe(topic, ch)
+
+	first := receive(t, ch)
+	if first.Header(HeaderOffset) == "0" {
+		t.Error("expected aged segments to be deleted")
+	}
+}
+
+func TestFileBusRetentionByAgeOnQuietTopics(t *testing.T) {
+	dir := t.TempDir()
+	old, quiet := "old", "quiet"
+	age := 100 * time.Millisecond
+
+	// A topic left behind by a previous run is swept without being used.
+	bus := newTestFileBus(t, FileOptions{Dir: dir})
+	publishN(t, bus, old, 0, 3)
+	bus.Close()
+	stale := time.Now().Add(-time.Hour)
+	segments, _ := filepath.Glob(filepath.Join(dir, topicDirName(old), "*"))
+	for _, path := range segments {
+		if err := os.Chtimes(path, stale, stale); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	bus = newTestFileBus(t, FileOptions{Dir: dir, RetentionAge: age})
+	defer bus.Close()
+	// Far below SegmentBytes and never published to again.
+	publishN(t, bus, quiet, 0, 3)
+	time.Sleep(3 * age)
+
+	for _, topic := range []string{old, quiet} {
+		segments, _ := filepath.Glob(filepath.Join(dir, topicDirName(topic), "*"))
+		if len(segments) != 1 {
+			t.Fatalf("expected only an empty segment for %s, got %v", topic, segments)
+		}
+		if info, err := os.Stat(segments[0]); err != nil || info.Size() != 0 {
+			t.Fatalf("expected %s to be empty: %v", segments[0], err)
+		}
+	}
+
+	// Offsets carry on where the expired messages stopped.
+	ch, err := bus.Subscribe(context.Background(), quiet, WithStartOffset(0))
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	defer bus.Unsubscribe(quiet, ch)
+	publishN(t, bus, quiet, 3, 4)
+	if msg := receive(t, ch); msg.Header(HeaderOffset) != "3" || string(msg.Payload) != "3" {
+		t.Errorf("expected offset 3, got %s (%q)", msg.Header(HeaderOffset), msg.Payload)
+	}
+}
+
+func TestFileBusReleasesIdleTopics(t *testing.T) {
+	dir := t.TempDir()
+	bus := newTestFileBus(t, FileOptions{Dir: dir})
+	defer bus.Close()
+	ctx := context.Background()
+
+	// Reply inboxes come and go without ever receiving a message.
+	for i := range 500 {
+		topic := fmt.Sprintf("_inbox:%d", i)
+		ch, err := bus.Subscribe(ctx, topic)
+		if err != nil {
+			t.Fatalf("Subscribe failed: %v", err)
+		}
+		bus.Unsubscribe(topic, ch)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Fatalf("expected no topic directories, got %d", len(entries))
+	}
+
+	// A subscriber to a topic without a log still gets what is published.
+	ch, err := bus.Subscribe(ctx, "events")
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	publishN(t, bus, "events", 0, 2)
+	expectPayloads(t, ch, 0, 2)
+
+	// Once the last subscriber leaves, the messages stay but the file is
+	// closed, and reopened by the next publish.
+	bus.Unsubscribe("events", ch)
+	tl := bus.(*FileMessageBus).topics["events"]
+	if tl == nil || tl.active != nil {
+		t.Fatal("expected the log to be kept with its active segment closed")
+	}
+	publishN(t, bus, "events", 2, 3)
+	if tl.active != nil {
+		t.Error("expected a publish without subscribers to close the segment again")
+	}
+	replay, err := bus.Subscribe(ctx, "events", WithStartOffset(OffsetEarliest))
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	defer bus.Unsubscribe("events", replay)
+	expectPayloads(t, replay, 0, 3)
+}
+
+func TestFileBusForgetsTransientTopics(t *testing.T) {
+	dir := t.TempDir()
+	bus := newTestFileBus(t, FileOptions{Dir: dir})
+	defer bus.Close()
+	ctx := context.Background()
+	shared := "echo:from-service-to-ws"
+
+	// Clients come and go, each getting replies on its own topic and
+	// sending a request whose reply comes back on an inbox.
+	for i := range 200 {
+		own := ConnectionTopic(shared, NewID())
+		inbox := inboxPrefix + ":" + NewID()
+		sub, _ := bus.Subscribe(ctx, shared)
+		replies, _ := bus.Subscribe(ctx, own)
+		answers, _ := bus.Subscribe(ctx, inbox)
+
+		publishN(t, bus, shared, i, i+1)
+		publishN(t, bus, own, 0, 1)
+		publishN(t, bus, inbox, 0, 1)
+		receive(t, sub)
+		receive(t, replies)
+		receive(t, answers)
+
+		bus.Unsubscribe(shared, sub)
+		bus.Unsubscribe(own, replies)
+		bus.Unsubscribe(inbox, answers)
+		// A reply arriving after the client left.
+		publishN(t, bus, own, 1, 2)
+	}
+
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 || entries[0].Name() != topicDirName(shared) {
+		t.Errorf("expected only the shared topic on disk, got %d directories", len(entries))
+	}
+	if topics := len(bus.(*FileMessageBus).topics); topics != 1 {
+		t.Errorf("expected only the shared topic to be tracked, got %d", topics)
+	}
+}
+
+func TestFileBusTopicCannotEscapeDir(t *testing.T) {
+	for _, topic := range []string{"..", "../etc", ".hidden", "a/b"} {
+		name := topicDirName(topic)
+		if name == "." || name == ".." || filepath.Base(name) != name || name[0] == '.' {
+			t.Errorf("topicDirName(%q) = %q escapes the data directory", topic, name)
+		}
+	}
+}
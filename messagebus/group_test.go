@@ -0,0 +1,259 @@
+package messagebus
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+func groupBackends(t *testing.T) map[string]MessageBus {
+	streams, _ := newTestStreamsBus(t, RedisStreamsOptions{})
+	return map[string]MessageBus{
+		"inmemory":      NewInMemoryMessageBus(),
+		"redis":         newTestRedisBus(t),
+		"redis-streams": streams,
+	}
+}
+
+// collect reads n messages from the given channels, failing if any message
+// is received twice, and returns how many each channel got.
+func collect(t *testing.T, n int, chans ...chan Message) []int {
+	t.Helper()
+
+	type received struct {
+		i   int
+		msg Message
+	}
+	merged := make(chan received)
+	done := make(chan struct{})
+	defer close(done)
+	for i, ch := range chans {
+		go func() {
+			for {
+				select {
+				case msg, ok := <-ch:
+					if !ok {
+						return
+					}
+					select {
+					case merged <- received{i, msg}:
+					case <-done:
+						return
+					}
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+
+	counts := make([]int, len(chans))
+	seen := map[string]bool{}
+	for range n {
+		select {
+		case r := <-merged:
+			if seen[string(r.msg.Payload)] {
+				t.Fatalf("message %s delivered twice", r.msg.Payload)
+			}
+			seen[string(r.msg.Payload)] = true
+			counts[r.i]++
+		case <-time.After(time.Second):
+			t.Fatalf("timeout after %d of %d messages", len(seen), n)
+		}
+	}
+	return counts
+}
+
+func TestGroupDeliversEachMessageOnce(t *testing.T) {
+	for name, bus := range groupBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			groups := bus.(GroupSubscriber)
+
+			a, err := groups.SubscribeGroup(ctx, "jobs", "workers")
+			if err != nil {
+				t.Fatalf("SubscribeGroup failed: %v", err)
+			}
+			defer bus.Unsubscribe("jobs", a)
+			b, err := groups.SubscribeGroup(ctx, "jobs", "workers")
+			if err != nil {
+				t.Fatalf("SubscribeGroup failed: %v", err)
+			}
+			defer bus.Unsubscribe("jobs", b)
+			audit, err := groups.SubscribeGroup(ctx, "jobs", "audit")
+			if err != nil {
+				t.Fatalf("SubscribeGroup failed: %v", err)
+			}
+			defer bus.Unsubscribe("jobs", audit)
+
+			for i := range 10 {
+				bus.Publish(ctx, "jobs", NewMessage(fmt.Appendf(nil, "%d", i)))
+			}
+
+			collect(t, 10, a, b)
+			collect(t, 10, audit)
+		})
+	}
+}
+
+func TestGroupMembersAlongsideSubscribers(t *testing.T) {
+	for name, bus := range groupBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+
+			member, err := bus.(GroupSubscriber).SubscribeGroup(ctx, "jobs", "workers")
+			if err != nil {
+				t.Fatalf("SubscribeGroup failed: %v", err)
+			}
+			defer bus.Unsubscribe("jobs", member)
+			sub, err := bus.Subscribe(ctx, "jobs")
+			if err != nil {
+				t.Fatalf("Subscribe failed: %v", err)
+			}
+			defer bus.Unsubscribe("jobs", sub)
+
+			bus.Publish(ctx, "jobs", NewMessage([]byte("job")))
+
+			if got := receive(t, member); string(got.Payload) != "job" {
+				t.Errorf("member: expected 'job', got '%s'", got.Payload)
+			}
+			if got := receive(t, sub); string(got.Payload) != "job" {
+				t.Errorf("subscriber: expected 'job', got '%s'", got.Payload)
+			}
+		})
+	}
+}
+
+func TestGroupRebalancesOnUnsubscribe(t *testing.T) {
+	for name, bus := range groupBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			groups := bus.(GroupSubscriber)
+
+			leaving, _ := groups.SubscribeGroup(ctx, "jobs", "workers")
+			staying, _ := groups.SubscribeGroup(ctx, "jobs", "workers")
+			defer bus.Unsubscribe("jobs", staying)
+
+			bus.Unsubscribe("jobs", leaving)
+
+			for i := range 5 {
+				bus.Publish(ctx, "jobs", NewMessage(fmt.Appendf(nil, "%d", i)))
+			}
+			collect(t, 5, staying)
+		})
+	}
+}
+
+func TestInMemoryGroupHandsOverQueuedMessages(t *testing.T) {
+	bus := NewInMemoryMessageBus().(*InMemoryMessageBus)
+	ctx := context.Background()
+
+	leaving, _ := bus.SubscribeGroup(ctx, "jobs", "workers")
+	staying, _ := bus.SubscribeGroup(ctx, "jobs", "workers")
+	defer bus.Unsubscribe("jobs", staying)
+
+	for i := range 4 {
+		bus.Publish(ctx, "jobs", NewMessage(fmt.Appendf(nil, "%d", i)))
+	}
+	// leaving never reads; its share must move to staying.
+	bus.Unsubscribe("jobs", leaving)
+
+	if counts := collect(t, 4, staying); counts[0] != 4 {
+		t.Errorf("expected 4 messages on the remaining member, got %d", counts[0])
+	}
+}
+
+func TestInMemoryGroupRoundRobin(t *testing.T) {
+	bus := NewInMemoryMessageBus().(*InMemoryMessageBus)
+	ctx := context.Background()
+
+	a, _ := bus.SubscribeGroup(ctx, "jobs", "workers")
+	b, _ := bus.SubscribeGroup(ctx, "jobs", "workers")
+
+	for i := range 6 {
+		bus.Publish(ctx, "jobs", NewMessage(fmt.Appendf(nil, "%d", i)))
+	}
+	if len(a) != 3 || len(b) != 3 {
+		t.Errorf("expected 3/3 split, got %d/%d", len(a), len(b))
+	}
+}
+
+func TestInMemoryGroupSkipsFullMembers(t *testing.T) {
+	bus := NewInMemoryMessageBus().(*InMemoryMessageBus)
+	ctx := context.Background()
+
+	full, _ := bus.SubscribeGroup(ctx, "jobs", "workers", WithBufferSize(1))
+	free, _ := bus.SubscribeGroup(ctx, "jobs", "workers")
+
+	for i := range 5 {
+		bus.Publish(ctx, "jobs", NewMessage(fmt.Appendf(nil, "%d", i)))
+	}
+	if len(full) != 1 || len(free) != 4 {
+		t.Errorf("expected 1/4 split, got %d/%d", len(full), len(free))
+	}
+	if dropped := bus.Dropped("jobs"); dropped != 0 {
+		t.Errorf("expected no drops, got %d", dropped)
+	}
+}
+
+func TestInMemoryGroupLeastLoaded(t *testing.T) {
+	bus := NewInMemoryMessageBus().(*InMemoryMessageBus)
+	ctx := context.Background()
+
+	busy, _ := bus.SubscribeGroup(ctx, "jobs", "workers", WithBalance(LeastLoaded))
+	bus.Publish(ctx, "jobs", NewMessage([]byte("first")))
+	bus.Publish(ctx, "jobs", NewMessage([]byte("second")))
+	idle, _ := bus.SubscribeGroup(ctx, "jobs", "workers")
+
+	for i := range 4 {
+		bus.Publish(ctx, "jobs", NewMessage(fmt.Appendf(nil, "%d", i)))
+	}
+	// idle catches up with busy before they alternate.
+	if len(busy) != 3 || len(idle) != 3 {
+		t.Errorf("expected 3/3 split, got %d/%d", len(busy), len(idle))
+	}
+}
+
+func TestRedisGroupDropsDeadMembersAndCapsQueues(t *testing.T) {
+	server := miniredis.RunT(t)
+	bus := NewRedisMessageBusWithOptions(&redis.Options{Addr: server.Addr()}, RedisOptions{GroupQueueLen: 3})
+	defer bus.Close()
+	ctx := context.Background()
+
+	// Groups of processes that died without unsubscribing: one whose
+	// member expired, and one whose member has not expired yet.
+	server.SAdd(groupsKeyPrefix+"jobs", "expired", "stalled")
+	server.ZAdd(groupKeyPrefix+"jobs:expired:members", float64(time.Now().Add(-time.Second).UnixMilli()), "dead")
+	server.ZAdd(groupKeyPrefix+"jobs:stalled:members", float64(time.Now().Add(time.Minute).UnixMilli()), "dead")
+
+	for i := range 5 {
+		bus.Publish(ctx, "jobs", NewMessage(fmt.Appendf(nil, "%d", i)))
+	}
+
+	if server.Exists(groupKeyPrefix+"jobs:expired") || server.Exists(groupKeyPrefix+"jobs:expired:members") {
+		t.Error("expected the group of the expired member to be removed")
+	}
+	if groups, _ := server.Members(groupsKeyPrefix + "jobs"); len(groups) != 1 || groups[0] != "stalled" {
+		t.Errorf("expected only the stalled group to be left, got %v", groups)
+	}
+	queue, _ := server.List(groupKeyPrefix + "jobs:stalled")
+	if len(queue) != 3 {
+		t.Fatalf("expected the queue to be capped at 3 messages, got %d", len(queue))
+	}
+	if msg, _ := Decode([]byte(queue[0])); string(msg.Payload) != "2" {
+		t.Errorf("expected the oldest messages to be dropped, got '%s' first", msg.Payload)
+	}
+}
+
+func TestGroupRejectsPatterns(t *testing.T) {
+	bus := NewInMemoryMessageBus().(GroupSubscriber)
+
+	_, err := bus.SubscribeGroup(context.Background(), "jobs.*", "workers")
+	if err == nil {
+		t.Fatal("expected an error for a pattern group subscription")
+	}
+}
@@ -1,56 +1,329 @@
 package messagebus
 
 import (
+	"context"
+	"fmt"
 	"log"
 	"sync"
+	"sync/atomic"
 )
 
 type InMemoryMessageBus struct {
 	mu          sync.RWMutex
-	subscribers map[string][]chan []byte
+	subscribers map[string][]*subscriber
+	patterns    topicTrie
+	groups      map[string][]*queueGroup
+	retained    map[string]Message
+	drops       dropCounts
+	closed      bool
+}
+
+type subscriber struct {
+	// topic is the topic or pattern the subscription was created with.
+	topic string
+	ch    chan Message
+	opts  subscribeOptions
+}
+
+// queueGroup is the set of members of one group subscription.
+type queueGroup struct {
+	name    string
+	balance Balance
+	members []*subscriber
+	// next is advanced by concurrent publishers holding only the read lock.
+	next atomic.Uint64
+}
+
+// pick returns the member that receives the next message.
+func (g *queueGroup) pick() *subscriber {
+	if g.balance == LeastLoaded {
+		best := g.members[0]
+		for _, m := range g.members[1:] {
+			if len(m.ch) < len(best.ch) {
+				best = m
+			}
+		}
+		return best
+	}
+
+	start := int(g.next.Add(1) - 1)
+	for i := range g.members {
+		m := g.members[(start+i)%len(g.members)]
+		if len(m.ch) < cap(m.ch) {
+			return m
+		}
+	}
+	// Everybody is full, let the overflow policy of the member whose turn
+	// it is decide.
+	return g.members[start%len(g.members)]
 }
 
 func NewInMemoryMessageBus() MessageBus {
 	return &InMemoryMessageBus{
-		subscribers: make(map[string][]chan []byte),
+		subscribers: make(map[string][]*subscriber),
+		groups:      make(map[string][]*queueGroup),
+		retained:    make(map[string]Message),
 	}
 }
 
-func (mb *InMemoryMessageBus) Subscribe(topic string) chan []byte {
+// Subscribe subscribes to topic, which may be a pattern (see MatchTopic).
+func (mb *InMemoryMessageBus) Subscribe(ctx context.Context, topic string, opts ...SubscribeOption) (chan Message, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	isPattern := IsPattern(topic)
+	if isPattern {
+		if err := validatePattern(topic); err != nil {
+			return nil, err
+		}
+	}
+
 	mb.mu.Lock()
 	defer mb.mu.Unlock()
 
-	ch := make(chan []byte, 256)
-	mb.subscribers[topic] = append(mb.subscribers[topic], ch)
+	if mb.closed {
+		return nil, ErrClosed
+	}
+
+	o := newSubscribeOptions(opts)
+	sub := &subscriber{
+		topic: topic,
+		ch:    make(chan Message, o.bufferSize),
+		opts:  o,
+	}
+	if isPattern {
+		mb.patterns.insert(topic, sub)
+	} else {
+		mb.subscribers[topic] = append(mb.subscribers[topic], sub)
+	}
+
+	// Holding the lock means no publish can slip in between the retained
+	// messages and the live ones.
+	for retainedTopic, msg := range mb.retained {
+		if retainedTopic == topic || (isPattern && MatchTopic(topic, retainedTopic)) {
+			if dropped, _ := o.deliver(ctx, sub.ch, msg); dropped {
+				mb.drops.add(retainedTopic)
+			}
+		}
+	}
 
-	return ch
+	return sub.ch, nil
 }
 
-func (mb *InMemoryMessageBus) Unsubscribe(topic string, ch chan []byte) {
+func (mb *InMemoryMessageBus) Unsubscribe(topic string, ch chan Message) error {
 	mb.mu.Lock()
 	defer mb.mu.Unlock()
 
-	channels := mb.subscribers[topic]
-	for i, c := range channels {
-		if c == ch {
-			mb.subscribers[topic] = append(channels[:i], channels[i+1:]...)
+	if IsPattern(topic) {
+		if mb.patterns.remove(topic, ch) {
+			close(ch)
+		}
+		return nil
+	}
+
+	subs := mb.subscribers[topic]
+	for i, sub := range subs {
+		if sub.ch == ch {
+			mb.subscribers[topic] = append(subs[:i], subs[i+1:]...)
 
 			// Close the channel to signal completion
 			close(ch)
-			break
+			return nil
 		}
 	}
+
+	mb.leaveGroup(topic, ch)
+	return nil
 }
 
-func (mb *InMemoryMessageBus) Publish(topic string, msg []byte) {
-	mb.mu.RLock()
-	defer mb.mu.RUnlock()
+// SubscribeGroup joins group on topic. Options of the first member, such as
+// WithBalance, decide how the group spreads messages.
+func (mb *InMemoryMessageBus) SubscribeGroup(ctx context.Context, topic, group string, opts ...SubscribeOption) (chan Message, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if IsPattern(topic) {
+		return nil, fmt.Errorf("%w: group subscription to pattern %q", ErrNotSupported, topic)
+	}
+	if group == "" {
+		return nil, fmt.Errorf("%w: topic %s: empty group name", ErrSubscribeFailed, topic)
+	}
+
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	if mb.closed {
+		return nil, ErrClosed
+	}
+
+	o := newSubscribeOptions(opts)
+	sub := &subscriber{
+		topic: topic,
+		ch:    make(chan Message, o.bufferSize),
+		opts:  o,
+	}
 
-	for _, ch := range mb.subscribers[topic] {
-		select {
-		case ch <- msg:
-		default:
-			log.Printf("Warning: subscriber channel full, dropping message")
+	for _, g := range mb.groups[topic] {
+		if g.name == group {
+			g.members = append(g.members, sub)
+			return sub.ch, nil
 		}
 	}
+
+	g := &queueGroup{name: group, balance: o.balance, members: []*subscriber{sub}}
+	mb.groups[topic] = append(mb.groups[topic], g)
+	return sub.ch, nil
+}
+
+// leaveGroup removes the group member reading ch and hands the messages still
+// queued in ch to the remaining members. Must be called with mu held.
+func (mb *InMemoryMessageBus) leaveGroup(topic string, ch chan Message) {
+	groups := mb.groups[topic]
+	for gi, g := range groups {
+		for i, m := range g.members {
+			if m.ch != ch {
+				continue
+			}
+
+			g.members = append(g.members[:i], g.members[i+1:]...)
+			if len(g.members) == 0 {
+				mb.groups[topic] = append(groups[:gi], groups[gi+1:]...)
+				if len(mb.groups[topic]) == 0 {
+					delete(mb.groups, topic)
+				}
+				close(ch)
+				return
+			}
+
+		drain:
+			for {
+				select {
+				case msg := <-ch:
+					next := g.pick()
+					if dropped, _ := next.opts.deliver(context.Background(), next.ch, msg); dropped {
+						mb.drops.add(topic)
+					}
+				default:
+					break drain
+				}
+			}
+			close(ch)
+			return
+		}
+	}
+}
+
+// Publish delivers msg to every subscriber of topic and of every pattern
+// matching it, and to one member of every group on topic, applying each
+// subscription's overflow policy. Subscribers using BlockWithTimeout hold up
+// the publisher (and Subscribe/Unsubscribe calls) for at most their timeout.
+func (mb *InMemoryMessageBus) Publish(ctx context.Context, topic string, msg Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if IsPattern(topic) {
+		return fmt.Errorf("%w: cannot publish to pattern %q", ErrInvalidTopic, topic)
+	}
+	retain := msg.Retain
+	msg = msg.stamp(topic)
+
+	var slow []*subscriber
+
+	deliver := func(sub *subscriber) {
+		dropped, disconnect := sub.opts.deliver(ctx, sub.ch, msg)
+		if dropped {
+			mb.drops.add(topic)
+			log.Printf("Warning: subscriber channel full on topic %s, dropping message (policy %s)", topic, sub.opts.policy)
+		}
+		if disconnect {
+			slow = append(slow, sub)
+		}
+	}
+
+	// Retained messages are stored and delivered under the write lock so a
+	// concurrent Subscribe sees them either as retained or as live, not both.
+	lock, unlock := mb.mu.RLock, mb.mu.RUnlock
+	if retain {
+		lock, unlock = mb.mu.Lock, mb.mu.Unlock
+	}
+
+	lock()
+	if mb.closed {
+		unlock()
+		return ErrClosed
+	}
+	if retain {
+		if len(msg.Payload) == 0 {
+			delete(mb.retained, topic)
+		} else {
+			mb.retained[topic] = msg
+		}
+	}
+	for _, sub := range mb.subscribers[topic] {
+		deliver(sub)
+	}
+	mb.patterns.match(topic, deliver)
+	for _, g := range mb.groups[topic] {
+		deliver(g.pick())
+	}
+	unlock()
+
+	for _, sub := range slow {
+		log.Printf("Disconnecting slow subscriber on topic %s", sub.topic)
+		mb.Unsubscribe(sub.topic, sub.ch)
+	}
+
+	return nil
+}
+
+// Dropped returns how many messages published on topic were dropped because
+// a subscriber channel was full.
+func (mb *InMemoryMessageBus) Dropped(topic string) uint64 {
+	return mb.drops.Dropped(topic)
+}
+
+// ClearRetained forgets the retained message of topic.
+func (mb *InMemoryMessageBus) ClearRetained(ctx context.Context, topic string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	delete(mb.retained, topic)
+	return nil
+}
+
+// Close closes every subscription channel. Later calls to Subscribe and
+// Publish fail with ErrClosed.
+func (mb *InMemoryMessageBus) Close() error {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	if mb.closed {
+		return nil
+	}
+	mb.closed = true
+
+	closeSub := func(sub *subscriber) { close(sub.ch) }
+	for _, subs := range mb.subscribers {
+		for _, sub := range subs {
+			closeSub(sub)
+		}
+	}
+	mb.patterns.each(closeSub)
+	for _, groups := range mb.groups {
+		for _, g := range groups {
+			for _, sub := range g.members {
+				closeSub(sub)
+			}
+		}
+	}
+
+	mb.subscribers = make(map[string][]*subscriber)
+	mb.patterns = topicTrie{}
+	mb.groups = make(map[string][]*queueGroup)
+	return nil
 }
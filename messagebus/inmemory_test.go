@@ -2,21 +2,27 @@ package messagebus
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"testing"
 	"time"
 )
 
 func TestBasicPubSub(t *testing.T) {
 	bus := NewInMemoryMessageBus()
+	ctx := context.Background()
 	topic := "test-topic"
 
-	ch := bus.Subscribe(topic)
-	bus.Publish(topic, []byte("hello"))
+	ch, err := bus.Subscribe(ctx, topic)
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	bus.Publish(ctx, topic, NewMessage([]byte("hello")))
 
 	select {
 	case msg := <-ch:
-		if !bytes.Equal(msg, []byte("hello")) {
-			t.Errorf("expected 'hello', got '%s'", msg)
+		if !bytes.Equal(msg.Payload, []byte("hello")) {
+			t.Errorf("expected 'hello', got '%s'", msg.Payload)
 		}
 	case <-time.After(100 * time.Millisecond):
 		t.Fatal("timeout waiting for message")
@@ -25,20 +31,30 @@ func TestBasicPubSub(t *testing.T) {
 
 func TestMultipleSubscribersSameTopic(t *testing.T) {
 	bus := NewInMemoryMessageBus()
+	ctx := context.Background()
 	topic := "test-topic"
 
-	ch1 := bus.Subscribe(topic)
-	ch2 := bus.Subscribe(topic)
-	ch3 := bus.Subscribe(topic)
+	ch1, err := bus.Subscribe(ctx, topic)
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	ch2, err := bus.Subscribe(ctx, topic)
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	ch3, err := bus.Subscribe(ctx, topic)
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
 
-	bus.Publish(topic, []byte("broadcast"))
+	bus.Publish(ctx, topic, NewMessage([]byte("broadcast")))
 
-	channels := []chan []byte{ch1, ch2, ch3}
+	channels := []chan Message{ch1, ch2, ch3}
 	for i, ch := range channels {
 		select {
 		case msg := <-ch:
-			if !bytes.Equal(msg, []byte("broadcast")) {
-				t.Errorf("subscriber %d: expected 'broadcast', got '%s'", i, msg)
+			if !bytes.Equal(msg.Payload, []byte("broadcast")) {
+				t.Errorf("subscriber %d: expected 'broadcast', got '%s'", i, msg.Payload)
 			}
 		case <-time.After(100 * time.Millisecond):
 			t.Fatalf("subscriber %d: timeout waiting for message", i)
@@ -48,17 +64,24 @@ func TestMultipleSubscribersSameTopic(t *testing.T) {
 
 func TestTopicIsolation(t *testing.T) {
 	bus := NewInMemoryMessageBus()
+	ctx := context.Background()
 
-	ch1 := bus.Subscribe("topic1")
-	ch2 := bus.Subscribe("topic2")
+	ch1, err := bus.Subscribe(ctx, "topic1")
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	ch2, err := bus.Subscribe(ctx, "topic2")
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
 
-	bus.Publish("topic1", []byte("message1"))
-	bus.Publish("topic2", []byte("message2"))
+	bus.Publish(ctx, "topic1", NewMessage([]byte("message1")))
+	bus.Publish(ctx, "topic2", NewMessage([]byte("message2")))
 
 	select {
 	case msg := <-ch1:
-		if !bytes.Equal(msg, []byte("message1")) {
-			t.Errorf("topic1: expected 'message1', got '%s'", msg)
+		if !bytes.Equal(msg.Payload, []byte("message1")) {
+			t.Errorf("topic1: expected 'message1', got '%s'", msg.Payload)
 		}
 	case <-time.After(100 * time.Millisecond):
 		t.Fatal("topic1: timeout waiting for message")
@@ -66,8 +89,8 @@ func TestTopicIsolation(t *testing.T) {
 
 	select {
 	case msg := <-ch2:
-		if !bytes.Equal(msg, []byte("message2")) {
-			t.Errorf("topic2: expected 'message2', got '%s'", msg)
+		if !bytes.Equal(msg.Payload, []byte("message2")) {
+			t.Errorf("topic2: expected 'message2', got '%s'", msg.Payload)
 		}
 	case <-time.After(100 * time.Millisecond):
 		t.Fatal("topic2: timeout waiting for message")
@@ -75,23 +98,27 @@ func TestTopicIsolation(t *testing.T) {
 
 	select {
 	case msg := <-ch1:
-		t.Errorf("topic1 received unexpected message: '%s'", msg)
+		t.Errorf("topic1 received unexpected message: '%s'", msg.Payload)
 	case <-time.After(50 * time.Millisecond):
 	}
 
 	select {
 	case msg := <-ch2:
-		t.Errorf("topic2 received unexpected message: '%s'", msg)
+		t.Errorf("topic2 received unexpected message: '%s'", msg.Payload)
 	case <-time.After(50 * time.Millisecond):
 	}
 }
 
 func TestUnsubscribe(t *testing.T) {
 	bus := NewInMemoryMessageBus()
+	ctx := context.Background()
 	topic := "test-topic"
 
-	ch := bus.Subscribe(topic)
-	bus.Publish(topic, []byte("before"))
+	ch, err := bus.Subscribe(ctx, topic)
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	bus.Publish(ctx, topic, NewMessage([]byte("before")))
 
 	select {
 	case <-ch:
@@ -99,19 +126,21 @@ func TestUnsubscribe(t *testing.T) {
 		t.Fatal("timeout waiting for message before unsubscribe")
 	}
 
-	bus.Unsubscribe(topic, ch)
+	if err := bus.Unsubscribe(topic, ch); err != nil {
+		t.Fatalf("Unsubscribe failed: %v", err)
+	}
 
 	_, ok := <-ch
 	if ok {
 		t.Fatal("channel should be closed after unsubscribe")
 	}
 
-	bus.Publish(topic, []byte("after"))
+	bus.Publish(ctx, topic, NewMessage([]byte("after")))
 
 	select {
 	case msg, ok := <-ch:
 		if ok {
-			t.Errorf("received message after unsubscribe: '%s'", msg)
+			t.Errorf("received message after unsubscribe: '%s'", msg.Payload)
 		}
 	case <-time.After(50 * time.Millisecond):
 	}
@@ -119,15 +148,19 @@ func TestUnsubscribe(t *testing.T) {
 
 func TestFullChannelDropsMessage(t *testing.T) {
 	bus := NewInMemoryMessageBus()
+	ctx := context.Background()
 	topic := "test-topic"
 
-	ch := bus.Subscribe(topic)
+	ch, err := bus.Subscribe(ctx, topic)
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
 
 	for i := 0; i < 256; i++ {
-		bus.Publish(topic, []byte("fill"))
+		bus.Publish(ctx, topic, NewMessage([]byte("fill")))
 	}
 
-	bus.Publish(topic, []byte("dropped"))
+	bus.Publish(ctx, topic, NewMessage([]byte("dropped")))
 
 	time.Sleep(10 * time.Millisecond)
 
@@ -144,24 +177,28 @@ func TestFullChannelDropsMessage(t *testing.T) {
 
 func TestSubscribeAfterPublish(t *testing.T) {
 	bus := NewInMemoryMessageBus()
+	ctx := context.Background()
 	topic := "test-topic"
 
-	bus.Publish(topic, []byte("old"))
+	bus.Publish(ctx, topic, NewMessage([]byte("old")))
 
-	ch := bus.Subscribe(topic)
+	ch, err := bus.Subscribe(ctx, topic)
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
 
 	select {
 	case msg := <-ch:
-		t.Errorf("received old message: '%s'", msg)
+		t.Errorf("received old message: '%s'", msg.Payload)
 	case <-time.After(50 * time.Millisecond):
 	}
 
-	bus.Publish(topic, []byte("new"))
+	bus.Publish(ctx, topic, NewMessage([]byte("new")))
 
 	select {
 	case msg := <-ch:
-		if !bytes.Equal(msg, []byte("new")) {
-			t.Errorf("expected 'new', got '%s'", msg)
+		if !bytes.Equal(msg.Payload, []byte("new")) {
+			t.Errorf("expected 'new', got '%s'", msg.Payload)
 		}
 	case <-time.After(100 * time.Millisecond):
 		t.Fatal("timeout waiting for new message")
@@ -170,6 +207,265 @@ func TestSubscribeAfterPublish(t *testing.T) {
 
 func TestPublishToTopicWithNoSubscribers(t *testing.T) {
 	bus := NewInMemoryMessageBus()
+	ctx := context.Background()
+
+	bus.Publish(ctx, "nonexistent", NewMessage([]byte("test")))
+}
+
+func TestSubscribeCancelledContext(t *testing.T) {
+	bus := NewInMemoryMessageBus()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := bus.Subscribe(ctx, "test-topic")
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestPublishCancelledContext(t *testing.T) {
+	bus := NewInMemoryMessageBus()
+	ch, err := bus.Subscribe(context.Background(), "test-topic")
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err = bus.Publish(ctx, "test-topic", NewMessage([]byte("hello")))
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+
+	select {
+	case msg := <-ch:
+		t.Errorf("received message from cancelled publish: '%s'", msg.Payload)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestBufferSizeOption(t *testing.T) {
+	bus := NewInMemoryMessageBus()
+	ctx := context.Background()
+
+	ch, err := bus.Subscribe(ctx, "test-topic", WithBufferSize(4))
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+
+	if cap(ch) != 4 {
+		t.Errorf("expected capacity 4, got %d", cap(ch))
+	}
+}
+
+func TestDropOldestPolicy(t *testing.T) {
+	bus := NewInMemoryMessageBus()
+	ctx := context.Background()
+	topic := "test-topic"
+
+	ch, err := bus.Subscribe(ctx, topic, WithBufferSize(2), WithOverflowPolicy(DropOldest))
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+
+	for _, msg := range []string{"1", "2", "3"} {
+		bus.Publish(ctx, topic, NewMessage([]byte(msg)))
+	}
+
+	for _, expected := range []string{"2", "3"} {
+		msg := <-ch
+		if string(msg.Payload) != expected {
+			t.Errorf("expected '%s', got '%s'", expected, msg.Payload)
+		}
+	}
+
+	if dropped := bus.(DropCounter).Dropped(topic); dropped != 1 {
+		t.Errorf("expected 1 dropped message, got %d", dropped)
+	}
+}
+
+func TestBlockWithTimeoutPolicy(t *testing.T) {
+	bus := NewInMemoryMessageBus()
+	ctx := context.Background()
+	topic := "test-topic"
+
+	ch, err := bus.Subscribe(ctx, topic,
+		WithBufferSize(1),
+		WithOverflowPolicy(BlockWithTimeout),
+		WithBlockTimeout(time.Second))
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+
+	bus.Publish(ctx, topic, NewMessage([]byte("first")))
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		<-ch
+	}()
+
+	// Blocks until the reader above makes room.
+	bus.Publish(ctx, topic, NewMessage([]byte("second")))
+
+	select {
+	case msg := <-ch:
+		if string(msg.Payload) != "second" {
+			t.Errorf("expected 'second', got '%s'", msg.Payload)
+		}
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("timeout waiting for blocked message")
+	}
+
+	if dropped := bus.(DropCounter).Dropped(topic); dropped != 0 {
+		t.Errorf("expected no dropped messages, got %d", dropped)
+	}
+}
+
+func TestBlockWithTimeoutPolicyGivesUp(t *testing.T) {
+	bus := NewInMemoryMessageBus()
+	ctx := context.Background()
+	topic := "test-topic"
+
+	_, err := bus.Subscribe(ctx, topic,
+		WithBufferSize(1),
+		WithOverflowPolicy(BlockWithTimeout),
+		WithBlockTimeout(10*time.Millisecond))
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+
+	bus.Publish(ctx, topic, NewMessage([]byte("first")))
+
+	start := time.Now()
+	bus.Publish(ctx, topic, NewMessage([]byte("second")))
+	if elapsed := time.Since(start); elapsed < 10*time.Millisecond {
+		t.Errorf("publish returned after %v, expected to block", elapsed)
+	}
+
+	if dropped := bus.(DropCounter).Dropped(topic); dropped != 1 {
+		t.Errorf("expected 1 dropped message, got %d", dropped)
+	}
+}
+
+func TestDisconnectSlowConsumerPolicy(t *testing.T) {
+	bus := NewInMemoryMessageBus()
+	ctx := context.Background()
+	topic := "test-topic"
+
+	slow, err := bus.Subscribe(ctx, topic, WithBufferSize(1), WithOverflowPolicy(DisconnectSlowConsumer))
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	fast, err := bus.Subscribe(ctx, topic, WithBufferSize(8))
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+
+	bus.Publish(ctx, topic, NewMessage([]byte("first")))
+	bus.Publish(ctx, topic, NewMessage([]byte("second")))
+
+	if msg := <-slow; string(msg.Payload) != "first" {
+		t.Errorf("expected 'first', got '%s'", msg.Payload)
+	}
+	if _, ok := <-slow; ok {
+		t.Fatal("slow subscriber channel should be closed")
+	}
+
+	if len(fast) != 2 {
+		t.Errorf("expected fast subscriber to receive 2 messages, got %d", len(fast))
+	}
+
+	// Unsubscribing an evicted channel must not panic.
+	if err := bus.Unsubscribe(topic, slow); err != nil {
+		t.Fatalf("Unsubscribe failed: %v", err)
+	}
+}
+
+func TestPatternSubscription(t *testing.T) {
+	bus := NewInMemoryMessageBus()
+	ctx := context.Background()
+
+	ch, err := bus.Subscribe(ctx, "*:from-service-to-ws")
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+
+	bus.Publish(ctx, "echo:from-service-to-ws", NewMessage([]byte("echo")))
+	bus.Publish(ctx, "echo:from-ws-to-service", NewMessage([]byte("ignored")))
+	bus.Publish(ctx, "timenow:from-service-to-ws", NewMessage([]byte("timenow")))
+
+	for _, expected := range []string{"echo", "timenow"} {
+		select {
+		case msg := <-ch:
+			if string(msg.Payload) != expected {
+				t.Errorf("expected '%s', got '%s'", expected, msg.Payload)
+			}
+		case <-time.After(100 * time.Millisecond):
+			t.Fatalf("timeout waiting for '%s'", expected)
+		}
+	}
+
+	select {
+	case msg := <-ch:
+		t.Errorf("received unexpected message: '%s'", msg.Payload)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestPatternAndExactSubscribersBothReceive(t *testing.T) {
+	bus := NewInMemoryMessageBus()
+	ctx := context.Background()
+
+	exact, err := bus.Subscribe(ctx, "chat.rooms.lobby")
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	pattern, err := bus.Subscribe(ctx, "chat.rooms.>")
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+
+	bus.Publish(ctx, "chat.rooms.lobby", NewMessage([]byte("hi")))
 
-	bus.Publish("nonexistent", []byte("test"))
+	for i, ch := range []chan Message{exact, pattern} {
+		select {
+		case msg := <-ch:
+			if string(msg.Payload) != "hi" {
+				t.Errorf("subscriber %d: expected 'hi', got '%s'", i, msg.Payload)
+			}
+		case <-time.After(100 * time.Millisecond):
+			t.Fatalf("subscriber %d: timeout waiting for message", i)
+		}
+	}
+}
+
+func TestPatternUnsubscribe(t *testing.T) {
+	bus := NewInMemoryMessageBus()
+	ctx := context.Background()
+	pattern := "chat.rooms.>"
+
+	ch, err := bus.Subscribe(ctx, pattern)
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+
+	if err := bus.Unsubscribe(pattern, ch); err != nil {
+		t.Fatalf("Unsubscribe failed: %v", err)
+	}
+
+	if _, ok := <-ch; ok {
+		t.Fatal("channel should be closed after unsubscribe")
+	}
+
+	bus.Publish(ctx, "chat.rooms.lobby", NewMessage([]byte("after")))
+}
+
+func TestPublishToPatternFails(t *testing.T) {
+	bus := NewInMemoryMessageBus()
+
+	err := bus.Publish(context.Background(), "chat.*", NewMessage([]byte("nope")))
+	if !errors.Is(err, ErrInvalidTopic) {
+		t.Fatalf("expected ErrInvalidTopic, got %v", err)
+	}
 }
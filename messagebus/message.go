@@ -0,0 +1,107 @@
+package messagebus
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"maps"
+	"time"
+)
+
+// Content types WebSocket clients stamp on the frames they read, and that
+// select the frame type they write: text frames for text/*, JSON and any
+// type with a charset, binary frames otherwise.
+const (
+	ContentTypeText   = "text/plain; charset=utf-8"
+	ContentTypeBinary = "application/octet-stream"
+)
+
+// Well-known message headers.
+const (
+	// HeaderContentType describes the payload, e.g. "text/plain; charset=utf-8".
+	HeaderContentType = "Content-Type"
+	// HeaderConnectionID identifies the WebSocket connection a message came from.
+	HeaderConnectionID = "Connection-Id"
+	// HeaderRemoteAddr is the network address of the WebSocket peer.
+	HeaderRemoteAddr = "Remote-Addr"
+	// HeaderReplyTo is the topic that reaches only the sender of a message.
+	HeaderReplyTo = "Reply-To"
+	// HeaderUserID and HeaderUserRoles identify the authenticated user of
+	// the WebSocket connection a message came from; roles are separated by
+	// commas.
+	HeaderUserID    = "User-Id"
+	HeaderUserRoles = "User-Roles"
+	// HeaderOffset is the position of a message in its topic log, on
+	// backends that keep one. Pass it to WithStartOffset to resume.
+	HeaderOffset = "Offset"
+)
+
+// Message is the envelope moved by the bus. Publish fills in Topic, and ID
+// and Timestamp when they are empty. Headers should be treated as read-only
+// once published since every subscriber shares the same map.
+//
+// On buses implementing Retainer, publishing with Retain set also stores the
+// message as the topic's last value, which every new subscriber receives
+// first. Publishing a retained message with an empty payload clears it.
+// Retain only instructs Publish: it is cleared on the copies subscribers
+// get, so forwarding a received message does not retain it again.
+type Message struct {
+	ID        string            `json:"id"`
+	Topic     string            `json:"topic"`
+	Timestamp time.Time         `json:"timestamp"`
+	Headers   map[string]string `json:"headers,omitempty"`
+	Payload   []byte            `json:"payload"`
+	Retain    bool              `json:"retain,omitempty"`
+}
+
+// NewMessage returns a message carrying payload and no headers.
+func NewMessage(payload []byte) Message {
+	return Message{Payload: payload}
+}
+
+// Header returns the value of header key, or "" if it is not set.
+func (m Message) Header(key string) string {
+	return m.Headers[key]
+}
+
+// WithHeader returns a copy of m with header key set to value. The original
+// headers map is left untouched.
+func (m Message) WithHeader(key, value string) Message {
+	headers := make(map[string]string, len(m.Headers)+1)
+	maps.Copy(headers, m.Headers)
+	headers[key] = value
+	m.Headers = headers
+	return m
+}
+
+// stamp prepares m for publishing on topic. Callers read m.Retain first.
+func (m Message) stamp(topic string) Message {
+	m.Topic = topic
+	m.Retain = false
+	if m.ID == "" {
+		m.ID = NewID()
+	}
+	if m.Timestamp.IsZero() {
+		m.Timestamp = time.Now().UTC()
+	}
+	return m
+}
+
+// NewID returns a random 128-bit identifier in hex.
+func NewID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// Encode serializes m for backends that move bytes over the wire.
+func Encode(m Message) ([]byte, error) {
+	return json.Marshal(m)
+}
+
+// Decode is the inverse of Encode.
+func Decode(data []byte) (Message, error) {
+	var m Message
+	err := json.Unmarshal(data, &m)
+	return m, err
+}
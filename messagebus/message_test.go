@@ -0,0 +1,84 @@
+package messagebus
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestEncodeDecodeRoundTrip(t *testing.T) {
+	original := NewMessage([]byte{0x00, 0xff, 'h', 'i'}).
+		WithHeader(HeaderConnectionID, "conn-1").
+		WithHeader(HeaderContentType, "application/octet-stream").
+		stamp("echo:from-ws-to-service")
+
+	data, err := Encode(original)
+	if err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+
+	decoded, err := Decode(data)
+	if err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+
+	if decoded.ID != original.ID {
+		t.Errorf("expected ID %s, got %s", original.ID, decoded.ID)
+	}
+	if decoded.Topic != original.Topic {
+		t.Errorf("expected topic %s, got %s", original.Topic, decoded.Topic)
+	}
+	if !decoded.Timestamp.Equal(original.Timestamp) {
+		t.Errorf("expected timestamp %s, got %s", original.Timestamp, decoded.Timestamp)
+	}
+	if !bytes.Equal(decoded.Payload, original.Payload) {
+		t.Errorf("expected payload %v, got %v", original.Payload, decoded.Payload)
+	}
+	if decoded.Header(HeaderConnectionID) != "conn-1" {
+		t.Errorf("expected connection ID header 'conn-1', got '%s'", decoded.Header(HeaderConnectionID))
+	}
+}
+
+func TestWithHeaderDoesNotMutateOriginal(t *testing.T) {
+	original := NewMessage([]byte("hi")).WithHeader("A", "1")
+	copied := original.WithHeader("B", "2")
+
+	if original.Header("B") != "" {
+		t.Error("WithHeader modified the original headers")
+	}
+	if copied.Header("A") != "1" || copied.Header("B") != "2" {
+		t.Errorf("unexpected headers on copy: %v", copied.Headers)
+	}
+}
+
+func TestPublishStampsEnvelope(t *testing.T) {
+	bus := NewInMemoryMessageBus()
+	ctx := t.Context()
+	topic := "test-topic"
+
+	ch, err := bus.Subscribe(ctx, topic)
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+
+	before := time.Now()
+	bus.Publish(ctx, topic, NewMessage([]byte("hello")).WithHeader("X-Trace", "abc"))
+
+	select {
+	case msg := <-ch:
+		if msg.ID == "" {
+			t.Error("expected message ID to be set")
+		}
+		if msg.Topic != topic {
+			t.Errorf("expected topic %s, got %s", topic, msg.Topic)
+		}
+		if msg.Timestamp.Before(before.Add(-time.Second)) {
+			t.Errorf("unexpected timestamp %s", msg.Timestamp)
+		}
+		if msg.Header("X-Trace") != "abc" {
+			t.Errorf("expected header X-Trace 'abc', got '%s'", msg.Header("X-Trace"))
+		}
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("timeout waiting for message")
+	}
+}
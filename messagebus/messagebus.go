@@ -1,7 +1,56 @@
 package messagebus
 
+import (
+	"context"
+	"errors"
+)
+
+// ErrSubscribeFailed is returned (wrapped) when a backend could not set up a
+// subscription, e.g. because the broker is unreachable.
+var ErrSubscribeFailed = errors.New("messagebus: subscribe failed")
+
+// ErrPublishFailed is returned (wrapped) when a backend could not deliver a
+// message to the broker.
+var ErrPublishFailed = errors.New("messagebus: publish failed")
+
+// ErrNotSupported is returned (wrapped) when a backend cannot provide an
+// optional feature, e.g. pattern subscriptions on Redis Streams.
+var ErrNotSupported = errors.New("messagebus: not supported by this backend")
+
+// ErrClosed is returned by a bus that has been closed.
+var ErrClosed = errors.New("messagebus: bus closed")
+
+// MessageBus is the contract between WebSocket clients and services.
+//
+// Subscribe and Publish honor ctx: an already cancelled or expired context
+// makes them fail with ctx.Err(), and backends that talk to a broker use it
+// as the deadline for that round trip. The returned subscription lives until
+// Unsubscribe is called, at which point its channel is closed. A bus may also
+// close the channel itself when a subscription using DisconnectSlowConsumer
+// falls behind; Unsubscribe on such a channel is a no-op.
+//
+// Close ends every subscription, closing its channel, and releases the
+// bus's connections and files. The bus must not be used afterwards.
 type MessageBus interface {
-	Subscribe(topic string) chan []byte
-	Unsubscribe(topic string, ch chan []byte)
-	Publish(topic string, msg []byte)
+	Subscribe(ctx context.Context, topic string, opts ...SubscribeOption) (chan Message, error)
+	Unsubscribe(topic string, ch chan Message) error
+	Publish(ctx context.Context, topic string, msg Message) error
+	Close() error
+}
+
+// Retainer is implemented by buses that keep the last retained message of
+// each topic (see Message.Retain).
+type Retainer interface {
+	// ClearRetained forgets the retained message of topic, if any.
+	ClearRetained(ctx context.Context, topic string) error
+}
+
+// GroupSubscriber is implemented by buses that support load-balanced (queue)
+// subscriptions.
+type GroupSubscriber interface {
+	// SubscribeGroup joins group on topic. Every message published on topic
+	// goes to exactly one member of each group, besides the regular
+	// subscribers. Members leave with Unsubscribe; their share of the
+	// traffic moves to the remaining members. Patterns are not supported.
+	SubscribeGroup(ctx context.Context, topic, group string, opts ...SubscribeOption) (chan Message, error)
 }
@@ -0,0 +1,220 @@
+package messagebus
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultBufferSize is the channel capacity of a subscription created
+	// without WithBufferSize.
+	DefaultBufferSize = 256
+
+	// DefaultBlockTimeout is how long BlockWithTimeout waits for room in a
+	// subscriber channel when no WithBlockTimeout is given.
+	DefaultBlockTimeout = 100 * time.Millisecond
+)
+
+// OverflowPolicy decides what happens when a message is published to a
+// subscriber whose channel is full.
+type OverflowPolicy int
+
+const (
+	// DropNewest discards the message being published. This is the default.
+	DropNewest OverflowPolicy = iota
+	// DropOldest discards the oldest queued message to make room.
+	DropOldest
+	// BlockWithTimeout makes the publisher wait for room, up to the
+	// subscription's block timeout, before dropping the message.
+	BlockWithTimeout
+	// DisconnectSlowConsumer drops the message and unsubscribes the
+	// subscriber, closing its channel.
+	DisconnectSlowConsumer
+)
+
+func (p OverflowPolicy) String() string {
+	switch p {
+	case DropNewest:
+		return "drop-newest"
+	case DropOldest:
+		return "drop-oldest"
+	case BlockWithTimeout:
+		return "block-with-timeout"
+	case DisconnectSlowConsumer:
+		return "disconnect-slow-consumer"
+	default:
+		return "unknown"
+	}
+}
+
+// SubscribeOption configures a single subscription.
+type SubscribeOption func(*subscribeOptions)
+
+type subscribeOptions struct {
+	bufferSize   int
+	policy       OverflowPolicy
+	blockTimeout time.Duration
+	durableName  string
+	startOffset  int64
+	balance      Balance
+}
+
+// WithBufferSize sets the capacity of the subscription channel.
+func WithBufferSize(size int) SubscribeOption {
+	return func(o *subscribeOptions) {
+		if size > 0 {
+			o.bufferSize = size
+		}
+	}
+}
+
+// WithOverflowPolicy sets what happens when the subscription channel is full.
+func WithOverflowPolicy(policy OverflowPolicy) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.policy = policy
+	}
+}
+
+// WithBlockTimeout sets how long BlockWithTimeout waits before dropping.
+func WithBlockTimeout(timeout time.Duration) SubscribeOption {
+	return func(o *subscribeOptions) {
+		if timeout > 0 {
+			o.blockTimeout = timeout
+		}
+	}
+}
+
+// WithDurableName makes the subscription durable on backends that persist
+// messages: a later subscription with the same name on the same topic
+// resumes where this one stopped, receiving what was published in between.
+// Backends without persistence ignore it.
+func WithDurableName(name string) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.durableName = name
+	}
+}
+
+// Special offsets for WithStartOffset.
+const (
+	// OffsetLatest starts a subscription with the next published message.
+	OffsetLatest int64 = -1
+	// OffsetEarliest starts a subscription with the oldest retained message.
+	OffsetEarliest int64 = -2
+)
+
+// WithStartOffset makes a subscription on a backend with a replayable log
+// start at offset, or at OffsetLatest/OffsetEarliest. Offsets older than
+// what is retained start at the earliest retained message. Backends without
+// a log ignore it and always start at OffsetLatest.
+func WithStartOffset(offset int64) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.startOffset = offset
+	}
+}
+
+// Balance decides which member of a group subscription receives a message.
+type Balance int
+
+const (
+	// RoundRobin hands messages to members in turn, skipping members whose
+	// channel is full. This is the default.
+	RoundRobin Balance = iota
+	// LeastLoaded hands each message to the member with the fewest queued
+	// messages.
+	LeastLoaded
+)
+
+// WithBalance sets how a group subscription spreads messages over its
+// members. The first member of a group decides; later members inherit it.
+// Backends where members pull from a shared queue ignore it.
+func WithBalance(balance Balance) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.balance = balance
+	}
+}
+
+func newSubscribeOptions(opts []SubscribeOption) subscribeOptions {
+	o := subscribeOptions{
+		bufferSize:   DefaultBufferSize,
+		policy:       DropNewest,
+		blockTimeout: DefaultBlockTimeout,
+		startOffset:  OffsetLatest,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// deliver hands msg to ch according to the overflow policy. It reports
+// whether a message was dropped and whether the subscriber must be
+// disconnected.
+func (o subscribeOptions) deliver(ctx context.Context, ch chan Message, msg Message) (dropped, disconnect bool) {
+	select {
+	case ch <- msg:
+		return false, false
+	default:
+	}
+
+	switch o.policy {
+	case DropOldest:
+		for {
+			select {
+			case <-ch:
+				dropped = true
+			default:
+			}
+			select {
+			case ch <- msg:
+				return dropped, false
+			default:
+			}
+		}
+	case BlockWithTimeout:
+		timer := time.NewTimer(o.blockTimeout)
+		defer timer.Stop()
+		select {
+		case ch <- msg:
+			return false, false
+		case <-timer.C:
+			return true, false
+		case <-ctx.Done():
+			return true, false
+		}
+	case DisconnectSlowConsumer:
+		return true, true
+	default:
+		return true, false
+	}
+}
+
+// DropCounter is implemented by buses that count messages lost to
+// subscriber backpressure.
+type DropCounter interface {
+	// Dropped returns how many messages published on topic were dropped
+	// because a subscriber could not keep up.
+	Dropped(topic string) uint64
+}
+
+type dropCounts struct {
+	mu     sync.Mutex
+	counts map[string]uint64
+}
+
+func (d *dropCounts) add(topic string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.counts == nil {
+		d.counts = make(map[string]uint64)
+	}
+	d.counts[topic]++
+}
+
+func (d *dropCounts) Dropped(topic string) uint64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.counts[topic]
+}
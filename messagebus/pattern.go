@@ -0,0 +1,210 @@
+package messagebus
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Topics are split into tokens on '.' and ':'. In a subscription pattern the
+// token "*" matches exactly one token and the token ">" matches one or more
+// trailing tokens, so "*:from-service-to-ws" matches
+// "echo:from-service-to-ws" and "chat.rooms.>" matches "chat.rooms.lobby" and
+// "chat.rooms.lobby.typing". Separators must match literally: "*.x" does not
+// match "a:x".
+const (
+	wildcardOne  = "*"
+	wildcardRest = ">"
+)
+
+// ErrInvalidTopic is returned for malformed subscription patterns and for
+// attempts to publish to a pattern.
+var ErrInvalidTopic = errors.New("messagebus: invalid topic")
+
+func isSeparator(token string) bool {
+	return token == "." || token == ":"
+}
+
+// tokenize splits topic into tokens, keeping the separators as tokens of
+// their own so that patterns can tell "a.b" and "a:b" apart.
+func tokenize(topic string) []string {
+	var tokens []string
+	start := 0
+	for i := 0; i < len(topic); i++ {
+		if topic[i] == '.' || topic[i] == ':' {
+			if i > start {
+				tokens = append(tokens, topic[start:i])
+			}
+			tokens = append(tokens, topic[i:i+1])
+			start = i + 1
+		}
+	}
+	if start < len(topic) {
+		tokens = append(tokens, topic[start:])
+	}
+	return tokens
+}
+
+// IsPattern reports whether topic contains a wildcard token.
+func IsPattern(topic string) bool {
+	for _, token := range tokenize(topic) {
+		if token == wildcardOne || token == wildcardRest {
+			return true
+		}
+	}
+	return false
+}
+
+func validatePattern(pattern string) error {
+	tokens := tokenize(pattern)
+	for i, token := range tokens {
+		if token == wildcardRest && i != len(tokens)-1 {
+			return fmt.Errorf("%w: %q: %q must be the last token", ErrInvalidTopic, pattern, wildcardRest)
+		}
+	}
+	return nil
+}
+
+// MatchTopic reports whether topic matches pattern. A pattern without
+// wildcards only matches itself.
+func MatchTopic(pattern, topic string) bool {
+	return matchTokens(tokenize(pattern), tokenize(topic))
+}
+
+func matchTokens(pattern, topic []string) bool {
+	for i, token := range pattern {
+		if i >= len(topic) {
+			return false
+		}
+		switch {
+		case token == wildcardRest:
+			return !isSeparator(topic[i])
+		case token == wildcardOne:
+			if isSeparator(topic[i]) {
+				return false
+			}
+		case token != topic[i]:
+			return false
+		}
+	}
+	return len(pattern) == len(topic)
+}
+
+// redisGlob translates a pattern into a Redis PSUBSCRIBE glob. The glob is
+// wider than the pattern ("*" also matches separators in Redis), so received
+// messages must still be filtered with MatchTopic.
+func redisGlob(pattern string) string {
+	var b strings.Builder
+	for _, token := range tokenize(pattern) {
+		switch token {
+		case wildcardOne, wildcardRest:
+			b.WriteString("*")
+		default:
+			for _, r := range token {
+				switch r {
+				case '*', '?', '[', ']', '\\':
+					b.WriteRune('\\')
+				}
+				b.WriteRune(r)
+			}
+		}
+	}
+	return b.String()
+}
+
+// topicTrie indexes pattern subscriptions by token so that a publish only
+// visits the patterns that can match its topic.
+type topicTrie struct {
+	root trieNode
+}
+
+type trieNode struct {
+	children map[string]*trieNode
+	subs     []*subscriber
+}
+
+func (t *topicTrie) insert(pattern string, sub *subscriber) {
+	node := &t.root
+	for _, token := range tokenize(pattern) {
+		if node.children == nil {
+			node.children = make(map[string]*trieNode)
+		}
+		child, ok := node.children[token]
+		if !ok {
+			child = &trieNode{}
+			node.children[token] = child
+		}
+		node = child
+	}
+	node.subs = append(node.subs, sub)
+}
+
+// remove deletes the subscription owning ch from pattern and prunes nodes
+// left empty. It reports whether the subscription was found.
+func (t *topicTrie) remove(pattern string, ch chan Message) bool {
+	return t.root.remove(tokenize(pattern), ch)
+}
+
+func (n *trieNode) remove(tokens []string, ch chan Message) bool {
+	if len(tokens) == 0 {
+		for i, sub := range n.subs {
+			if sub.ch == ch {
+				n.subs = append(n.subs[:i], n.subs[i+1:]...)
+				return true
+			}
+		}
+		return false
+	}
+
+	child, ok := n.children[tokens[0]]
+	if !ok || !child.remove(tokens[1:], ch) {
+		return false
+	}
+	if len(child.subs) == 0 && len(child.children) == 0 {
+		delete(n.children, tokens[0])
+	}
+	return true
+}
+
+// each calls fn for every subscription in the trie.
+func (t *topicTrie) each(fn func(*subscriber)) {
+	t.root.each(fn)
+}
+
+func (n *trieNode) each(fn func(*subscriber)) {
+	for _, sub := range n.subs {
+		fn(sub)
+	}
+	for _, child := range n.children {
+		child.each(fn)
+	}
+}
+
+// match calls fn for every subscription whose pattern matches topic.
+func (t *topicTrie) match(topic string, fn func(*subscriber)) {
+	t.root.match(tokenize(topic), fn)
+}
+
+func (n *trieNode) match(tokens []string, fn func(*subscriber)) {
+	if len(tokens) == 0 {
+		for _, sub := range n.subs {
+			fn(sub)
+		}
+		return
+	}
+
+	if child, ok := n.children[tokens[0]]; ok {
+		child.match(tokens[1:], fn)
+	}
+	if isSeparator(tokens[0]) {
+		return
+	}
+	if child, ok := n.children[wildcardOne]; ok {
+		child.match(tokens[1:], fn)
+	}
+	if child, ok := n.children[wildcardRest]; ok {
+		for _, sub := range child.subs {
+			fn(sub)
+		}
+	}
+}
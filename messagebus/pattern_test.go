@@ -0,0 +1,57 @@
+package messagebus
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestMatchTopic(t *testing.T) {
+	tests := []struct {
+		pattern string
+		topic   string
+		want    bool
+	}{
+		{"echo:from-service-to-ws", "echo:from-service-to-ws", true},
+		{"echo:from-service-to-ws", "echo:from-ws-to-service", false},
+		{"*:from-service-to-ws", "echo:from-service-to-ws", true},
+		{"*:from-service-to-ws", "timenow:from-service-to-ws", true},
+		{"*:from-service-to-ws", "echo.from-service-to-ws", false},
+		{"*:from-service-to-ws", "chat.lobby:from-service-to-ws", false},
+		{"chat.rooms.>", "chat.rooms.lobby", true},
+		{"chat.rooms.>", "chat.rooms.lobby.typing", true},
+		{"chat.rooms.>", "chat.rooms", false},
+		{"chat.rooms.>", "chat.rooms.", false},
+		{"chat.*.lobby", "chat.rooms.lobby", true},
+		{"chat.*.lobby", "chat.rooms.other", false},
+		{">", "anything:at.all", true},
+	}
+
+	for _, tt := range tests {
+		if got := MatchTopic(tt.pattern, tt.topic); got != tt.want {
+			t.Errorf("MatchTopic(%q, %q) = %v, want %v", tt.pattern, tt.topic, got, tt.want)
+		}
+	}
+}
+
+func TestValidatePattern(t *testing.T) {
+	if err := validatePattern("chat.>.lobby"); !errors.Is(err, ErrInvalidTopic) {
+		t.Errorf("expected ErrInvalidTopic, got %v", err)
+	}
+	if err := validatePattern("chat.*.>"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestRedisGlob(t *testing.T) {
+	tests := map[string]string{
+		"*:from-service-to-ws": "*:from-service-to-ws",
+		"chat.rooms.>":         "chat.rooms.*",
+		"odd[name]?.*":         `odd\[name\]\?.*`,
+	}
+
+	for pattern, want := range tests {
+		if got := redisGlob(pattern); got != want {
+			t.Errorf("redisGlob(%q) = %q, want %q", pattern, got, want)
+		}
+	}
+}
@@ -2,45 +2,174 @@ package messagebus
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/go-redis/redis/v8"
 )
 
+const (
+	// retainedKeyPrefix is prepended to topics to form the keys holding
+	// retained messages.
+	retainedKeyPrefix = "messagebus:retained:"
+	// groupsKeyPrefix is prepended to topics to form the set of their groups.
+	groupsKeyPrefix = "messagebus:groups:"
+	// groupKeyPrefix starts the key of a group's queue; its members set
+	// appends ":members".
+	groupKeyPrefix = "messagebus:group:"
+
+	// groupPopTimeout bounds each BLPOP of a group member, and so how long
+	// Unsubscribe waits for it.
+	groupPopTimeout = time.Second
+	// groupMemberTTL is how long a group member stays registered without a
+	// heartbeat from its pop loop, which renews it every third of it.
+	groupMemberTTL = 30 * time.Second
+
+	defaultGroupQueueLen = 10000
+)
+
+// RedisOptions tunes a RedisMessageBus. The zero value is usable.
+type RedisOptions struct {
+	// GroupQueueLen caps the queue of every group (see SubscribeGroup); the
+	// oldest messages are dropped beyond it. Defaults to 10000.
+	GroupQueueLen int64
+}
+
+// publishScript publishes ARGV[2] on topic ARGV[1], pushes it onto the queue
+// of every group of the topic, trimmed to ARGV[6] entries, and, depending on
+// ARGV[4], stores ("set") or clears ("del") it as the retained message.
+// Doing it in one script keeps all three in the same order for every
+// publisher. Members whose registration expired before ARGV[5] (Unix ms)
+// are dropped on the way, and so are groups left without members.
+var publishScript = redis.NewScript(`
+if ARGV[4] == "set" then
+	redis.call("SET", KEYS[2], ARGV[2])
+elseif ARGV[4] == "del" then
+	redis.call("DEL", KEYS[2])
+end
+for _, group in ipairs(redis.call("SMEMBERS", KEYS[1])) do
+	local queue = ARGV[3] .. group
+	local members = queue .. ":members"
+	redis.call("ZREMRANGEBYSCORE", members, "-inf", ARGV[5])
+	if redis.call("ZCARD", members) == 0 then
+		redis.call("SREM", KEYS[1], group)
+		redis.call("DEL", queue)
+	else
+		redis.call("RPUSH", queue, ARGV[2])
+		redis.call("LTRIM", queue, -tonumber(ARGV[6]), -1)
+	end
+end
+return redis.call("PUBLISH", ARGV[1], ARGV[2])
+`)
+
+// leaveGroupScript removes member ARGV[1], and those whose registration
+// expired before ARGV[3] (Unix ms), from the members set KEYS[2] and, once
+// the group is empty, unregisters group ARGV[2] from the topic's groups set
+// KEYS[1] and deletes its queue KEYS[3].
+var leaveGroupScript = redis.NewScript(`
+redis.call("ZREM", KEYS[2], ARGV[1])
+redis.call("ZREMRANGEBYSCORE", KEYS[2], "-inf", ARGV[3])
+if redis.call("ZCARD", KEYS[2]) == 0 then
+	redis.call("SREM", KEYS[1], ARGV[2])
+	redis.call("DEL", KEYS[3])
+end
+return 0
+`)
+
 type RedisMessageBus struct {
 	client        *redis.Client
-	ctx           context.Context
+	opts          RedisOptions
 	mu            sync.RWMutex
-	subscriptions map[chan []byte]*subscription
+	subscriptions map[chan Message]*subscription
+	drops         dropCounts
 }
 
+// subscription is either a pub/sub subscription (pubsub set) or a group
+// member popping from its group's queue (cancel set).
 type subscription struct {
 	pubsub *redis.PubSub
+	cancel context.CancelFunc
 	done   chan struct{}
 }
 
+// stop makes the forwarding goroutine return.
+func (s *subscription) stop() error {
+	if s.pubsub != nil {
+		return s.pubsub.Close()
+	}
+	s.cancel()
+	return nil
+}
+
 func NewRedisMessageBus(options *redis.Options) MessageBus {
+	return NewRedisMessageBusWithOptions(options, RedisOptions{})
+}
+
+// NewRedisMessageBusWithOptions is NewRedisMessageBus tuned by opts.
+func NewRedisMessageBusWithOptions(options *redis.Options, opts RedisOptions) MessageBus {
+	if opts.GroupQueueLen <= 0 {
+		opts.GroupQueueLen = defaultGroupQueueLen
+	}
 	client := redis.NewClient(options)
 	return &RedisMessageBus{
 		client:        client,
-		ctx:           context.Background(),
-		subscriptions: make(map[chan []byte]*subscription),
+		opts:          opts,
+		subscriptions: make(map[chan Message]*subscription),
 	}
 }
 
-func (mb *RedisMessageBus) Subscribe(topic string) chan []byte {
+// Subscribe subscribes to topic. Patterns (see MatchTopic) are mapped onto
+// PSUBSCRIBE. Retained messages of matching topics are delivered before any
+// live message.
+func (mb *RedisMessageBus) Subscribe(ctx context.Context, topic string, opts ...SubscribeOption) (chan Message, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	mb.mu.Lock()
 	defer mb.mu.Unlock()
 
-	ch := make(chan []byte, 256)
-	pubsub := mb.client.Subscribe(mb.ctx, topic)
+	isPattern := IsPattern(topic)
 
-	_, err := pubsub.Receive(mb.ctx)
+	var pubsub *redis.PubSub
+	if isPattern {
+		if err := validatePattern(topic); err != nil {
+			return nil, err
+		}
+		pubsub = mb.client.PSubscribe(ctx, redisGlob(topic))
+	} else {
+		pubsub = mb.client.Subscribe(ctx, topic)
+	}
+
+	// Wait for the subscription confirmation so that a broken connection is
+	// reported to the caller instead of yielding a dead channel.
+	_, err := pubsub.Receive(ctx)
+	if err != nil {
+		pubsub.Close()
+		return nil, fmt.Errorf("%w: topic %s: %w", ErrSubscribeFailed, topic, err)
+	}
+
+	o := newSubscribeOptions(opts)
+	ch := make(chan Message, o.bufferSize)
+
+	// Fetched after the subscription is confirmed so nothing published in
+	// between is missed. A message may then arrive both ways; seen lets the
+	// forwarder skip the live copy.
+	retained, err := mb.retained(ctx, topic)
 	if err != nil {
-		log.Printf("Error subscribing to topic %s: %v", topic, err)
-		close(ch)
-		return ch
+		pubsub.Close()
+		return nil, fmt.Errorf("%w: topic %s: fetching retained messages: %w", ErrSubscribeFailed, topic, err)
+	}
+	seen := make(map[string]string, len(retained))
+	for _, msg := range retained {
+		seen[msg.Topic] = msg.ID
+		if dropped, _ := o.deliver(ctx, ch, msg); dropped {
+			mb.drops.add(msg.Topic)
+		}
 	}
 
 	sub := &subscription{
@@ -57,37 +186,304 @@ func (mb *RedisMessageBus) Subscribe(topic string) chan []byte {
 
 		redisCh := pubsub.Channel()
 		for msg := range redisCh {
-			select {
-			case ch <- []byte(msg.Payload):
-			default:
-				log.Printf("Warning: subscriber channel full, dropping message")
+			// Redis globs are wider than our patterns, filter locally.
+			if isPattern && !MatchTopic(topic, msg.Channel) {
+				continue
+			}
+
+			m := decodeRedisMessage(msg)
+			if id, ok := seen[msg.Channel]; ok && id == m.ID {
+				delete(seen, msg.Channel)
+				continue
+			}
+
+			dropped, disconnect := o.deliver(context.Background(), ch, m)
+			if dropped {
+				mb.drops.add(msg.Channel)
+				log.Printf("Warning: subscriber channel full on topic %s, dropping message (policy %s)", msg.Channel, o.policy)
+			}
+			if disconnect {
+				log.Printf("Disconnecting slow subscriber on topic %s", topic)
+				mb.disconnect(ch)
+				return
 			}
 		}
 	}()
 
-	return ch
+	return ch, nil
 }
 
-func (mb *RedisMessageBus) Unsubscribe(topic string, ch chan []byte) {
+func (mb *RedisMessageBus) Unsubscribe(topic string, ch chan Message) error {
 	mb.mu.Lock()
 	sub, ok := mb.subscriptions[ch]
 	if !ok {
 		mb.mu.Unlock()
-		return
+		return nil
 	}
 	delete(mb.subscriptions, ch)
 	mb.mu.Unlock()
 
-	if err := sub.pubsub.Close(); err != nil {
-		log.Printf("Error closing redis pubsub: %v", err)
-	}
+	err := sub.stop()
 
 	<-sub.done
+
+	if err != nil {
+		return fmt.Errorf("closing redis pubsub for topic %s: %w", topic, err)
+	}
+	return nil
+}
+
+// disconnect drops a subscription from within its forwarding goroutine. The
+// goroutine closes ch itself once it returns.
+func (mb *RedisMessageBus) disconnect(ch chan Message) {
+	mb.mu.Lock()
+	sub, ok := mb.subscriptions[ch]
+	delete(mb.subscriptions, ch)
+	mb.mu.Unlock()
+
+	if ok {
+		sub.stop()
+	}
+}
+
+// Close ends every subscription, leaving the groups they joined, and closes
+// the Redis client.
+func (mb *RedisMessageBus) Close() error {
+	mb.mu.Lock()
+	subs := mb.subscriptions
+	mb.subscriptions = make(map[chan Message]*subscription)
+	mb.mu.Unlock()
+
+	for _, sub := range subs {
+		sub.stop()
+		<-sub.done
+	}
+	return mb.client.Close()
+}
+
+// Dropped returns how many messages received on topic were dropped because
+// a subscriber channel was full.
+func (mb *RedisMessageBus) Dropped(topic string) uint64 {
+	return mb.drops.Dropped(topic)
+}
+
+func (mb *RedisMessageBus) Publish(ctx context.Context, topic string, msg Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if IsPattern(topic) {
+		return fmt.Errorf("%w: cannot publish to pattern %q", ErrInvalidTopic, topic)
+	}
+
+	data, err := Encode(msg.stamp(topic))
+	if err != nil {
+		return fmt.Errorf("%w: topic %s: %w", ErrPublishFailed, topic, err)
+	}
+
+	retain := ""
+	if msg.Retain {
+		retain = "set"
+		if len(msg.Payload) == 0 {
+			retain = "del"
+		}
+	}
+
+	keys := []string{groupsKeyPrefix + topic, retainedKeyPrefix + topic}
+	err = publishScript.Run(ctx, mb.client, keys, topic, data, groupKeyPrefix+topic+":", retain,
+		time.Now().UnixMilli(), mb.opts.GroupQueueLen).Err()
+	if err != nil {
+		return fmt.Errorf("%w: topic %s: %w", ErrPublishFailed, topic, err)
+	}
+	return nil
 }
 
-func (mb *RedisMessageBus) Publish(topic string, msg []byte) {
-	err := mb.client.Publish(mb.ctx, topic, msg).Err()
+// SubscribeGroup joins group on topic. Members pop messages from a queue
+// shared by the group, so a message goes to whichever member asks first and
+// busy members naturally get less; WithBalance is ignored. The group and its
+// queue are removed when its last member unsubscribes. Members renew their
+// registration while they run; those of a process that died without
+// unsubscribing expire after 30s, and the group with them. The queue holds
+// at most RedisOptions.GroupQueueLen messages.
+func (mb *RedisMessageBus) SubscribeGroup(ctx context.Context, topic, group string, opts ...SubscribeOption) (chan Message, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if IsPattern(topic) {
+		return nil, fmt.Errorf("%w: group subscription to pattern %q", ErrNotSupported, topic)
+	}
+	if group == "" {
+		return nil, fmt.Errorf("%w: topic %s: empty group name", ErrSubscribeFailed, topic)
+	}
+
+	queue := groupKeyPrefix + topic + ":" + group
+	members := queue + ":members"
+	member := NewID()
+
+	if err := mb.join(ctx, topic, group, members, member); err != nil {
+		return nil, fmt.Errorf("%w: topic %s: joining group %s: %w", ErrSubscribeFailed, topic, group, err)
+	}
+
+	o := newSubscribeOptions(opts)
+	ch := make(chan Message, o.bufferSize)
+
+	popCtx, cancel := context.WithCancel(context.Background())
+	sub := &subscription{
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+
+	mb.mu.Lock()
+	mb.subscriptions[ch] = sub
+	mb.mu.Unlock()
+
+	go func() {
+		defer func() {
+			keys := []string{groupsKeyPrefix + topic, members, queue}
+			err := leaveGroupScript.Run(context.Background(), mb.client, keys, member, group, time.Now().UnixMilli()).Err()
+			if err != nil {
+				log.Printf("Error leaving group %s on topic %s: %v", group, topic, err)
+			}
+			close(sub.done)
+			close(ch)
+		}()
+
+		heartbeat := func() error {
+			return mb.join(popCtx, topic, group, members, member)
+		}
+		if mb.pop(popCtx, topic, queue, heartbeat, ch, o) {
+			log.Printf("Disconnecting slow group member on topic %s", topic)
+			mb.disconnect(ch)
+		}
+	}()
+
+	return ch, nil
+}
+
+// join registers member of group on topic, or renews its registration, for
+// groupMemberTTL.
+func (mb *RedisMessageBus) join(ctx context.Context, topic, group, members, member string) error {
+	_, err := mb.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.SAdd(ctx, groupsKeyPrefix+topic, group)
+		pipe.ZAdd(ctx, members, &redis.Z{
+			Score:  float64(time.Now().Add(groupMemberTTL).UnixMilli()),
+			Member: member,
+		})
+		return nil
+	})
+	return err
+}
+
+// pop moves messages from a group queue into ch until ctx is cancelled,
+// calling heartbeat to renew the member's registration on the way. It
+// reports whether it stopped because the member was too slow.
+func (mb *RedisMessageBus) pop(ctx context.Context, topic, queue string, heartbeat func() error, ch chan Message, o subscribeOptions) bool {
+	renewed := time.Now()
+	for ctx.Err() == nil {
+		if time.Since(renewed) >= groupMemberTTL/3 {
+			if err := heartbeat(); err != nil && ctx.Err() == nil {
+				log.Printf("Error renewing group membership on topic %s: %v", topic, err)
+			} else {
+				renewed = time.Now()
+			}
+		}
+
+		result, err := mb.client.BLPop(ctx, groupPopTimeout, queue).Result()
+		switch {
+		case errors.Is(err, redis.Nil):
+			continue
+		case err != nil:
+			if ctx.Err() != nil {
+				return false
+			}
+			log.Printf("Error popping group queue for topic %s: %v", topic, err)
+			select {
+			case <-time.After(groupPopTimeout):
+			case <-ctx.Done():
+			}
+			continue
+		}
+
+		data := result[1]
+		if ctx.Err() != nil {
+			// Unsubscribed while blocked: leave it to the other members.
+			mb.client.LPush(context.Background(), queue, data)
+			return false
+		}
+
+		msg, err := Decode([]byte(data))
+		if err != nil {
+			log.Printf("Error decoding group message on topic %s: %v", topic, err)
+			continue
+		}
+
+		dropped, disconnect := o.deliver(ctx, ch, msg)
+		if dropped {
+			mb.drops.add(topic)
+			log.Printf("Warning: group member channel full on topic %s, dropping message (policy %s)", topic, o.policy)
+		}
+		if disconnect {
+			return true
+		}
+	}
+	return false
+}
+
+// retained returns the retained messages of topic, or of every topic
+// matching it when topic is a pattern.
+func (mb *RedisMessageBus) retained(ctx context.Context, topic string) ([]Message, error) {
+	keys := []string{retainedKeyPrefix + topic}
+	if IsPattern(topic) {
+		keys = nil
+		iter := mb.client.Scan(ctx, 0, retainedKeyPrefix+redisGlob(topic), 0).Iterator()
+		for iter.Next(ctx) {
+			if MatchTopic(topic, strings.TrimPrefix(iter.Val(), retainedKeyPrefix)) {
+				keys = append(keys, iter.Val())
+			}
+		}
+		if err := iter.Err(); err != nil {
+			return nil, err
+		}
+		if len(keys) == 0 {
+			return nil, nil
+		}
+	}
+
+	values, err := mb.client.MGet(ctx, keys...).Result()
 	if err != nil {
-		log.Printf("Error publishing message to topic %s: %v", topic, err)
+		return nil, err
+	}
+
+	var msgs []Message
+	for i, value := range values {
+		data, ok := value.(string)
+		if !ok {
+			continue
+		}
+		msg, err := Decode([]byte(data))
+		if err != nil {
+			log.Printf("Error decoding retained message %s: %v", keys[i], err)
+			continue
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, nil
+}
+
+// ClearRetained forgets the retained message of topic.
+func (mb *RedisMessageBus) ClearRetained(ctx context.Context, topic string) error {
+	if err := mb.client.Del(ctx, retainedKeyPrefix+topic).Err(); err != nil {
+		return fmt.Errorf("clearing retained message for topic %s: %w", topic, err)
+	}
+	return nil
+}
+
+// decodeRedisMessage turns a pub/sub payload back into a Message. Payloads
+// that were not published through this package (e.g. from redis-cli) are
+// passed through as raw messages.
+func decodeRedisMessage(msg *redis.Message) Message {
+	m, err := Decode([]byte(msg.Payload))
+	if err != nil || m.ID == "" {
+		return NewMessage([]byte(msg.Payload)).stamp(msg.Channel)
 	}
+	return m
 }
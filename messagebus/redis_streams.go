@@ -0,0 +1,401 @@
+package messagebus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	defaultStreamKeyPrefix    = "messagebus:stream:"
+	defaultStreamBlock        = time.Second
+	defaultStreamClaimMinIdle = 30 * time.Second
+	defaultStreamMaxLen       = 10000
+	streamReadCount           = 100
+
+	// streamMessageField is the stream entry field holding the encoded Message.
+	streamMessageField = "msg"
+)
+
+// RedisStreamsOptions tunes a RedisStreamsMessageBus. The zero value is
+// usable.
+type RedisStreamsOptions struct {
+	// KeyPrefix is prepended to topics to form stream keys.
+	// Defaults to "messagebus:stream:".
+	KeyPrefix string
+	// Consumer identifies this process inside consumer groups. Each
+	// subscription appends a random suffix. Defaults to hostname-pid.
+	Consumer string
+	// MaxLen caps every stream at roughly this many entries (XADD MAXLEN ~).
+	// Defaults to 10000; a negative value keeps everything.
+	MaxLen int64
+	// Block is how long a single XREADGROUP waits for new entries. It also
+	// bounds how long Unsubscribe waits for the reader to stop.
+	// Defaults to 1s.
+	Block time.Duration
+	// ClaimMinIdle is how long an entry must stay unacknowledged before
+	// another consumer of the group reclaims it. Defaults to 30s.
+	ClaimMinIdle time.Duration
+}
+
+// RedisStreamsMessageBus is a MessageBus on top of Redis Streams. Unlike
+// RedisMessageBus, messages are stored in a stream per topic, so a durable
+// subscription (see WithDurableName) that reconnects receives everything
+// published while it was away.
+//
+// Every subscription reads through a consumer group. Subscriptions without a
+// durable name get a private group starting at the stream tail that is
+// destroyed on Unsubscribe, which gives the same fan-out semantics as pub/sub.
+// Entries are acknowledged once they are handed to the subscriber channel;
+// entries the channel had no room for stay pending and are reclaimed after
+// ClaimMinIdle, as are entries left behind by consumers that died.
+type RedisStreamsMessageBus struct {
+	client        *redis.Client
+	opts          RedisStreamsOptions
+	mu            sync.Mutex
+	subscriptions map[chan Message]*streamSubscription
+	drops         dropCounts
+}
+
+type streamSubscription struct {
+	topic    string
+	stream   string
+	group    string
+	consumer string
+	durable  bool
+	cancel   context.CancelFunc
+	done     chan struct{}
+}
+
+func NewRedisStreamsMessageBus(options *redis.Options, streamOptions RedisStreamsOptions) MessageBus {
+	if streamOptions.KeyPrefix == "" {
+		streamOptions.KeyPrefix = defaultStreamKeyPrefix
+	}
+	if streamOptions.Consumer == "" {
+		hostname, _ := os.Hostname()
+		streamOptions.Consumer = fmt.Sprintf("%s-%d", hostname, os.Getpid())
+	}
+	if streamOptions.Block <= 0 {
+		streamOptions.Block = defaultStreamBlock
+	}
+	if streamOptions.ClaimMinIdle <= 0 {
+		streamOptions.ClaimMinIdle = defaultStreamClaimMinIdle
+	}
+	if streamOptions.MaxLen == 0 {
+		streamOptions.MaxLen = defaultStreamMaxLen
+	}
+
+	return &RedisStreamsMessageBus{
+		client:        redis.NewClient(options),
+		opts:          streamOptions,
+		subscriptions: make(map[chan Message]*streamSubscription),
+	}
+}
+
+func (mb *RedisStreamsMessageBus) streamKey(topic string) string {
+	return mb.opts.KeyPrefix + topic
+}
+
+func (mb *RedisStreamsMessageBus) Subscribe(ctx context.Context, topic string, opts ...SubscribeOption) (chan Message, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if IsPattern(topic) {
+		return nil, fmt.Errorf("%w: pattern subscription %q on redis streams", ErrNotSupported, topic)
+	}
+
+	o := newSubscribeOptions(opts)
+	sub := &streamSubscription{
+		topic:    topic,
+		stream:   mb.streamKey(topic),
+		group:    o.durableName,
+		consumer: mb.opts.Consumer + "-" + NewID()[:8],
+		durable:  o.durableName != "",
+		done:     make(chan struct{}),
+	}
+	if !sub.durable {
+		sub.group = "ephemeral-" + NewID()
+	}
+
+	// "$" only delivers entries added from now on. For a durable group this
+	// only applies the first time; afterwards the group keeps its position.
+	err := mb.client.XGroupCreateMkStream(ctx, sub.stream, sub.group, "$").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return nil, fmt.Errorf("%w: topic %s: %w", ErrSubscribeFailed, topic, err)
+	}
+
+	ch := make(chan Message, o.bufferSize)
+
+	readCtx, cancel := context.WithCancel(context.Background())
+	sub.cancel = cancel
+
+	mb.mu.Lock()
+	mb.subscriptions[ch] = sub
+	mb.mu.Unlock()
+
+	go func() {
+		defer func() {
+			close(sub.done)
+			close(ch)
+		}()
+
+		if mb.read(readCtx, sub, ch, o) {
+			log.Printf("Disconnecting slow subscriber on topic %s", topic)
+			mb.mu.Lock()
+			delete(mb.subscriptions, ch)
+			mb.mu.Unlock()
+			mb.cleanup(sub)
+		}
+	}()
+
+	return ch, nil
+}
+
+// SubscribeGroup joins group on topic. It is a durable subscription named
+// group (see WithDurableName): the stream's consumer group already hands each
+// entry to a single consumer, and unlike the other backends the group keeps
+// its position after its last member leaves. WithBalance is ignored.
+func (mb *RedisStreamsMessageBus) SubscribeGroup(ctx context.Context, topic, group string, opts ...SubscribeOption) (chan Message, error) {
+	if group == "" {
+		return nil, fmt.Errorf("%w: topic %s: empty group name", ErrSubscribeFailed, topic)
+	}
+	return mb.Subscribe(ctx, topic, append(opts, WithDurableName(group))...)
+}
+
+// read pumps entries from the stream into ch until ctx is cancelled. It
+// reports whether it stopped because the subscriber was too slow.
+func (mb *RedisStreamsMessageBus) read(ctx context.Context, sub *streamSubscription, ch chan Message, o subscribeOptions) bool {
+	// Reclaim right away so entries left behind by a crashed consumer of a
+	// durable group are not stuck until the first interval elapses.
+	nextClaim := time.Now()
+
+	for ctx.Err() == nil {
+		var entries []redis.XMessage
+
+		if !time.Now().Before(nextClaim) {
+			claimed, err := mb.claim(ctx, sub)
+			if err != nil && ctx.Err() == nil {
+				log.Printf("Error reclaiming pending entries on topic %s: %v", sub.topic, err)
+			}
+			entries = append(entries, claimed...)
+			nextClaim = time.Now().Add(mb.opts.ClaimMinIdle)
+		}
+
+		streams, err := mb.client.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group:    sub.group,
+			Consumer: sub.consumer,
+			Streams:  []string{sub.stream, ">"},
+			Count:    streamReadCount,
+			Block:    mb.opts.Block,
+		}).Result()
+		switch {
+		case err == nil:
+			for _, stream := range streams {
+				entries = append(entries, stream.Messages...)
+			}
+		case errors.Is(err, redis.Nil):
+		case ctx.Err() != nil:
+			return false
+		default:
+			log.Printf("Error reading stream for topic %s: %v", sub.topic, err)
+			select {
+			case <-time.After(mb.opts.Block):
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		for _, entry := range entries {
+			msg, err := decodeStreamEntry(entry)
+			if err != nil {
+				log.Printf("Error decoding stream entry %s on topic %s: %v", entry.ID, sub.topic, err)
+				mb.client.XAck(ctx, sub.stream, sub.group, entry.ID)
+				continue
+			}
+
+			dropped, disconnect := o.deliver(ctx, ch, msg)
+			if dropped {
+				// Left pending on purpose: it is reclaimed after ClaimMinIdle.
+				mb.drops.add(sub.topic)
+				log.Printf("Warning: subscriber channel full on topic %s, leaving entry %s pending (policy %s)", sub.topic, entry.ID, o.policy)
+			} else if err := mb.client.XAck(ctx, sub.stream, sub.group, entry.ID).Err(); err != nil && ctx.Err() == nil {
+				log.Printf("Error acknowledging entry %s on topic %s: %v", entry.ID, sub.topic, err)
+			}
+			if disconnect {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// claim takes over entries of sub's group that have been pending for longer
+// than ClaimMinIdle, e.g. because their consumer died. It uses XPENDING and
+// XCLAIM rather than XAUTOCLAIM to work across Redis versions.
+func (mb *RedisStreamsMessageBus) claim(ctx context.Context, sub *streamSubscription) ([]redis.XMessage, error) {
+	pending, err := mb.client.XPendingExt(ctx, &redis.XPendingExtArgs{
+		Stream: sub.stream,
+		Group:  sub.group,
+		Start:  "-",
+		End:    "+",
+		Count:  streamReadCount,
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	for _, entry := range pending {
+		if entry.Idle >= mb.opts.ClaimMinIdle {
+			ids = append(ids, entry.ID)
+		}
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	// XCLAIM re-checks the idle time, so two consumers racing for the same
+	// entry cannot both win.
+	return mb.client.XClaim(ctx, &redis.XClaimArgs{
+		Stream:   sub.stream,
+		Group:    sub.group,
+		Consumer: sub.consumer,
+		MinIdle:  mb.opts.ClaimMinIdle,
+		Messages: ids,
+	}).Result()
+}
+
+func decodeStreamEntry(entry redis.XMessage) (Message, error) {
+	raw, ok := entry.Values[streamMessageField].(string)
+	if !ok {
+		return Message{}, fmt.Errorf("missing %q field", streamMessageField)
+	}
+	return Decode([]byte(raw))
+}
+
+// streamPublishScript adds an entry with field ARGV[2] set to ARGV[3] to
+// stream KEYS[1], trimmed to about ARGV[1] entries unless that is 0. Streams
+// without groups are left alone: new groups start at the tail, so nobody
+// would ever read the entry, and publishing to e.g. the reply topic of a
+// connection that is gone would otherwise leave a key behind.
+var streamPublishScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 0 or #redis.call("XINFO", "GROUPS", KEYS[1]) == 0 then
+	return false
+end
+if ARGV[1] == "0" then
+	return redis.call("XADD", KEYS[1], "*", ARGV[2], ARGV[3])
+end
+return redis.call("XADD", KEYS[1], "MAXLEN", "~", ARGV[1], "*", ARGV[2], ARGV[3])
+`)
+
+// destroyGroupScript destroys group ARGV[1] of stream KEYS[1] and, once the
+// stream has no groups left, deletes it: new groups start at the tail, so
+// nobody would ever read its entries, and an ephemeral subscription would
+// otherwise leave a key behind per topic.
+var destroyGroupScript = redis.NewScript(`
+redis.call("XGROUP", "DESTROY", KEYS[1], ARGV[1])
+if #redis.call("XINFO", "GROUPS", KEYS[1]) == 0 then
+	redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// cleanup removes the server-side state of a stopped subscription: the whole
+// group, and the stream once no group is left, for ephemeral subscriptions,
+// and the consumer for durable ones when
+// it holds no pending entries (deleting it would lose them).
+func (mb *RedisStreamsMessageBus) cleanup(sub *streamSubscription) error {
+	ctx := context.Background()
+
+	if !sub.durable {
+		return destroyGroupScript.Run(ctx, mb.client, []string{sub.stream}, sub.group).Err()
+	}
+
+	pending, err := mb.client.XPendingExt(ctx, &redis.XPendingExtArgs{
+		Stream:   sub.stream,
+		Group:    sub.group,
+		Start:    "-",
+		End:      "+",
+		Count:    1,
+		Consumer: sub.consumer,
+	}).Result()
+	if err != nil || len(pending) > 0 {
+		return err
+	}
+	return mb.client.XGroupDelConsumer(ctx, sub.stream, sub.group, sub.consumer).Err()
+}
+
+func (mb *RedisStreamsMessageBus) Unsubscribe(topic string, ch chan Message) error {
+	mb.mu.Lock()
+	sub, ok := mb.subscriptions[ch]
+	if !ok {
+		mb.mu.Unlock()
+		return nil
+	}
+	delete(mb.subscriptions, ch)
+	mb.mu.Unlock()
+
+	sub.cancel()
+	<-sub.done
+
+	if err := mb.cleanup(sub); err != nil {
+		return fmt.Errorf("cleaning up stream subscription for topic %s: %w", topic, err)
+	}
+	return nil
+}
+
+// Publish appends msg to the stream of topic. Topics without any
+// subscription, durable or not, are skipped since nobody could read it.
+func (mb *RedisStreamsMessageBus) Publish(ctx context.Context, topic string, msg Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if IsPattern(topic) {
+		return fmt.Errorf("%w: cannot publish to pattern %q", ErrInvalidTopic, topic)
+	}
+
+	data, err := Encode(msg.stamp(topic))
+	if err != nil {
+		return fmt.Errorf("%w: topic %s: %w", ErrPublishFailed, topic, err)
+	}
+
+	err = streamPublishScript.Run(ctx, mb.client, []string{mb.streamKey(topic)},
+		max(mb.opts.MaxLen, 0), streamMessageField, data).Err()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return fmt.Errorf("%w: topic %s: %w", ErrPublishFailed, topic, err)
+	}
+	return nil
+}
+
+// Close ends every subscription, cleaning up their groups and consumers as
+// Unsubscribe does, and closes the Redis client.
+func (mb *RedisStreamsMessageBus) Close() error {
+	mb.mu.Lock()
+	subs := mb.subscriptions
+	mb.subscriptions = make(map[chan Message]*streamSubscription)
+	mb.mu.Unlock()
+
+	var errs []error
+	for _, sub := range subs {
+		sub.cancel()
+		<-sub.done
+		if err := mb.cleanup(sub); err != nil {
+			errs = append(errs, fmt.Errorf("cleaning up stream subscription for topic %s: %w", sub.topic, err))
+		}
+	}
+	errs = append(errs, mb.client.Close())
+	return errors.Join(errs...)
+}
+
+// Dropped returns how many entries on topic could not be handed to a
+// subscriber channel. They stay pending and are redelivered later.
+func (mb *RedisStreamsMessageBus) Dropped(topic string) uint64 {
+	return mb.drops.Dropped(topic)
+}
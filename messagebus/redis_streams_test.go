@@ -0,0 +1,226 @@
+package messagebus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+func newTestStreamsBus(t *testing.T, opts RedisStreamsOptions) (MessageBus, *miniredis.Miniredis) {
+	t.Helper()
+
+	server := miniredis.RunT(t)
+	if opts.Block == 0 {
+		opts.Block = 20 * time.Millisecond
+	}
+	bus := NewRedisStreamsMessageBus(&redis.Options{Addr: server.Addr()}, opts)
+	return bus, server
+}
+
+func TestStreamsPubSub(t *testing.T) {
+	bus, _ := newTestStreamsBus(t, RedisStreamsOptions{})
+	ctx := context.Background()
+
+	ch1, err := bus.Subscribe(ctx, "test-topic")
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	ch2, err := bus.Subscribe(ctx, "test-topic")
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	defer bus.Unsubscribe("test-topic", ch2)
+
+	if err := bus.Publish(ctx, "test-topic", NewMessage([]byte("hello")).WithHeader("X-Trace", "abc")); err != nil {
+		t.Fatalf("Publish failed: %v", err)
+	}
+
+	for i, ch := range []chan Message{ch1, ch2} {
+		msg := receive(t, ch)
+		if string(msg.Payload) != "hello" {
+			t.Errorf("subscriber %d: expected 'hello', got '%s'", i, msg.Payload)
+		}
+		if msg.Header("X-Trace") != "abc" {
+			t.Errorf("subscriber %d: expected header X-Trace 'abc', got '%s'", i, msg.Header("X-Trace"))
+		}
+	}
+
+	if err := bus.Unsubscribe("test-topic", ch1); err != nil {
+		t.Fatalf("Unsubscribe failed: %v", err)
+	}
+	if _, ok := <-ch1; ok {
+		t.Fatal("channel should be closed after unsubscribe")
+	}
+}
+
+func TestStreamsEphemeralSubscriptionsLeaveNoKeys(t *testing.T) {
+	bus, server := newTestStreamsBus(t, RedisStreamsOptions{})
+	ctx := context.Background()
+
+	for i := range 50 {
+		topic := fmt.Sprintf("_inbox:%d", i)
+		ch, err := bus.Subscribe(ctx, topic)
+		if err != nil {
+			t.Fatalf("Subscribe failed: %v", err)
+		}
+		bus.Publish(ctx, topic, NewMessage([]byte("hello")))
+		receive(t, ch)
+		if err := bus.Unsubscribe(topic, ch); err != nil {
+			t.Fatalf("Unsubscribe failed: %v", err)
+		}
+	}
+	// Nor does a late reply to a subscriber that is gone.
+	bus.Publish(ctx, "_inbox:0", NewMessage([]byte("late")))
+	if keys := server.Keys(); len(keys) != 0 {
+		t.Errorf("expected no keys left, got %v", keys)
+	}
+
+	// A stream that still has a group is kept.
+	durable, err := bus.Subscribe(ctx, "orders", WithDurableName("billing"))
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	defer bus.Unsubscribe("orders", durable)
+	ch, err := bus.Subscribe(ctx, "orders")
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	if err := bus.Unsubscribe("orders", ch); err != nil {
+		t.Fatalf("Unsubscribe failed: %v", err)
+	}
+	if !server.Exists("messagebus:stream:orders") {
+		t.Error("expected the stream of the durable subscription to be kept")
+	}
+}
+
+func TestStreamsDurableSubscriptionResumes(t *testing.T) {
+	bus, _ := newTestStreamsBus(t, RedisStreamsOptions{})
+	ctx := context.Background()
+	topic := "orders"
+
+	ch, err := bus.Subscribe(ctx, topic, WithDurableName("billing"))
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	bus.Publish(ctx, topic, NewMessage([]byte("first")))
+	receive(t, ch)
+
+	if err := bus.Unsubscribe(topic, ch); err != nil {
+		t.Fatalf("Unsubscribe failed: %v", err)
+	}
+
+	// Published while nobody is connected.
+	bus.Publish(ctx, topic, NewMessage([]byte("second")))
+	bus.Publish(ctx, topic, NewMessage([]byte("third")))
+
+	ch, err = bus.Subscribe(ctx, topic, WithDurableName("billing"))
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	defer bus.Unsubscribe(topic, ch)
+
+	for _, expected := range []string{"second", "third"} {
+		if msg := receive(t, ch); string(msg.Payload) != expected {
+			t.Errorf("expected '%s', got '%s'", expected, msg.Payload)
+		}
+	}
+}
+
+func TestStreamsReclaimsPendingEntries(t *testing.T) {
+	bus, server := newTestStreamsBus(t, RedisStreamsOptions{ClaimMinIdle: 10 * time.Millisecond})
+	ctx := context.Background()
+	topic := "jobs"
+	stream := defaultStreamKeyPrefix + topic
+
+	// Simulate a consumer that read an entry and died before acknowledging.
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	defer client.Close()
+	if err := client.XGroupCreateMkStream(ctx, stream, "workers", "$").Err(); err != nil {
+		t.Fatalf("XGroupCreateMkStream failed: %v", err)
+	}
+	bus.Publish(ctx, topic, NewMessage([]byte("orphaned")))
+	if err := client.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    "workers",
+		Consumer: "dead",
+		Streams:  []string{stream, ">"},
+	}).Err(); err != nil {
+		t.Fatalf("XReadGroup failed: %v", err)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	ch, err := bus.Subscribe(ctx, topic, WithDurableName("workers"))
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	defer bus.Unsubscribe(topic, ch)
+
+	if msg := receive(t, ch); string(msg.Payload) != "orphaned" {
+		t.Errorf("expected 'orphaned', got '%s'", msg.Payload)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		pending, err := client.XPending(ctx, stream, "workers").Result()
+		if err != nil {
+			t.Fatalf("XPending failed: %v", err)
+		}
+		if pending.Count == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected no pending entries, got %d", pending.Count)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestStreamsMaxLenTrimming(t *testing.T) {
+	bus, server := newTestStreamsBus(t, RedisStreamsOptions{MaxLen: 10})
+	ctx := context.Background()
+
+	ch, err := bus.Subscribe(ctx, "metrics", WithDurableName("archive"))
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	defer bus.Unsubscribe("metrics", ch)
+
+	for i := 0; i < 50; i++ {
+		bus.Publish(ctx, "metrics", NewMessage([]byte(fmt.Sprint(i))))
+	}
+
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	defer client.Close()
+
+	length, err := client.XLen(ctx, defaultStreamKeyPrefix+"metrics").Result()
+	if err != nil {
+		t.Fatalf("XLen failed: %v", err)
+	}
+	if length == 0 || length > 10 {
+		t.Errorf("expected 1 to 10 entries, got %d", length)
+	}
+}
+
+func TestStreamsRejectsPatterns(t *testing.T) {
+	bus, _ := newTestStreamsBus(t, RedisStreamsOptions{})
+
+	_, err := bus.Subscribe(context.Background(), "*:from-service-to-ws")
+	if !errors.Is(err, ErrNotSupported) {
+		t.Fatalf("expected ErrNotSupported, got %v", err)
+	}
+}
+
+func TestStreamsSubscribeFailsWhenRedisIsDown(t *testing.T) {
+	bus, server := newTestStreamsBus(t, RedisStreamsOptions{})
+	server.Close()
+
+	_, err := bus.Subscribe(context.Background(), "test-topic")
+	if !errors.Is(err, ErrSubscribeFailed) {
+		t.Fatalf("expected ErrSubscribeFailed, got %v", err)
+	}
+}
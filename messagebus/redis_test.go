@@ -0,0 +1,101 @@
+package messagebus
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+func newTestRedisBus(t *testing.T) MessageBus {
+	t.Helper()
+
+	server := miniredis.RunT(t)
+	return NewRedisMessageBus(&redis.Options{Addr: server.Addr()})
+}
+
+func receive(t *testing.T, ch chan Message) Message {
+	t.Helper()
+
+	select {
+	case msg, ok := <-ch:
+		if !ok {
+			t.Fatal("channel closed while waiting for message")
+		}
+		return msg
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for message")
+	}
+	return Message{}
+}
+
+func TestRedisPubSubRoundTrip(t *testing.T) {
+	bus := newTestRedisBus(t)
+	ctx := context.Background()
+
+	ch, err := bus.Subscribe(ctx, "echo:from-ws-to-service")
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	defer bus.Unsubscribe("echo:from-ws-to-service", ch)
+
+	msg := NewMessage([]byte("hello")).WithHeader(HeaderConnectionID, "conn-1")
+	if err := bus.Publish(ctx, "echo:from-ws-to-service", msg); err != nil {
+		t.Fatalf("Publish failed: %v", err)
+	}
+
+	got := receive(t, ch)
+	if string(got.Payload) != "hello" {
+		t.Errorf("expected 'hello', got '%s'", got.Payload)
+	}
+	if got.Header(HeaderConnectionID) != "conn-1" {
+		t.Errorf("expected connection ID 'conn-1', got '%s'", got.Header(HeaderConnectionID))
+	}
+	if got.Topic != "echo:from-ws-to-service" {
+		t.Errorf("expected topic 'echo:from-ws-to-service', got '%s'", got.Topic)
+	}
+}
+
+func TestRedisPatternSubscription(t *testing.T) {
+	bus := newTestRedisBus(t)
+	ctx := context.Background()
+	pattern := "*:from-service-to-ws"
+
+	ch, err := bus.Subscribe(ctx, pattern)
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	defer bus.Unsubscribe(pattern, ch)
+
+	// Matched by the Redis glob but not by the pattern.
+	bus.Publish(ctx, "chat.lobby:from-service-to-ws", NewMessage([]byte("ignored")))
+	bus.Publish(ctx, "echo:from-service-to-ws", NewMessage([]byte("echo")))
+
+	if msg := receive(t, ch); string(msg.Payload) != "echo" {
+		t.Errorf("expected 'echo', got '%s'", msg.Payload)
+	}
+
+	select {
+	case msg := <-ch:
+		t.Errorf("received unexpected message: '%s'", msg.Payload)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestRedisRequestReply(t *testing.T) {
+	bus := newTestRedisBus(t)
+	startResponder(t, bus, "upper")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	reply, err := Request(ctx, bus, "upper", []byte("hello"))
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	if string(reply) != "HELLO" {
+		t.Errorf("expected 'HELLO', got '%s'", reply)
+	}
+}
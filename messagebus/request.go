@@ -0,0 +1,79 @@
+package messagebus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// HeaderCorrelationID ties a reply to the request it answers.
+const HeaderCorrelationID = "Correlation-Id"
+
+// DefaultRequestTimeout bounds Request when ctx has no deadline.
+const DefaultRequestTimeout = 5 * time.Second
+
+// inboxPrefix namespaces the one-off reply topics created by Request.
+const inboxPrefix = "_inbox"
+
+// ErrRequestTimeout is returned by Request when no reply arrived in time.
+var ErrRequestTimeout = errors.New("messagebus: request timed out")
+
+// Request publishes payload on topic and waits for a single reply. The
+// request carries a fresh inbox topic in its Reply-To header and a
+// correlation ID; responders answer it with Reply. Request gives up when ctx
+// is done or, if ctx has no deadline, after DefaultRequestTimeout.
+//
+// Request only uses the MessageBus interface, so it works on every backend.
+func Request(ctx context.Context, bus MessageBus, topic string, payload []byte) ([]byte, error) {
+	reply, err := RequestMessage(ctx, bus, topic, NewMessage(payload))
+	if err != nil {
+		return nil, err
+	}
+	return reply.Payload, nil
+}
+
+// RequestMessage is like Request but sends and returns whole messages, so
+// callers can set and inspect headers.
+func RequestMessage(ctx context.Context, bus MessageBus, topic string, msg Message) (Message, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, DefaultRequestTimeout)
+		defer cancel()
+	}
+
+	correlationID := NewID()
+	inbox := inboxPrefix + ":" + correlationID
+
+	// Subscribe before publishing so a fast responder cannot beat us.
+	replies, err := bus.Subscribe(ctx, inbox)
+	if err != nil {
+		return Message{}, err
+	}
+	defer bus.Unsubscribe(inbox, replies)
+
+	msg = msg.
+		WithHeader(HeaderReplyTo, inbox).
+		WithHeader(HeaderCorrelationID, correlationID)
+	if err := bus.Publish(ctx, topic, msg); err != nil {
+		return Message{}, err
+	}
+
+	for {
+		select {
+		case reply, ok := <-replies:
+			if !ok {
+				return Message{}, fmt.Errorf("%w: inbox %s closed", ErrSubscribeFailed, inbox)
+			}
+			if reply.Header(HeaderCorrelationID) != correlationID {
+				continue
+			}
+			return reply, nil
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return Message{}, fmt.Errorf("%w: topic %s: %w", ErrRequestTimeout, topic, ctx.Err())
+			}
+			return Message{}, ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package messagebus
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startResponder answers every request on topic with the upper-cased payload.
+func startResponder(t *testing.T, bus MessageBus, topic string) {
+	t.Helper()
+
+	requests, err := bus.Subscribe(context.Background(), topic)
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	t.Cleanup(func() { bus.Unsubscribe(topic, requests) })
+
+	go func() {
+		for req := range requests {
+			reply := NewMessage([]byte(strings.ToUpper(string(req.Payload))))
+			Reply(context.Background(), bus, req, reply)
+		}
+	}()
+}
+
+func TestRequestReply(t *testing.T) {
+	bus := NewInMemoryMessageBus()
+	startResponder(t, bus, "upper")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	reply, err := Request(ctx, bus, "upper", []byte("hello"))
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	if string(reply) != "HELLO" {
+		t.Errorf("expected 'HELLO', got '%s'", reply)
+	}
+}
+
+func TestConcurrentRequestsGetTheirOwnReplies(t *testing.T) {
+	bus := NewInMemoryMessageBus()
+	startResponder(t, bus, "upper")
+
+	words := []string{"alpha", "beta", "gamma", "delta"}
+	errs := make(chan error, len(words))
+
+	for _, word := range words {
+		go func() {
+			reply, err := Request(context.Background(), bus, "upper", []byte(word))
+			if err == nil && string(reply) != strings.ToUpper(word) {
+				err = errors.New("got reply " + string(reply) + " for " + word)
+			}
+			errs <- err
+		}()
+	}
+
+	for range words {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	bus := NewInMemoryMessageBus()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	_, err := Request(ctx, bus, "nobody-listens", []byte("hello"))
+	if !errors.Is(err, ErrRequestTimeout) {
+		t.Fatalf("expected ErrRequestTimeout, got %v", err)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+}
+
+func TestRequestIgnoresUncorrelatedReplies(t *testing.T) {
+	bus := NewInMemoryMessageBus()
+	ctx := context.Background()
+
+	requests, err := bus.Subscribe(ctx, "svc")
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+
+	go func() {
+		req := <-requests
+		inbox := req.Header(HeaderReplyTo)
+		bus.Publish(ctx, inbox, NewMessage([]byte("stray")).WithHeader(HeaderCorrelationID, "other"))
+		Reply(ctx, bus, req, NewMessage([]byte("real")))
+	}()
+
+	reqCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+
+	reply, err := Request(reqCtx, bus, "svc", []byte("hello"))
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	if string(reply) != "real" {
+		t.Errorf("expected 'real', got '%s'", reply)
+	}
+}
@@ -0,0 +1,120 @@
+package messagebus
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func retainBackends(t *testing.T) map[string]MessageBus {
+	return map[string]MessageBus{
+		"inmemory": NewInMemoryMessageBus(),
+		"redis":    newTestRedisBus(t),
+	}
+}
+
+func expectNoMessage(t *testing.T, ch chan Message) {
+	t.Helper()
+
+	select {
+	case msg := <-ch:
+		t.Fatalf("expected no message, got '%s'", msg.Payload)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestRetainedMessageDeliveredToNewSubscriber(t *testing.T) {
+	for name, bus := range retainBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+
+			retained := NewMessage([]byte("12:00"))
+			retained.Retain = true
+			bus.Publish(ctx, "timenow", retained)
+			bus.Publish(ctx, "timenow", NewMessage([]byte("not retained")))
+
+			ch, err := bus.Subscribe(ctx, "timenow")
+			if err != nil {
+				t.Fatalf("Subscribe failed: %v", err)
+			}
+			defer bus.Unsubscribe("timenow", ch)
+
+			got := receive(t, ch)
+			if string(got.Payload) != "12:00" {
+				t.Errorf("expected retained '12:00', got '%s'", got.Payload)
+			}
+			if got.Retain {
+				t.Error("expected Retain to be cleared on the delivered copy")
+			}
+
+			bus.Publish(ctx, "timenow", NewMessage([]byte("live")))
+			if got := receive(t, ch); string(got.Payload) != "live" {
+				t.Errorf("expected 'live', got '%s'", got.Payload)
+			}
+
+			live := NewMessage([]byte("12:01"))
+			live.Retain = true
+			bus.Publish(ctx, "timenow", live)
+			if got := receive(t, ch); got.Retain {
+				t.Error("expected Retain to be cleared on live copies")
+			}
+		})
+	}
+}
+
+func TestRetainedMessageMatchesPattern(t *testing.T) {
+	for name, bus := range retainBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+
+			for _, topic := range []string{"sensors.kitchen", "sensors.garage", "alerts.kitchen"} {
+				msg := NewMessage([]byte(topic))
+				msg.Retain = true
+				bus.Publish(ctx, topic, msg)
+			}
+
+			ch, err := bus.Subscribe(ctx, "sensors.*")
+			if err != nil {
+				t.Fatalf("Subscribe failed: %v", err)
+			}
+			defer bus.Unsubscribe("sensors.*", ch)
+
+			got := map[string]bool{}
+			for range 2 {
+				got[string(receive(t, ch).Payload)] = true
+			}
+			if !got["sensors.kitchen"] || !got["sensors.garage"] {
+				t.Errorf("expected both sensors, got %v", got)
+			}
+			expectNoMessage(t, ch)
+		})
+	}
+}
+
+func TestClearRetained(t *testing.T) {
+	for name, bus := range retainBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+
+			msg := NewMessage([]byte("stale"))
+			msg.Retain = true
+			bus.Publish(ctx, "a", msg)
+			bus.Publish(ctx, "b", msg)
+
+			if err := bus.(Retainer).ClearRetained(ctx, "a"); err != nil {
+				t.Fatalf("ClearRetained failed: %v", err)
+			}
+			// An empty retained payload clears too.
+			bus.Publish(ctx, "b", Message{Retain: true})
+
+			for _, topic := range []string{"a", "b"} {
+				ch, err := bus.Subscribe(ctx, topic)
+				if err != nil {
+					t.Fatalf("Subscribe failed: %v", err)
+				}
+				expectNoMessage(t, ch)
+				bus.Unsubscribe(topic, ch)
+			}
+		})
+	}
+}
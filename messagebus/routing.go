@@ -0,0 +1,57 @@
+package messagebus
+
+import (
+	"context"
+	"errors"
+	"strings"
+)
+
+// ErrNoReplyTo is returned by Reply when the message it answers carries no
+// Reply-To header.
+var ErrNoReplyTo = errors.New("messagebus: message has no Reply-To header")
+
+// ConnectionTopic returns the topic that reaches only the WebSocket
+// connection connID among the subscribers of topic. Every ws.Client
+// subscribes to it next to the shared topic.
+func ConnectionTopic(topic, connID string) string {
+	return topic + ":_" + connID
+}
+
+// isTransient reports whether topic only matters while someone subscribes
+// to it, which topics with a ':'-separated part starting with '_' declare:
+// connection topics and Request inboxes. Backends that keep a log drop
+// theirs once nobody subscribes anymore.
+func isTransient(topic string) bool {
+	for part := range strings.SplitSeq(topic, ":") {
+		if strings.HasPrefix(part, "_") {
+			return true
+		}
+	}
+	return false
+}
+
+// Reply publishes reply to the sender of msg only. If msg is a Request, the
+// reply carries its correlation ID.
+func Reply(ctx context.Context, bus MessageBus, msg Message, reply Message) error {
+	replyTo := msg.Header(HeaderReplyTo)
+	if replyTo == "" {
+		return ErrNoReplyTo
+	}
+	if correlationID := msg.Header(HeaderCorrelationID); correlationID != "" {
+		reply = reply.WithHeader(HeaderCorrelationID, correlationID)
+	}
+	return bus.Publish(ctx, replyTo, reply)
+}
+
+// PublishToConnections publishes msg to the given connections among the
+// subscribers of topic. It attempts every connection and returns the joined
+// errors of those that failed.
+func PublishToConnections(ctx context.Context, bus MessageBus, topic string, connIDs []string, msg Message) error {
+	var errs []error
+	for _, connID := range connIDs {
+		if err := bus.Publish(ctx, ConnectionTopic(topic, connID), msg); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,54 @@
+package messagebus
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestReplyWithoutReplyTo(t *testing.T) {
+	bus := NewInMemoryMessageBus()
+
+	err := Reply(context.Background(), bus, NewMessage([]byte("hi")), NewMessage([]byte("back")))
+	if !errors.Is(err, ErrNoReplyTo) {
+		t.Fatalf("expected ErrNoReplyTo, got %v", err)
+	}
+}
+
+func TestPublishToConnections(t *testing.T) {
+	bus := NewInMemoryMessageBus()
+	ctx := context.Background()
+	topic := "chat:from-service-to-ws"
+
+	channels := make(map[string]chan Message)
+	for _, id := range []string{"a", "b", "c"} {
+		ch, err := bus.Subscribe(ctx, ConnectionTopic(topic, id))
+		if err != nil {
+			t.Fatalf("Subscribe failed: %v", err)
+		}
+		channels[id] = ch
+	}
+
+	err := PublishToConnections(ctx, bus, topic, []string{"a", "c"}, NewMessage([]byte("hi")))
+	if err != nil {
+		t.Fatalf("PublishToConnections failed: %v", err)
+	}
+
+	for _, id := range []string{"a", "c"} {
+		select {
+		case msg := <-channels[id]:
+			if string(msg.Payload) != "hi" {
+				t.Errorf("connection %s: expected 'hi', got '%s'", id, msg.Payload)
+			}
+		case <-time.After(100 * time.Millisecond):
+			t.Fatalf("connection %s: timeout waiting for message", id)
+		}
+	}
+
+	select {
+	case msg := <-channels["b"]:
+		t.Errorf("connection b received unexpected message: '%s'", msg.Payload)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
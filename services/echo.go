@@ -2,18 +2,35 @@ package services
 
 import (
 	"context"
+	"errors"
 	"log"
 
 	"github.com/samuel1992/ws-server-with-messagebus/messagebus"
 )
 
+// errSubscriptionClosed is returned by services whose subscription was
+// closed by the bus, e.g. because they could not keep up.
+var errSubscriptionClosed = errors.New("subscription closed by the bus")
+
 type EchoService struct {
 	bus        messagebus.MessageBus
 	readTopic  string
 	writeTopic string
 	cancel     context.CancelFunc
+	// prepared is the subscription made by Prepare for the next Run.
+	prepared chan messagebus.Message
 
 	stopped chan struct{}
+	publishHealth
+}
+
+func init() {
+	Register("echo", func(bus messagebus.MessageBus, readTopic, writeTopic string, opts Options) (Service, error) {
+		if err := opts.Allow(); err != nil {
+			return nil, err
+		}
+		return NewEchoService(bus, readTopic, writeTopic), nil
+	})
 }
 
 func NewEchoService(mb messagebus.MessageBus, readTopic, writeTopic string) Service {
@@ -26,33 +43,92 @@ func NewEchoService(mb messagebus.MessageBus, readTopic, writeTopic string) Serv
 }
 
 func (s *EchoService) Start(ctx context.Context) error {
+	subscription, err := s.bus.Subscribe(ctx, s.readTopic)
+	if err != nil {
+		close(s.stopped)
+		return err
+	}
+
 	ctx, cancel := context.WithCancel(ctx)
 	s.cancel = cancel
 
-	subscription := s.bus.Subscribe(s.readTopic)
-
 	// run the service in a go routine
 	go func() {
-		defer func() {
-			s.bus.Unsubscribe(s.readTopic, subscription)
-			close(s.stopped)
-		}()
-
-		for {
-			select {
-			case msg := <-subscription:
-				// publish the same received message to the write topic (echo)
-				s.bus.Publish(s.writeTopic, msg)
-			case <-ctx.Done():
-				log.Println("EchoService stopping")
-				return
-			}
+		defer close(s.stopped)
+		if err := s.serve(ctx, subscription); err != nil {
+			log.Println("EchoService:", err)
 		}
 	}()
 
 	return nil
 }
 
+// Prepare subscribes to the read topic for the next Run, so that messages
+// published once it returns are echoed.
+func (s *EchoService) Prepare(ctx context.Context) error {
+	subscription, err := s.bus.Subscribe(ctx, s.readTopic)
+	if err != nil {
+		return err
+	}
+	s.prepared = subscription
+	return nil
+}
+
+// Run echoes messages until ctx is cancelled, on the subscription made by
+// Prepare or a new one. It fails if the subscription cannot be made or is
+// closed by the bus.
+func (s *EchoService) Run(ctx context.Context) error {
+	subscription := s.prepared
+	s.prepared = nil
+	if subscription == nil {
+		var err error
+		subscription, err = s.bus.Subscribe(ctx, s.readTopic)
+		if err != nil {
+			return err
+		}
+	}
+	return s.serve(ctx, subscription)
+}
+
+func (s *EchoService) serve(ctx context.Context, subscription chan messagebus.Message) error {
+	defer func() {
+		if err := s.bus.Unsubscribe(s.readTopic, subscription); err != nil {
+			log.Println("EchoService unsubscribe:", err)
+		}
+	}()
+
+	for {
+		select {
+		case msg, ok := <-subscription:
+			if !ok {
+				return errSubscriptionClosed
+			}
+			// publish the same received payload to the write topic (echo)
+			reply := messagebus.NewMessage(msg.Payload)
+			if contentType := msg.Header(messagebus.HeaderContentType); contentType != "" {
+				reply = reply.WithHeader(messagebus.HeaderContentType, contentType)
+			}
+			err := s.echo(ctx, msg, reply)
+			if err != nil {
+				log.Println("EchoService publish:", err)
+			}
+			s.record(err)
+		case <-ctx.Done():
+			log.Println("EchoService stopping")
+			return nil
+		}
+	}
+}
+
+// echo answers the sender of msg only. Messages that did not come from a
+// WebSocket connection have nobody to answer and are broadcast instead.
+func (s *EchoService) echo(ctx context.Context, msg, reply messagebus.Message) error {
+	if msg.Header(messagebus.HeaderReplyTo) == "" {
+		return s.bus.Publish(ctx, s.writeTopic, reply)
+	}
+	return messagebus.Reply(ctx, s.bus, msg, reply)
+}
+
 func (s *EchoService) Stop() error {
 	log.Println("Stopping EchoService")
 	if s.cancel != nil {
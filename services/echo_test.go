@@ -3,6 +3,7 @@ package services
 import (
 	"bytes"
 	"context"
+	"errors"
 	"testing"
 	"time"
 
@@ -11,25 +12,28 @@ import (
 
 func TestEchoServiceEcho(t *testing.T) {
 	bus := messagebus.NewInMemoryMessageBus()
+	ctx := context.Background()
 	readTopic := "echo:from-ws"
 	writeTopic := "echo:to-ws"
 
 	service := NewEchoService(bus, readTopic, writeTopic)
-	ctx := context.Background()
 
 	err := service.Start(ctx)
 	if err != nil {
 		t.Fatalf("Start failed: %v", err)
 	}
 
-	outputCh := bus.Subscribe(writeTopic)
+	outputCh, err := bus.Subscribe(ctx, writeTopic)
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
 
-	bus.Publish(readTopic, []byte("hello"))
+	bus.Publish(ctx, readTopic, messagebus.NewMessage([]byte("hello")))
 
 	select {
 	case msg := <-outputCh:
-		if !bytes.Equal(msg, []byte("hello")) {
-			t.Errorf("expected 'hello', got '%s'", msg)
+		if !bytes.Equal(msg.Payload, []byte("hello")) {
+			t.Errorf("expected 'hello', got '%s'", msg.Payload)
 		}
 	case <-time.After(100 * time.Millisecond):
 		t.Fatal("timeout waiting for echo")
@@ -40,25 +44,29 @@ func TestEchoServiceEcho(t *testing.T) {
 
 func TestEchoServiceMultipleMessages(t *testing.T) {
 	bus := messagebus.NewInMemoryMessageBus()
+	ctx := context.Background()
 	readTopic := "echo:from-ws"
 	writeTopic := "echo:to-ws"
 
 	service := NewEchoService(bus, readTopic, writeTopic)
-	service.Start(context.Background())
+	service.Start(ctx)
 
-	outputCh := bus.Subscribe(writeTopic)
+	outputCh, err := bus.Subscribe(ctx, writeTopic)
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
 
 	messages := []string{"msg1", "msg2", "msg3", "msg4", "msg5"}
 
 	for _, msg := range messages {
-		bus.Publish(readTopic, []byte(msg))
+		bus.Publish(ctx, readTopic, messagebus.NewMessage([]byte(msg)))
 	}
 
 	for i, expected := range messages {
 		select {
 		case msg := <-outputCh:
-			if !bytes.Equal(msg, []byte(expected)) {
-				t.Errorf("message %d: expected '%s', got '%s'", i, expected, msg)
+			if !bytes.Equal(msg.Payload, []byte(expected)) {
+				t.Errorf("message %d: expected '%s', got '%s'", i, expected, msg.Payload)
 			}
 		case <-time.After(100 * time.Millisecond):
 			t.Fatalf("message %d: timeout waiting for echo", i)
@@ -70,15 +78,19 @@ func TestEchoServiceMultipleMessages(t *testing.T) {
 
 func TestEchoServiceStop(t *testing.T) {
 	bus := messagebus.NewInMemoryMessageBus()
+	ctx := context.Background()
 	readTopic := "echo:from-ws"
 	writeTopic := "echo:to-ws"
 
 	service := NewEchoService(bus, readTopic, writeTopic)
-	service.Start(context.Background())
+	service.Start(ctx)
 
-	outputCh := bus.Subscribe(writeTopic)
+	outputCh, err := bus.Subscribe(ctx, writeTopic)
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
 
-	bus.Publish(readTopic, []byte("before-stop"))
+	bus.Publish(ctx, readTopic, messagebus.NewMessage([]byte("before-stop")))
 
 	select {
 	case <-outputCh:
@@ -90,28 +102,32 @@ func TestEchoServiceStop(t *testing.T) {
 
 	time.Sleep(50 * time.Millisecond)
 
-	bus.Publish(readTopic, []byte("after-stop"))
+	bus.Publish(ctx, readTopic, messagebus.NewMessage([]byte("after-stop")))
 
 	select {
 	case msg := <-outputCh:
-		t.Errorf("received message after stop: '%s'", msg)
+		t.Errorf("received message after stop: '%s'", msg.Payload)
 	case <-time.After(100 * time.Millisecond):
 	}
 }
 
 func TestEchoServiceContextCancellation(t *testing.T) {
 	bus := messagebus.NewInMemoryMessageBus()
+	ctx := context.Background()
 	readTopic := "echo:from-ws"
 	writeTopic := "echo:to-ws"
 
 	service := NewEchoService(bus, readTopic, writeTopic)
-	ctx, cancel := context.WithCancel(context.Background())
+	serviceCtx, cancel := context.WithCancel(ctx)
 
-	service.Start(ctx)
+	service.Start(serviceCtx)
 
-	outputCh := bus.Subscribe(writeTopic)
+	outputCh, err := bus.Subscribe(ctx, writeTopic)
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
 
-	bus.Publish(readTopic, []byte("test"))
+	bus.Publish(ctx, readTopic, messagebus.NewMessage([]byte("test")))
 
 	select {
 	case <-outputCh:
@@ -123,11 +139,93 @@ func TestEchoServiceContextCancellation(t *testing.T) {
 
 	time.Sleep(50 * time.Millisecond)
 
-	bus.Publish(readTopic, []byte("after-cancel"))
+	bus.Publish(ctx, readTopic, messagebus.NewMessage([]byte("after-cancel")))
 
 	select {
 	case msg := <-outputCh:
-		t.Errorf("received message after context cancel: '%s'", msg)
+		t.Errorf("received message after context cancel: '%s'", msg.Payload)
 	case <-time.After(100 * time.Millisecond):
 	}
 }
+
+type failingBus struct {
+	messagebus.MessageBus
+	err error
+}
+
+func (b *failingBus) Subscribe(ctx context.Context, topic string, opts ...messagebus.SubscribeOption) (chan messagebus.Message, error) {
+	return nil, b.err
+}
+
+func TestEchoServiceStartSurfacesSubscribeError(t *testing.T) {
+	busErr := errors.New("broker unavailable")
+	bus := &failingBus{err: busErr}
+
+	service := NewEchoService(bus, "echo:from-ws", "echo:to-ws")
+
+	err := service.Start(context.Background())
+	if !errors.Is(err, busErr) {
+		t.Fatalf("expected %v, got %v", busErr, err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		service.Stop()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(1 * time.Second):
+		t.Fatal("Stop() blocked after failed Start")
+	}
+}
+
+func TestEchoServiceRepliesOnlyToSender(t *testing.T) {
+	bus := messagebus.NewInMemoryMessageBus()
+	ctx := context.Background()
+	readTopic := "echo:from-ws"
+	writeTopic := "echo:to-ws"
+
+	service := NewEchoService(bus, readTopic, writeTopic)
+	if err := service.Start(ctx); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer service.Stop()
+
+	senderTopic := messagebus.ConnectionTopic(writeTopic, "sender")
+	otherTopic := messagebus.ConnectionTopic(writeTopic, "other")
+
+	senderCh, err := bus.Subscribe(ctx, senderTopic)
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	otherCh, err := bus.Subscribe(ctx, otherTopic)
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	broadcastCh, err := bus.Subscribe(ctx, writeTopic)
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+
+	msg := messagebus.NewMessage([]byte("hello")).WithHeader(messagebus.HeaderReplyTo, senderTopic)
+	bus.Publish(ctx, readTopic, msg)
+
+	select {
+	case msg := <-senderCh:
+		if !bytes.Equal(msg.Payload, []byte("hello")) {
+			t.Errorf("expected 'hello', got '%s'", msg.Payload)
+		}
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("timeout waiting for echo")
+	}
+
+	select {
+	case msg := <-otherCh:
+		t.Errorf("other connection received echo: '%s'", msg.Payload)
+	case msg := <-broadcastCh:
+		t.Errorf("echo was broadcast: '%s'", msg.Payload)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,82 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ErrInvalidOptions is returned (wrapped) when a service's options do not
+// validate.
+var ErrInvalidOptions = errors.New("invalid service options")
+
+// Options are a service's settings as text, as they come from a config file
+// or the query string of a connection.
+type Options map[string]string
+
+// With returns a copy of o with overrides applied.
+func (o Options) With(overrides Options) Options {
+	merged := maps.Clone(o)
+	if merged == nil {
+		merged = make(Options, len(overrides))
+	}
+	maps.Copy(merged, overrides)
+	return merged
+}
+
+// Allow fails if o holds an option not in names, which usually is a typo.
+func (o Options) Allow(names ...string) error {
+	var unknown []string
+	for name := range o {
+		if !slices.Contains(names, name) {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		slices.Sort(unknown)
+		return fmt.Errorf("%w: unknown %s", ErrInvalidOptions, strings.Join(unknown, ", "))
+	}
+	return nil
+}
+
+// String returns option name, or def if it is not set.
+func (o Options) String(name, def string) string {
+	if value, ok := o[name]; ok {
+		return value
+	}
+	return def
+}
+
+// Duration parses option name with time.ParseDuration and checks it is at
+// least minimum. It returns def if the option is not set.
+func (o Options) Duration(name string, def, minimum time.Duration) (time.Duration, error) {
+	value, ok := o[name]
+	if !ok {
+		return def, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s: %q is not a duration", ErrInvalidOptions, name, value)
+	}
+	if d < minimum {
+		return 0, fmt.Errorf("%w: %s: %s is below the minimum of %s", ErrInvalidOptions, name, d, minimum)
+	}
+	return d, nil
+}
+
+// Location loads the IANA time zone named by option name, e.g.
+// "Europe/Berlin". It returns def if the option is not set.
+func (o Options) Location(name string, def *time.Location) (*time.Location, error) {
+	value, ok := o[name]
+	if !ok {
+		return def, nil
+	}
+	loc, err := time.LoadLocation(value)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: unknown time zone %q", ErrInvalidOptions, name, value)
+	}
+	return loc, nil
+}
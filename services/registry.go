@@ -2,8 +2,13 @@ package services
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log"
+	"slices"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/samuel1992/ws-server-with-messagebus/messagebus"
 )
@@ -13,25 +18,327 @@ type Service interface {
 	Stop() error
 }
 
+// Factory creates the service for an endpoint. It is only called when the
+// endpoint has no running service.
+type Factory func() Service
+
 type ServiceEntry struct {
-	service  Service
+	service Service
+	// endpoint is the endpoint the instance belongs to, whose linger applies
+	// to it.
+	endpoint string
+	// refCount is guarded by the registry's mu.
 	refCount int32
-	mu       sync.Mutex
+	// ready is closed once service has started, or failed to with err.
+	ready chan struct{}
+	err   error
+	// stopTimer is the pending stop of an idle entry that is lingering.
+	stopTimer *time.Timer
+	// state and stateErr are the last reported state, guarded by the
+	// registry's mu.
+	state    State
+	stateErr error
 }
 
 type ServiceRegistry struct {
 	bus      messagebus.MessageBus
 	services map[string]*ServiceEntry
-	mu       sync.RWMutex
+	mu       sync.Mutex
+
+	linger        map[string]time.Duration
+	defaultLinger time.Duration
+
+	stateListener func(endpoint string, state State, err error)
 }
 
 func NewServiceRegistry(bus messagebus.MessageBus) *ServiceRegistry {
 	return &ServiceRegistry{
 		bus:      bus,
 		services: make(map[string]*ServiceEntry),
+		linger:   make(map[string]time.Duration),
+	}
+}
+
+// InstanceKey names the instance of endpoint that serves scope key, for
+// endpoints that are not shared by all their connections (e.g. one instance
+// per chat room). The empty key is the shared instance, named endpoint. Keys
+// must not contain '.'.
+func InstanceKey(endpoint, key string) string {
+	if key == "" {
+		return endpoint
+	}
+	return endpoint + "." + key
+}
+
+// SetLinger keeps the service of endpoint running for d after its last
+// reference is released, so that a client reconnecting within d gets the same
+// instance instead of a fresh one. Zero stops it right away. It applies to
+// every instance of endpoint (see AcquireInstance) unless one has its own.
+func (r *ServiceRegistry) SetLinger(endpoint string, d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.linger[endpoint] = d
+}
+
+// ClearLinger drops the linger period set for endpoint, which falls back to
+// the default.
+func (r *ServiceRegistry) ClearLinger(endpoint string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.linger, endpoint)
+}
+
+// SetDefaultLinger sets the linger period of endpoints without their own
+// (see SetLinger). It defaults to zero.
+func (r *ServiceRegistry) SetDefaultLinger(d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.defaultLinger = d
+}
+
+// SetStateListener registers fn to be called on every state transition of
+// every service, e.g. a Supervisor restarting it. Services that do not report
+// their own state are Running once started and Stopped once stopped.
+func (r *ServiceRegistry) SetStateListener(fn func(endpoint string, state State, err error)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.stateListener = fn
+}
+
+// State returns the last reported state of the service of endpoint and the
+// error that caused it. Endpoints without a service are Stopped.
+func (r *ServiceRegistry) State(endpoint string) (State, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entry, exists := r.services[endpoint]
+	if !exists {
+		return Stopped, nil
+	}
+	return entry.state, entry.stateErr
+}
+
+func (r *ServiceRegistry) recordState(endpoint string, entry *ServiceEntry, state State, err error) {
+	r.mu.Lock()
+	entry.state, entry.stateErr = state, err
+	listener := r.stateListener
+	r.mu.Unlock()
+
+	if err != nil {
+		log.Printf("Service %s: %s: %v\n", endpoint, state, err)
+	} else {
+		log.Printf("Service %s: %s\n", endpoint, state)
+	}
+	if listener != nil {
+		listener(endpoint, state, err)
+	}
+}
+
+// lingerFor must be called with mu held.
+func (r *ServiceRegistry) lingerFor(instance string, entry *ServiceEntry) time.Duration {
+	if d, ok := r.linger[instance]; ok {
+		return d
+	}
+	if d, ok := r.linger[entry.endpoint]; ok {
+		return d
+	}
+	return r.defaultLinger
+}
+
+// reference takes a reference on entry, cancelling its pending stop if it
+// was lingering. Must be called with mu held.
+func (r *ServiceRegistry) reference(endpoint string, entry *ServiceEntry) int32 {
+	if entry.stopTimer != nil {
+		entry.stopTimer.Stop()
+		entry.stopTimer = nil
+		log.Printf("Service %s: reacquired while lingering\n", endpoint)
+	}
+	entry.refCount++
+	return entry.refCount
+}
+
+// Acquire returns the service of endpoint, creating it with factory and
+// starting it if there is none, and takes a reference that must be given
+// back with Release. Concurrent callers for the same endpoint share a single
+// creation: they wait for its Start and, if it fails, all get its error and
+// hold no reference.
+func (r *ServiceRegistry) Acquire(endpoint string, factory Factory) (Service, error) {
+	return r.acquire(endpoint, endpoint, factory)
+}
+
+// AcquireInstance is Acquire for the instance of endpoint that serves scope
+// key, registered as InstanceKey(endpoint, key). The instance follows the
+// linger of endpoint and is stopped by StopIdle(endpoint).
+func (r *ServiceRegistry) AcquireInstance(endpoint, key string, factory Factory) (Service, error) {
+	return r.acquire(InstanceKey(endpoint, key), endpoint, factory)
+}
+
+func (r *ServiceRegistry) acquire(endpoint, owner string, factory Factory) (Service, error) {
+	r.mu.Lock()
+	entry, exists := r.services[endpoint]
+	if exists {
+		refCount := r.reference(endpoint, entry)
+		r.mu.Unlock()
+
+		<-entry.ready
+		if entry.err != nil {
+			return nil, entry.err
+		}
+		log.Printf("Service %s: acquired (refCount now %d)\n", endpoint, refCount)
+		return entry.service, nil
+	}
+
+	entry = &ServiceEntry{
+		endpoint: owner,
+		refCount: 1,
+		ready:    make(chan struct{}),
+	}
+	r.services[endpoint] = entry
+	r.mu.Unlock()
+
+	entry.service, entry.err = r.start(endpoint, entry, factory)
+	if entry.err != nil {
+		r.mu.Lock()
+		if r.services[endpoint] == entry {
+			delete(r.services, endpoint)
+		}
+		r.mu.Unlock()
 	}
+	close(entry.ready)
+
+	if entry.err != nil {
+		return nil, entry.err
+	}
+	log.Printf("Service %s: created (refCount now 1)\n", endpoint)
+	return entry.service, nil
 }
 
+// start creates and starts the service of entry. A panic is turned into an
+// error so that callers waiting in Acquire are released.
+func (r *ServiceRegistry) start(endpoint string, entry *ServiceEntry, factory Factory) (service Service, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			service, err = nil, fmt.Errorf("service %s: panic during start: %v", endpoint, p)
+		}
+		if err != nil {
+			r.recordState(endpoint, entry, Failed, err)
+		}
+	}()
+
+	service = factory()
+	reporter, reports := service.(stateReporter)
+	if reports {
+		reporter.setStateListener(func(state State, err error) {
+			r.recordState(endpoint, entry, state, err)
+		})
+	}
+
+	if err := service.Start(context.Background()); err != nil {
+		return nil, fmt.Errorf("service %s: start: %w", endpoint, err)
+	}
+	if !reports {
+		r.recordState(endpoint, entry, Running, nil)
+	}
+	return service, nil
+}
+
+// stop stops the service of entry, which must no longer be registered.
+func (r *ServiceRegistry) stop(endpoint string, entry *ServiceEntry) {
+	_, reports := entry.service.(stateReporter)
+	if !reports {
+		r.recordState(endpoint, entry, Stopping, nil)
+	}
+	entry.service.Stop()
+	if !reports {
+		r.recordState(endpoint, entry, Stopped, nil)
+	}
+}
+
+// ServiceHealth is the outcome of the health check of one service.
+type ServiceHealth struct {
+	Endpoint string
+	State    State
+	// Err is nil when the service is healthy.
+	Err error
+}
+
+// Health checks every registered service concurrently and returns the
+// results sorted by endpoint. A service is unhealthy when it is Degraded,
+// Restarting or Failed, or when it is a HealthChecker whose check fails.
+// Services that are still starting or already stopping are not checked.
+func (r *ServiceRegistry) Health(ctx context.Context) []ServiceHealth {
+	r.mu.Lock()
+	results := make([]ServiceHealth, 0, len(r.services))
+	var services []Service
+	for endpoint, entry := range r.services {
+		result := ServiceHealth{
+			Endpoint: endpoint,
+			State:    entry.state,
+			Err:      entry.stateErr,
+		}
+		var service Service
+		select {
+		case <-entry.ready:
+			service = entry.service
+		default:
+			// entry.service is not set before ready is closed.
+			result.State = Starting
+		}
+		results = append(results, result)
+		services = append(services, service)
+	}
+	r.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for i := range results {
+		result := &results[i]
+		switch result.State {
+		case Running, Degraded:
+		case Restarting, Failed:
+			result.Err = fmt.Errorf("%w: %s: %w", ErrUnhealthy, result.State, result.Err)
+			continue
+		default:
+			result.Err = nil
+			continue
+		}
+
+		checker, ok := services[i].(HealthChecker)
+		if !ok {
+			if result.State == Degraded {
+				result.Err = fmt.Errorf("%w: %s: %w", ErrUnhealthy, result.State, result.Err)
+			}
+			continue
+		}
+		wg.Go(func() {
+			result.Err = checker.Health(ctx)
+		})
+	}
+	wg.Wait()
+
+	slices.SortFunc(results, func(a, b ServiceHealth) int {
+		return strings.Compare(a.Endpoint, b.Endpoint)
+	})
+	return results
+}
+
+// Ready returns nil when every registered service is healthy, and the
+// joined errors of the unhealthy ones otherwise.
+func (r *ServiceRegistry) Ready(ctx context.Context) error {
+	var errs []error
+	for _, result := range r.Health(ctx) {
+		if result.Err != nil {
+			errs = append(errs, fmt.Errorf("service %s: %w", result.Endpoint, result.Err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Add starts service and registers it for endpoint, replacing any existing
+// entry. Prefer Acquire, which does not race with concurrent callers.
 func (r *ServiceRegistry) Add(endpoint string, service Service) error {
 	bgCtx := context.Background()
 	err := service.Start(bgCtx)
@@ -41,8 +348,12 @@ func (r *ServiceRegistry) Add(endpoint string, service Service) error {
 
 	entry := &ServiceEntry{
 		service:  service,
+		endpoint: endpoint,
 		refCount: 1,
+		ready:    make(chan struct{}),
+		state:    Running,
 	}
+	close(entry.ready)
 
 	r.mu.Lock()
 	r.services[endpoint] = entry
@@ -52,60 +363,138 @@ func (r *ServiceRegistry) Add(endpoint string, service Service) error {
 	return nil
 }
 
+// Get returns the service of endpoint, taking a reference on it, or nil if
+// there is none. Prefer Acquire, which also creates missing services.
 func (r *ServiceRegistry) Get(endpoint string) (Service, error) {
-	r.mu.RLock()
+	r.mu.Lock()
 	entry, exists := r.services[endpoint]
-	r.mu.RUnlock()
-
-	if exists {
-		entry.mu.Lock()
-		entry.refCount++
-		refCount := entry.refCount
-		entry.mu.Unlock()
-		log.Printf("Service %s: acquired (refCount now %d)\n", endpoint, refCount)
+	if !exists {
+		r.mu.Unlock()
+		return nil, nil
+	}
+	refCount := r.reference(endpoint, entry)
+	r.mu.Unlock()
 
-		return entry.service, nil
+	<-entry.ready
+	if entry.err != nil {
+		return nil, entry.err
 	}
+	log.Printf("Service %s: acquired (refCount now %d)\n", endpoint, refCount)
 
-	return nil, nil
+	return entry.service, nil
 }
 
 func (r *ServiceRegistry) Release(endpoint string) {
-	r.mu.RLock()
-	entry, exists := r.services[endpoint]
-	r.mu.RUnlock()
+	r.release(endpoint, true)
+}
 
+// Discard gives back a reference like Release, but stops the service right
+// away when it was the last one, without lingering. It suits instances that
+// nobody can reacquire, such as per-connection services.
+func (r *ServiceRegistry) Discard(endpoint string) {
+	r.release(endpoint, false)
+}
+
+func (r *ServiceRegistry) release(endpoint string, linger bool) {
+	r.mu.Lock()
+	entry, exists := r.services[endpoint]
 	if !exists {
+		r.mu.Unlock()
 		log.Printf("Service %s: release called but not found\n", endpoint)
 		return
 	}
 
-	entry.mu.Lock()
+	// Deciding under the registry lock means a concurrent Acquire either
+	// takes its reference first or finds the endpoint empty and creates a
+	// new service; it never gets one that is being stopped.
 	entry.refCount--
 	refCount := entry.refCount
-	entry.mu.Unlock()
+	if refCount <= 0 {
+		if d := r.lingerFor(endpoint, entry); linger && d > 0 {
+			r.scheduleStop(endpoint, entry, d)
+			r.mu.Unlock()
+			log.Printf("Service %s: idle, stopping in %s\n", endpoint, d)
+			return
+		}
+		delete(r.services, endpoint)
+	}
+	r.mu.Unlock()
 
 	if refCount <= 0 {
 		// Last client disconnected
+		r.stop(endpoint, entry)
+		log.Printf("Service %s: stopped (refCount was %d)\n", endpoint, refCount)
+	} else {
+		log.Printf("Service %s: released (refCount now %d)\n", endpoint, refCount)
+	}
+}
+
+// scheduleStop stops the idle entry after d unless it is reacquired first.
+// Must be called with mu held.
+func (r *ServiceRegistry) scheduleStop(endpoint string, entry *ServiceEntry, d time.Duration) {
+	var timer *time.Timer
+	timer = time.AfterFunc(d, func() {
 		r.mu.Lock()
+		// The timer may fire while a reacquire is cancelling it, or after it
+		// was replaced by a later release; only the current one may stop.
+		if r.services[endpoint] != entry || entry.stopTimer != timer {
+			r.mu.Unlock()
+			return
+		}
 		delete(r.services, endpoint)
 		r.mu.Unlock()
 
-		entry.service.Stop()
-		log.Printf("Service %s: stopped (refCount was %d)\n", endpoint, refCount)
-	} else {
-		log.Printf("Service %s: released (refCount now %d)\n", endpoint, refCount)
+		r.stop(endpoint, entry)
+		log.Printf("Service %s: stopped after lingering %s\n", endpoint, d)
+	})
+	entry.stopTimer = timer
+}
+
+// StopIdle stops the instances of endpoint that are lingering without
+// references right away, e.g. because the endpoint was reconfigured and they
+// must not be reacquired. Instances still in use are left alone.
+func (r *ServiceRegistry) StopIdle(endpoint string) {
+	r.mu.Lock()
+	idle := make(map[string]*ServiceEntry)
+	for key, entry := range r.services {
+		if entry.endpoint != endpoint {
+			continue
+		}
+		if entry.refCount > 0 || entry.stopTimer == nil {
+			continue
+		}
+		entry.stopTimer.Stop()
+		entry.stopTimer = nil
+		delete(r.services, key)
+		idle[key] = entry
+	}
+	r.mu.Unlock()
+
+	for key, entry := range idle {
+		r.stop(key, entry)
+		log.Printf("Service %s: stopped while lingering\n", key)
 	}
 }
 
 func (r *ServiceRegistry) StopAll() {
 	r.mu.Lock()
-	defer r.mu.Unlock()
+	services := r.services
+	r.services = make(map[string]*ServiceEntry)
+	for _, entry := range services {
+		if entry.stopTimer != nil {
+			entry.stopTimer.Stop()
+			entry.stopTimer = nil
+		}
+	}
+	r.mu.Unlock()
 
-	for endpoint, entry := range r.services {
-		entry.service.Stop()
+	for endpoint, entry := range services {
+		// Services still starting are stopped once they are up.
+		<-entry.ready
+		if entry.err != nil {
+			continue
+		}
+		r.stop(endpoint, entry)
 		log.Printf("Service %s: stopped during shutdown\n", endpoint)
 	}
-
-	r.services = make(map[string]*ServiceEntry)
 }
@@ -2,6 +2,8 @@ package services
 
 import (
 	"context"
+	"errors"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -158,3 +160,325 @@ func TestRegistryStopAll(t *testing.T) {
 		t.Error("expected all services cleared after StopAll")
 	}
 }
+
+func TestRegistryAcquireCreatesOnce(t *testing.T) {
+	bus := messagebus.NewInMemoryMessageBus()
+	registry := NewServiceRegistry(bus)
+
+	var created int32
+	mock := &mockService{}
+	factory := func() Service {
+		atomic.AddInt32(&created, 1)
+		return mock
+	}
+
+	for range 3 {
+		svc, err := registry.Acquire("test", factory)
+		if err != nil {
+			t.Fatalf("Acquire failed: %v", err)
+		}
+		if svc != mock {
+			t.Error("expected same service instance")
+		}
+	}
+	if created != 1 || mock.started() != 1 {
+		t.Errorf("expected one creation and start, got %d and %d", created, mock.started())
+	}
+
+	registry.Release("test")
+	registry.Release("test")
+	if mock.stopped() != 0 {
+		t.Error("service should not be stopped yet")
+	}
+	registry.Release("test")
+	if mock.stopped() != 1 {
+		t.Errorf("expected Stop called once, got %d", mock.stopped())
+	}
+}
+
+// slowService takes a while to start so that concurrent Acquire calls pile up
+// on the in-flight creation.
+type slowService struct {
+	mockService
+}
+
+func (s *slowService) Start(ctx context.Context) error {
+	time.Sleep(20 * time.Millisecond)
+	return s.mockService.Start(ctx)
+}
+
+func TestRegistryAcquireConcurrent(t *testing.T) {
+	bus := messagebus.NewInMemoryMessageBus()
+	registry := NewServiceRegistry(bus)
+
+	var mu sync.Mutex
+	var created []*slowService
+	factory := func() Service {
+		svc := &slowService{}
+		mu.Lock()
+		created = append(created, svc)
+		mu.Unlock()
+		return svc
+	}
+
+	// Several rounds of connect storms followed by everybody leaving, so
+	// creation also races with the teardown of the previous instance.
+	for range 5 {
+		var wg sync.WaitGroup
+		for range 50 {
+			wg.Go(func() {
+				if _, err := registry.Acquire("test", factory); err != nil {
+					t.Errorf("Acquire failed: %v", err)
+					return
+				}
+				registry.Release("test")
+			})
+		}
+		wg.Wait()
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for i, svc := range created {
+		if svc.started() != 1 || svc.stopped() != 1 {
+			t.Errorf("service %d: expected started and stopped once, got %d/%d", i, svc.started(), svc.stopped())
+		}
+	}
+}
+
+func TestRegistryAcquirePropagatesStartError(t *testing.T) {
+	bus := messagebus.NewInMemoryMessageBus()
+	registry := NewServiceRegistry(bus)
+
+	startErr := errors.New("boom")
+	var created int32
+	factory := func() Service {
+		atomic.AddInt32(&created, 1)
+		return &slowService{mockService{startErr: startErr}}
+	}
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Go(func() {
+			svc, err := registry.Acquire("test", factory)
+			if !errors.Is(err, startErr) {
+				t.Errorf("expected start error, got %v", err)
+			}
+			if svc != nil {
+				t.Error("expected no service on error")
+			}
+		})
+	}
+	wg.Wait()
+
+	if created != 1 {
+		t.Errorf("expected one creation attempt for concurrent callers, got %d", created)
+	}
+
+	// A failed start is not cached: the next caller tries again.
+	mock := &mockService{}
+	svc, err := registry.Acquire("test", func() Service { return mock })
+	if err != nil || svc != mock {
+		t.Errorf("expected a fresh service after a failed start, got %v, %v", svc, err)
+	}
+}
+
+func TestRegistryAcquireRecoversFromPanic(t *testing.T) {
+	bus := messagebus.NewInMemoryMessageBus()
+	registry := NewServiceRegistry(bus)
+
+	_, err := registry.Acquire("test", func() Service { panic("broken factory") })
+	if err == nil {
+		t.Fatal("expected an error from a panicking factory")
+	}
+
+	if svc, _ := registry.Get("test"); svc != nil {
+		t.Error("expected no entry after a failed start")
+	}
+}
+
+func TestRegistryLingerKeepsServiceForReacquire(t *testing.T) {
+	bus := messagebus.NewInMemoryMessageBus()
+	registry := NewServiceRegistry(bus)
+	registry.SetLinger("test", 50*time.Millisecond)
+
+	mock := &mockService{}
+	factory := func() Service { return mock }
+
+	registry.Acquire("test", factory)
+	registry.Release("test")
+
+	time.Sleep(20 * time.Millisecond)
+	svc, err := registry.Acquire("test", func() Service {
+		t.Error("factory called while the service was lingering")
+		return &mockService{}
+	})
+	if err != nil || svc != mock {
+		t.Fatalf("expected the lingering instance, got %v, %v", svc, err)
+	}
+
+	// The pending stop was cancelled by the reacquire.
+	time.Sleep(60 * time.Millisecond)
+	if mock.stopped() != 0 {
+		t.Fatalf("expected lingering stop to be cancelled, got %d stops", mock.stopped())
+	}
+
+	registry.Release("test")
+	time.Sleep(70 * time.Millisecond)
+	if mock.stopped() != 1 {
+		t.Errorf("expected Stop after the linger period, got %d", mock.stopped())
+	}
+	if svc, _ := registry.Get("test"); svc != nil {
+		t.Error("expected the entry to be gone after lingering")
+	}
+}
+
+func TestRegistryDefaultLingerAndOverride(t *testing.T) {
+	bus := messagebus.NewInMemoryMessageBus()
+	registry := NewServiceRegistry(bus)
+	registry.SetDefaultLinger(time.Hour)
+	registry.SetLinger("immediate", 0)
+
+	lingering := &mockService{}
+	immediate := &mockService{}
+	registry.Acquire("lingering", func() Service { return lingering })
+	registry.Acquire("immediate", func() Service { return immediate })
+	registry.Release("lingering")
+	registry.Release("immediate")
+
+	if lingering.stopped() != 0 {
+		t.Error("expected the default linger to keep the service running")
+	}
+	if immediate.stopped() != 1 {
+		t.Errorf("expected immediate stop, got %d", immediate.stopped())
+	}
+
+	// StopAll does not wait for lingering services.
+	registry.StopAll()
+	if lingering.stopped() != 1 {
+		t.Errorf("expected StopAll to stop the lingering service, got %d", lingering.stopped())
+	}
+}
+
+type checkedService struct {
+	mockService
+	healthErr error
+}
+
+func (s *checkedService) Health(ctx context.Context) error {
+	return s.healthErr
+}
+
+func TestRegistryHealthAndReady(t *testing.T) {
+	bus := messagebus.NewInMemoryMessageBus()
+	registry := NewServiceRegistry(bus)
+
+	registry.Acquire("plain", func() Service { return &mockService{} })
+	registry.Acquire("healthy", func() Service { return &checkedService{} })
+	if err := registry.Ready(context.Background()); err != nil {
+		t.Fatalf("expected ready, got %v", err)
+	}
+
+	sick := errors.New("lost connection")
+	registry.Acquire("sick", func() Service { return &checkedService{healthErr: sick} })
+
+	results := registry.Health(context.Background())
+	if len(results) != 3 || results[0].Endpoint != "healthy" || results[2].Endpoint != "sick" {
+		t.Fatalf("expected results sorted by endpoint, got %+v", results)
+	}
+	if results[2].State != Running || !errors.Is(results[2].Err, sick) {
+		t.Errorf("expected sick service to be running with its health error, got %+v", results[2])
+	}
+
+	err := registry.Ready(context.Background())
+	if !errors.Is(err, sick) {
+		t.Errorf("expected Ready to report the sick service, got %v", err)
+	}
+}
+
+func TestRegistryNotReadyWhenSupervisedServiceFails(t *testing.T) {
+	bus := messagebus.NewInMemoryMessageBus()
+	registry := NewServiceRegistry(bus)
+
+	runner := &scriptedRunner{steps: []func() error{fail}}
+	registry.Acquire("test", func() Service {
+		return NewSupervisor("test", runner, fastOptions(Temporary))
+	})
+	defer registry.Release("test")
+
+	waitForState(t, func() State {
+		state, _ := registry.State("test")
+		return state
+	}, Failed)
+
+	if err := registry.Ready(context.Background()); !errors.Is(err, ErrUnhealthy) {
+		t.Errorf("expected ErrUnhealthy, got %v", err)
+	}
+}
+
+func TestRegistryDiscardSkipsLinger(t *testing.T) {
+	bus := messagebus.NewInMemoryMessageBus()
+	registry := NewServiceRegistry(bus)
+	registry.SetDefaultLinger(time.Hour)
+
+	mock := &mockService{}
+	registry.AcquireInstance("session", "abc", func() Service { return mock })
+	registry.Discard(InstanceKey("session", "abc"))
+
+	if mock.stopped() != 1 {
+		t.Errorf("expected Discard to stop right away, got %d stops", mock.stopped())
+	}
+}
+
+func TestRegistryLingerAppliesToInstances(t *testing.T) {
+	bus := messagebus.NewInMemoryMessageBus()
+	registry := NewServiceRegistry(bus)
+	registry.SetLinger("chat", time.Hour)
+
+	mock, named := &mockService{}, &mockService{}
+	key := InstanceKey("chat", "lobby")
+	if key != "chat.lobby" {
+		t.Fatalf("unexpected instance key %q", key)
+	}
+	registry.AcquireInstance("chat", "lobby", func() Service { return mock })
+	registry.Release(key)
+	// A service that merely has a '.' in its name is not an instance.
+	registry.Acquire("chat.bot", func() Service { return named })
+	registry.Release("chat.bot")
+
+	if mock.stopped() != 0 {
+		t.Error("expected the endpoint's linger to cover its instances")
+	}
+	if named.stopped() != 1 {
+		t.Errorf("expected chat.bot to stop without lingering, got %d stops", named.stopped())
+	}
+	registry.StopAll()
+}
+
+func TestRegistryStopIdleStopsLingeringInstances(t *testing.T) {
+	bus := messagebus.NewInMemoryMessageBus()
+	registry := NewServiceRegistry(bus)
+	registry.SetDefaultLinger(time.Hour)
+
+	idle, busy, other, named := &mockService{}, &mockService{}, &mockService{}, &mockService{}
+	registry.AcquireInstance("chat", "lobby", func() Service { return idle })
+	registry.Release("chat.lobby")
+	registry.AcquireInstance("chat", "games", func() Service { return busy })
+	registry.Acquire("chatter", func() Service { return other })
+	registry.Release("chatter")
+	registry.Acquire("chat.bot", func() Service { return named })
+	registry.Release("chat.bot")
+
+	registry.StopIdle("chat")
+
+	if idle.stopped() != 1 {
+		t.Errorf("expected the lingering instance to stop, got %d stops", idle.stopped())
+	}
+	if busy.stopped() != 0 || other.stopped() != 0 || named.stopped() != 0 {
+		t.Error("expected instances in use and other endpoints to be left alone")
+	}
+	if state, _ := registry.State("chat.lobby"); state != Stopped {
+		t.Errorf("expected chat.lobby to be gone, got %s", state)
+	}
+	registry.StopAll()
+}
@@ -0,0 +1,118 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+)
+
+// ErrUnhealthy is returned by health checks of services that are not in a
+// state to do their work.
+var ErrUnhealthy = errors.New("service unhealthy")
+
+// State is where a service is in its lifecycle.
+type State int
+
+const (
+	// Starting services have been created but are not running yet.
+	Starting State = iota
+	// Running services are doing their work.
+	Running
+	// Degraded services are running but failing their health check.
+	Degraded
+	// Restarting services exited unexpectedly and wait for their
+	// supervisor to run them again.
+	Restarting
+	// Stopping services have been asked to stop and are winding down.
+	Stopping
+	// Stopped services exited cleanly or were stopped.
+	Stopped
+	// Failed services exited with an error and will not be restarted.
+	Failed
+)
+
+func (s State) String() string {
+	switch s {
+	case Starting:
+		return "starting"
+	case Running:
+		return "running"
+	case Degraded:
+		return "degraded"
+	case Restarting:
+		return "restarting"
+	case Stopping:
+		return "stopping"
+	case Stopped:
+		return "stopped"
+	case Failed:
+		return "failed"
+	default:
+		return "unknown"
+	}
+}
+
+// MarshalText lets states appear by name in JSON.
+func (s State) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// Runner is a service whose work happens in one blocking call, which lets a
+// Supervisor notice when it exits. Run returns nil once ctx is cancelled, and
+// an error when the service cannot go on. It may be called again after it
+// returns.
+type Runner interface {
+	Run(ctx context.Context) error
+}
+
+// Preparer is implemented by runners that must set things up, such as their
+// bus subscriptions, before they can serve. A Supervisor calls Prepare
+// before every Run, and its Start returns only once the first Prepare has,
+// so that messages published right after Start are not missed. The next
+// Run uses what Prepare set up.
+type Preparer interface {
+	Prepare(ctx context.Context) error
+}
+
+// HealthChecker is implemented by services and runners that can tell
+// whether they are working properly. Health returns nil when they are.
+type HealthChecker interface {
+	Health(ctx context.Context) error
+}
+
+// Lifecycle is the optional extension of Service for services that report
+// where they are in their lifecycle, such as Supervisor.
+type Lifecycle interface {
+	Service
+	HealthChecker
+	State() State
+	// LastError is the error behind the current state, if any.
+	LastError() error
+}
+
+// stateReporter is implemented by services that track their own state, such
+// as Supervisor, so the registry can record their transitions.
+type stateReporter interface {
+	setStateListener(fn func(state State, err error))
+}
+
+// publishHealth makes a service unhealthy while its last publish failed.
+type publishHealth struct {
+	err atomic.Pointer[error]
+}
+
+func (h *publishHealth) record(err error) {
+	if err == nil {
+		h.err.Store(nil)
+	} else {
+		h.err.Store(&err)
+	}
+}
+
+// Health returns the error of the last publish, if it failed.
+func (h *publishHealth) Health(ctx context.Context) error {
+	if err := h.err.Load(); err != nil {
+		return errors.Join(ErrUnhealthy, *err)
+	}
+	return nil
+}
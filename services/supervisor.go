@@ -0,0 +1,353 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrPanic wraps a panic recovered from a supervised service.
+	ErrPanic = errors.New("service panicked")
+	// ErrRestartIntensity is reported when a service restarted more than
+	// MaxRestarts times within Period and its supervisor gave up.
+	ErrRestartIntensity = errors.New("restart intensity exceeded")
+	// ErrExited is reported by a Permanent service whose Run returned nil
+	// although it was not asked to stop.
+	ErrExited = errors.New("service exited")
+)
+
+// RestartStrategy decides which exits of a supervised service lead to a
+// restart.
+type RestartStrategy int
+
+const (
+	// Permanent services are restarted whenever they exit.
+	Permanent RestartStrategy = iota
+	// Transient services are restarted only when they fail, i.e. return an
+	// error or panic.
+	Transient
+	// Temporary services are never restarted.
+	Temporary
+)
+
+func (s RestartStrategy) String() string {
+	switch s {
+	case Permanent:
+		return "permanent"
+	case Transient:
+		return "transient"
+	case Temporary:
+		return "temporary"
+	default:
+		return "unknown"
+	}
+}
+
+const (
+	defaultMinBackoff  = 100 * time.Millisecond
+	defaultMaxBackoff  = 10 * time.Second
+	defaultMaxRestarts = 5
+	defaultPeriod      = time.Minute
+)
+
+// SupervisorOptions configures a Supervisor. The zero value supervises a
+// Permanent service with the defaults below.
+type SupervisorOptions struct {
+	Strategy RestartStrategy
+	// MinBackoff is the delay before the first restart. It doubles with
+	// every consecutive restart up to MaxBackoff, and a random jitter of up
+	// to half the delay is taken off. A run lasting longer than MaxBackoff
+	// resets it. Defaults to 100ms and 10s.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// MaxRestarts is how many restarts are allowed within Period before the
+	// supervisor gives up and the service is Failed. Defaults to 5 per
+	// minute.
+	MaxRestarts int
+	Period      time.Duration
+}
+
+// Supervisor is a Service that runs a Runner and restarts it according to
+// its RestartStrategy, recovering panics raised by Run. Panics in goroutines
+// started by the runner cannot be recovered and still crash the process.
+type Supervisor struct {
+	name   string
+	runner Runner
+	opts   SupervisorOptions
+
+	mu       sync.Mutex
+	state    State
+	err      error
+	listener func(State, error)
+	cancel   context.CancelFunc
+	done     chan struct{}
+}
+
+func NewSupervisor(name string, runner Runner, opts SupervisorOptions) *Supervisor {
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = defaultMinBackoff
+	}
+	if opts.MaxBackoff < opts.MinBackoff {
+		opts.MaxBackoff = max(defaultMaxBackoff, opts.MinBackoff)
+	}
+	if opts.MaxRestarts <= 0 {
+		opts.MaxRestarts = defaultMaxRestarts
+	}
+	if opts.Period <= 0 {
+		opts.Period = defaultPeriod
+	}
+
+	return &Supervisor{
+		name:   name,
+		runner: runner,
+		opts:   opts,
+		state:  Starting,
+	}
+}
+
+// Supervise wraps service in a Supervisor when it is a Runner, and returns it
+// unchanged otherwise.
+func Supervise(name string, service Service, opts SupervisorOptions) Service {
+	runner, ok := service.(Runner)
+	if !ok {
+		return service
+	}
+	return NewSupervisor(name, runner, opts)
+}
+
+// Start runs the supervised service in the background, once a runner that
+// is a Preparer is prepared. It fails when ctx is already cancelled or the
+// first Prepare fails; later failures of the service are handled by
+// restarting it.
+func (s *Supervisor) Start(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+
+	s.mu.Lock()
+	if s.done != nil {
+		s.mu.Unlock()
+		cancel()
+		return fmt.Errorf("supervisor %s: already started", s.name)
+	}
+	s.cancel = cancel
+	s.done = make(chan struct{})
+	s.mu.Unlock()
+
+	if err := s.prepare(ctx); err != nil {
+		cancel()
+		close(s.done)
+		s.setState(Failed, err)
+		return fmt.Errorf("supervisor %s: %w", s.name, err)
+	}
+
+	go s.loop(ctx)
+
+	return nil
+}
+
+// Stop stops the supervised service and waits for it to return.
+func (s *Supervisor) Stop() error {
+	s.mu.Lock()
+	cancel, done := s.cancel, s.done
+	s.mu.Unlock()
+
+	if cancel == nil {
+		return nil
+	}
+	select {
+	case <-done:
+		return nil
+	default:
+	}
+
+	s.setState(Stopping, nil)
+	cancel()
+	<-done
+	// The loop may have ended on its own just before the cancel.
+	s.transition(Stopping, Stopped, nil)
+
+	return nil
+}
+
+// State returns the current state of the supervised service.
+func (s *Supervisor) State() State {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.state
+}
+
+// LastError returns the error behind the current state, if any.
+func (s *Supervisor) LastError() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.err
+}
+
+// Health fails unless the supervised service is running. When the runner is
+// a HealthChecker its check decides, and moves the service between Running
+// and Degraded.
+func (s *Supervisor) Health(ctx context.Context) error {
+	state := s.State()
+	if state != Running && state != Degraded {
+		return fmt.Errorf("%w: %s is %s", ErrUnhealthy, s.name, state)
+	}
+
+	checker, ok := s.runner.(HealthChecker)
+	if !ok {
+		return nil
+	}
+
+	err := checker.Health(ctx)
+	switch {
+	case err != nil && state == Running:
+		s.transition(Running, Degraded, err)
+	case err == nil && state == Degraded:
+		s.transition(Degraded, Running, nil)
+	}
+	return err
+}
+
+func (s *Supervisor) setStateListener(fn func(State, error)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.listener = fn
+}
+
+// transition moves to state unless the state changed from "from" meanwhile,
+// e.g. because the service exited during a health check.
+func (s *Supervisor) transition(from, state State, err error) {
+	s.mu.Lock()
+	if s.state != from {
+		s.mu.Unlock()
+		return
+	}
+	s.state, s.err = state, err
+	listener := s.listener
+	s.mu.Unlock()
+
+	if listener != nil {
+		listener(state, err)
+	}
+}
+
+func (s *Supervisor) setState(state State, err error) {
+	s.mu.Lock()
+	s.state, s.err = state, err
+	listener := s.listener
+	s.mu.Unlock()
+
+	if listener != nil {
+		listener(state, err)
+	}
+}
+
+func (s *Supervisor) loop(ctx context.Context) {
+	defer close(s.done)
+
+	backoff := s.opts.MinBackoff
+	var restarts []time.Time
+
+	// Start prepared the first run.
+	prepared := true
+	for {
+		s.setState(Running, nil)
+		started := time.Now()
+		var err error
+		if !prepared {
+			err = s.prepare(ctx)
+		}
+		if err == nil {
+			err = s.run(ctx)
+		}
+		prepared = false
+
+		if ctx.Err() != nil {
+			s.setState(Stopped, nil)
+			return
+		}
+
+		switch {
+		case err == nil && s.opts.Strategy != Permanent:
+			s.setState(Stopped, nil)
+			return
+		case s.opts.Strategy == Temporary:
+			s.setState(Failed, err)
+			return
+		case err == nil:
+			err = ErrExited
+		}
+
+		now := time.Now()
+		restarts = append(restarts, now)
+		for len(restarts) > 0 && now.Sub(restarts[0]) > s.opts.Period {
+			restarts = restarts[1:]
+		}
+		if len(restarts) > s.opts.MaxRestarts {
+			log.Printf("Supervisor %s: giving up: %v", s.name, err)
+			s.setState(Failed, fmt.Errorf("%w: %d restarts within %s: %w", ErrRestartIntensity, s.opts.MaxRestarts, s.opts.Period, err))
+			return
+		}
+
+		// A run that lasted a while was healthy; start backing off afresh.
+		if time.Since(started) > s.opts.MaxBackoff {
+			backoff = s.opts.MinBackoff
+		}
+		delay := jitter(backoff)
+		backoff = min(2*backoff, s.opts.MaxBackoff)
+
+		log.Printf("Supervisor %s: restarting in %s: %v", s.name, delay, err)
+		s.setState(Restarting, err)
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			s.setState(Stopped, nil)
+			return
+		}
+	}
+}
+
+// prepare calls Prepare if the runner has it, turning a panic into an
+// error.
+func (s *Supervisor) prepare(ctx context.Context) (err error) {
+	preparer, ok := s.runner.(Preparer)
+	if !ok {
+		return nil
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("%w: %v\n%s", ErrPanic, p, debug.Stack())
+		}
+	}()
+
+	return preparer.Prepare(ctx)
+}
+
+// run calls Run once, turning a panic into an error.
+func (s *Supervisor) run(ctx context.Context) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("%w: %v\n%s", ErrPanic, p, debug.Stack())
+		}
+	}()
+
+	return s.runner.Run(ctx)
+}
+
+// jitter returns d minus a random amount of up to half of it, so services
+// failing together do not restart in lockstep.
+func jitter(d time.Duration) time.Duration {
+	return d - rand.N(d/2+1)
+}
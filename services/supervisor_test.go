@@ -0,0 +1,386 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/samuel1992/ws-server-with-messagebus/messagebus"
+)
+
+// scriptedRunner runs the i-th step on the i-th call of Run; once the steps
+// are used up it blocks until cancelled.
+type scriptedRunner struct {
+	mu    sync.Mutex
+	steps []func() error
+	calls int
+}
+
+func (r *scriptedRunner) Run(ctx context.Context) error {
+	r.mu.Lock()
+	call := r.calls
+	r.calls++
+	r.mu.Unlock()
+
+	if call < len(r.steps) {
+		return r.steps[call]()
+	}
+	<-ctx.Done()
+	return nil
+}
+
+func (r *scriptedRunner) runs() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.calls
+}
+
+func fail() error { return errors.New("boom") }
+
+// stateRecorder collects the transitions reported to a state listener.
+type stateRecorder struct {
+	mu     sync.Mutex
+	states []State
+	errs   []error
+}
+
+func (s *stateRecorder) record(state State, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.states = append(s.states, state)
+	s.errs = append(s.errs, err)
+}
+
+func (s *stateRecorder) last() (State, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.states) == 0 {
+		return Starting, nil
+	}
+	return s.states[len(s.states)-1], s.errs[len(s.errs)-1]
+}
+
+func waitForState(t *testing.T, get func() State, want State) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if get() == want {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("timeout waiting for state %s, still %s", want, get())
+}
+
+func fastOptions(strategy RestartStrategy) SupervisorOptions {
+	return SupervisorOptions{
+		Strategy:   strategy,
+		MinBackoff: time.Millisecond,
+		MaxBackoff: 5 * time.Millisecond,
+	}
+}
+
+func TestSupervisorRestartsPermanentService(t *testing.T) {
+	runner := &scriptedRunner{steps: []func() error{
+		fail,
+		func() error { return nil },
+	}}
+	supervisor := NewSupervisor("test", runner, fastOptions(Permanent))
+	recorder := &stateRecorder{}
+	supervisor.setStateListener(recorder.record)
+
+	if err := supervisor.Start(context.Background()); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer supervisor.Stop()
+
+	// Both the failure and the clean exit are restarted.
+	for runner.runs() < 3 {
+		time.Sleep(time.Millisecond)
+	}
+	waitForState(t, supervisor.State, Running)
+
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	want := []State{Running, Restarting, Running, Restarting, Running}
+	if len(recorder.states) != len(want) {
+		t.Fatalf("expected transitions %v, got %v", want, recorder.states)
+	}
+	for i := range want {
+		if recorder.states[i] != want[i] {
+			t.Fatalf("expected transitions %v, got %v", want, recorder.states)
+		}
+	}
+	if !errors.Is(recorder.errs[3], ErrExited) {
+		t.Errorf("expected ErrExited for a clean exit, got %v", recorder.errs[3])
+	}
+}
+
+func TestSupervisorTransientStopsOnCleanExit(t *testing.T) {
+	runner := &scriptedRunner{steps: []func() error{
+		fail,
+		func() error { return nil },
+	}}
+	supervisor := NewSupervisor("test", runner, fastOptions(Transient))
+	supervisor.Start(context.Background())
+	defer supervisor.Stop()
+
+	waitForState(t, supervisor.State, Stopped)
+	if runner.runs() != 2 {
+		t.Errorf("expected a restart after the failure only, got %d runs", runner.runs())
+	}
+}
+
+func TestSupervisorTemporaryNeverRestarts(t *testing.T) {
+	runner := &scriptedRunner{steps: []func() error{fail}}
+	supervisor := NewSupervisor("test", runner, fastOptions(Temporary))
+	supervisor.Start(context.Background())
+	defer supervisor.Stop()
+
+	waitForState(t, supervisor.State, Failed)
+	if supervisor.LastError() == nil {
+		t.Error("expected the run error to be reported")
+	}
+	if runner.runs() != 1 {
+		t.Errorf("expected a single run, got %d", runner.runs())
+	}
+}
+
+func TestSupervisorRecoversPanic(t *testing.T) {
+	runner := &scriptedRunner{steps: []func() error{
+		func() error { panic("kaboom") },
+	}}
+	supervisor := NewSupervisor("test", runner, fastOptions(Transient))
+	recorder := &stateRecorder{}
+	supervisor.setStateListener(recorder.record)
+	supervisor.Start(context.Background())
+	defer supervisor.Stop()
+
+	for runner.runs() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	waitForState(t, supervisor.State, Running)
+
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	if len(recorder.errs) < 2 || !errors.Is(recorder.errs[1], ErrPanic) {
+		t.Errorf("expected a Restarting transition caused by ErrPanic, got %v", recorder.errs)
+	}
+}
+
+func TestSupervisorRestartIntensity(t *testing.T) {
+	runner := &scriptedRunner{}
+	for range 10 {
+		runner.steps = append(runner.steps, fail)
+	}
+	opts := fastOptions(Permanent)
+	opts.MaxRestarts = 3
+	supervisor := NewSupervisor("test", runner, opts)
+	supervisor.Start(context.Background())
+	defer supervisor.Stop()
+
+	waitForState(t, supervisor.State, Failed)
+	if err := supervisor.LastError(); !errors.Is(err, ErrRestartIntensity) {
+		t.Errorf("expected ErrRestartIntensity, got %v", err)
+	}
+	if runner.runs() != 4 {
+		t.Errorf("expected the first run plus 3 restarts, got %d runs", runner.runs())
+	}
+}
+
+func TestSupervisorStop(t *testing.T) {
+	runner := &scriptedRunner{}
+	supervisor := NewSupervisor("test", runner, fastOptions(Permanent))
+	supervisor.Start(context.Background())
+	waitForState(t, supervisor.State, Running)
+
+	supervisor.Stop()
+
+	if state := supervisor.State(); state != Stopped {
+		t.Errorf("expected stopped after Stop, got %s", state)
+	}
+	if runner.runs() != 1 {
+		t.Errorf("expected no restart after Stop, got %d runs", runner.runs())
+	}
+}
+
+func TestJitter(t *testing.T) {
+	for range 100 {
+		if d := jitter(time.Second); d < time.Second/2 || d > time.Second {
+			t.Fatalf("jitter out of range: %s", d)
+		}
+	}
+}
+
+func TestRegistryRecordsSupervisorStates(t *testing.T) {
+	bus := messagebus.NewInMemoryMessageBus()
+	registry := NewServiceRegistry(bus)
+
+	recorder := &stateRecorder{}
+	registry.SetStateListener(func(endpoint string, state State, err error) {
+		if endpoint == "test" {
+			recorder.record(state, err)
+		}
+	})
+
+	runner := &scriptedRunner{steps: []func() error{fail}}
+	_, err := registry.Acquire("test", func() Service {
+		return NewSupervisor("test", runner, fastOptions(Permanent))
+	})
+	if err != nil {
+		t.Fatalf("Acquire failed: %v", err)
+	}
+
+	for runner.runs() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	waitForState(t, func() State {
+		state, _ := registry.State("test")
+		return state
+	}, Running)
+
+	registry.Release("test")
+	if state, _ := recorder.last(); state != Stopped {
+		t.Errorf("expected the listener to see the final stop, got %s", state)
+	}
+	if state, _ := registry.State("test"); state != Stopped {
+		t.Errorf("expected released endpoint to be stopped, got %s", state)
+	}
+}
+
+type checkedRunner struct {
+	scriptedRunner
+	mu        sync.Mutex
+	healthErr error
+}
+
+func (r *checkedRunner) Health(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.healthErr
+}
+
+func TestSupervisorHealthDegrades(t *testing.T) {
+	runner := &checkedRunner{}
+	supervisor := NewSupervisor("test", runner, fastOptions(Permanent))
+	supervisor.Start(context.Background())
+	defer supervisor.Stop()
+	waitForState(t, supervisor.State, Running)
+
+	if err := supervisor.Health(context.Background()); err != nil {
+		t.Fatalf("expected healthy, got %v", err)
+	}
+
+	runner.mu.Lock()
+	runner.healthErr = errors.New("backend down")
+	runner.mu.Unlock()
+
+	if err := supervisor.Health(context.Background()); err == nil {
+		t.Fatal("expected the runner's health error")
+	}
+	if supervisor.State() != Degraded {
+		t.Errorf("expected degraded, got %s", supervisor.State())
+	}
+
+	runner.mu.Lock()
+	runner.healthErr = nil
+	runner.mu.Unlock()
+
+	supervisor.Health(context.Background())
+	if supervisor.State() != Running {
+		t.Errorf("expected running again, got %s", supervisor.State())
+	}
+}
+
+func TestSupervisorUnhealthyWhileRestarting(t *testing.T) {
+	runner := &scriptedRunner{steps: []func() error{fail}}
+	opts := fastOptions(Permanent)
+	opts.MinBackoff = time.Hour
+	opts.MaxBackoff = time.Hour
+	supervisor := NewSupervisor("test", runner, opts)
+	supervisor.Start(context.Background())
+	defer supervisor.Stop()
+
+	waitForState(t, supervisor.State, Restarting)
+	if err := supervisor.Health(context.Background()); !errors.Is(err, ErrUnhealthy) {
+		t.Errorf("expected ErrUnhealthy, got %v", err)
+	}
+}
+
+func TestSupervisedEchoIsReadyOnStart(t *testing.T) {
+	bus := messagebus.NewInMemoryMessageBus()
+	ctx := context.Background()
+
+	for i := range 50 {
+		echo := Supervise("echo", NewEchoService(bus, "echo:in", "echo:out"), SupervisorOptions{})
+		out, _ := bus.Subscribe(ctx, "echo:out")
+		if err := echo.Start(ctx); err != nil {
+			t.Fatalf("Start failed: %v", err)
+		}
+		bus.Publish(ctx, "echo:in", messagebus.NewMessage([]byte("first")))
+
+		select {
+		case <-out:
+		case <-time.After(time.Second):
+			t.Fatalf("run %d: the message published right after Start was lost", i)
+		}
+		echo.Stop()
+		bus.Unsubscribe("echo:out", out)
+	}
+}
+
+// preparedRunner fails to prepare on the calls listed in failures.
+type preparedRunner struct {
+	scriptedRunner
+	prepares int
+	failures map[int]bool
+}
+
+func (r *preparedRunner) Prepare(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	call := r.prepares
+	r.prepares++
+	if r.failures[call] {
+		return fail()
+	}
+	return nil
+}
+
+func TestSupervisorPrepares(t *testing.T) {
+	runner := &preparedRunner{failures: map[int]bool{0: true}}
+	supervisor := NewSupervisor("prepared", runner, fastOptions(Permanent))
+	if err := supervisor.Start(context.Background()); err == nil {
+		t.Fatal("expected Start to fail when the first Prepare does")
+	}
+	if supervisor.State() != Failed || runner.runs() != 0 {
+		t.Errorf("expected a failed service that never ran, got %s after %d runs", supervisor.State(), runner.runs())
+	}
+
+	// A failed Prepare on restart counts as a failed run.
+	runner = &preparedRunner{scriptedRunner: scriptedRunner{steps: []func() error{fail}}, failures: map[int]bool{1: true}}
+	supervisor = NewSupervisor("prepared", runner, fastOptions(Permanent))
+	if err := supervisor.Start(context.Background()); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer supervisor.Stop()
+	waitForState(t, supervisor.State, Running)
+	deadline := time.Now().Add(time.Second)
+	for runner.runs() < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	runner.mu.Lock()
+	prepares := runner.prepares
+	runner.mu.Unlock()
+	if runner.runs() != 2 || prepares != 3 {
+		t.Errorf("expected 3 prepares for 2 runs, got %d for %d", prepares, runner.runs())
+	}
+}
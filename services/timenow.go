@@ -2,56 +2,167 @@ package services
 
 import (
 	"context"
+	"fmt"
 	"log"
+	"strconv"
 	"time"
 
 	"github.com/samuel1992/ws-server-with-messagebus/messagebus"
 )
 
+// TimeNowOptions configure a TimeNowService.
+type TimeNowOptions struct {
+	// Interval between two publications. Defaults to 2s.
+	Interval time.Duration
+	// Location is the time zone of the published time. Defaults to the
+	// server's.
+	Location *time.Location
+	// Format is a time.Format layout, or "unix" or "unixmilli" for an epoch
+	// timestamp. Defaults to time.RFC3339.
+	Format string
+}
+
+// timeFormats are the layouts TimeNowOptions accept by name.
+var timeFormats = map[string]string{
+	"rfc3339":     time.RFC3339,
+	"rfc3339nano": time.RFC3339Nano,
+	"rfc1123":     time.RFC1123,
+	"kitchen":     time.Kitchen,
+	"datetime":    time.DateTime,
+}
+
+// ParseTimeNowOptions validates opts: "interval" (a duration of at least
+// 100ms), "timezone" (an IANA name such as "Europe/Berlin") and "format"
+// ("rfc3339", "rfc3339nano", "rfc1123", "kitchen", "datetime", "unix",
+// "unixmilli" or a Go layout).
+func ParseTimeNowOptions(opts Options) (TimeNowOptions, error) {
+	if err := opts.Allow("interval", "timezone", "format"); err != nil {
+		return TimeNowOptions{}, err
+	}
+
+	interval, err := opts.Duration("interval", 2*time.Second, 100*time.Millisecond)
+	if err != nil {
+		return TimeNowOptions{}, err
+	}
+	location, err := opts.Location("timezone", time.Local)
+	if err != nil {
+		return TimeNowOptions{}, err
+	}
+	format := opts.String("format", "rfc3339")
+	if layout, ok := timeFormats[format]; ok {
+		format = layout
+	}
+	if format == "" {
+		return TimeNowOptions{}, fmt.Errorf("%w: format: empty layout", ErrInvalidOptions)
+	}
+
+	return TimeNowOptions{Interval: interval, Location: location, Format: format}, nil
+}
+
 type TimeNowService struct {
 	bus        messagebus.MessageBus
 	readTopic  string
 	writeTopic string
+	opts       TimeNowOptions
 	cancel     context.CancelFunc
 
 	stopped chan struct{}
+	publishHealth
+}
+
+func init() {
+	Register("timenow", func(bus messagebus.MessageBus, readTopic, writeTopic string, opts Options) (Service, error) {
+		timeNowOpts, err := ParseTimeNowOptions(opts)
+		if err != nil {
+			return nil, err
+		}
+		return NewTimeNowServiceWithOptions(bus, readTopic, writeTopic, timeNowOpts), nil
+	})
 }
 
 func NewTimeNowService(mb messagebus.MessageBus, readTopic, writeTopic string) Service {
+	opts, _ := ParseTimeNowOptions(nil)
+	return NewTimeNowServiceWithOptions(mb, readTopic, writeTopic, opts)
+}
+
+// NewTimeNowServiceWithOptions creates a TimeNowService configured by opts,
+// as returned by ParseTimeNowOptions.
+func NewTimeNowServiceWithOptions(mb messagebus.MessageBus, readTopic, writeTopic string, opts TimeNowOptions) Service {
 	return &TimeNowService{
 		bus:        mb,
 		readTopic:  readTopic,
 		writeTopic: writeTopic,
+		opts:       opts,
 		stopped:    make(chan struct{}),
 	}
 }
 
+// format renders t as configured.
+func (s *TimeNowService) format(t time.Time) string {
+	switch s.opts.Format {
+	case "unix":
+		return strconv.FormatInt(t.Unix(), 10)
+	case "unixmilli":
+		return strconv.FormatInt(t.UnixMilli(), 10)
+	default:
+		return t.In(s.opts.Location).Format(s.opts.Format)
+	}
+}
+
 func (s *TimeNowService) Start(c context.Context) error {
 	ctx, cancel := context.WithCancel(c)
 	s.cancel = cancel
 
-	ticker := time.NewTicker(2 * time.Second)
-
 	go func() {
+		defer close(s.stopped)
+		s.Run(ctx)
+	}()
+
+	return nil
+}
 
-		defer func() {
-			close(s.stopped)
-		}()
-
-		for {
-			select {
-			case <-ticker.C:
-				datetime := time.Now().Format(time.RFC3339)
-				s.bus.Publish(s.writeTopic, []byte(datetime))
-			case <-ctx.Done():
-				log.Println("TimeNowService stopping")
-				return
+// Run publishes the time right away and then every interval until ctx is
+// cancelled.
+func (s *TimeNowService) Run(ctx context.Context) error {
+	ticker := time.NewTicker(s.opts.Interval)
+
+	defer func() {
+		ticker.Stop()
+		// Do not hand a stale time to whoever subscribes next.
+		if retainer, ok := s.bus.(messagebus.Retainer); ok {
+			if err := retainer.ClearRetained(context.Background(), s.writeTopic); err != nil {
+				log.Println("TimeNowService clear retained:", err)
 			}
 		}
-
 	}()
 
-	return nil
+	// The first clients, which create the instance, would otherwise see
+	// nothing for a whole interval.
+	s.tick(ctx)
+	for {
+		select {
+		case <-ticker.C:
+			s.tick(ctx)
+		case <-ctx.Done():
+			log.Println("TimeNowService stopping")
+			return nil
+		}
+	}
+}
+
+// tick publishes the current time.
+func (s *TimeNowService) tick(ctx context.Context) {
+	datetime := s.format(time.Now())
+	msg := messagebus.NewMessage([]byte(datetime)).
+		WithHeader(messagebus.HeaderContentType, messagebus.ContentTypeText)
+	// Retained so clients that connect between ticks get the current time
+	// right away.
+	msg.Retain = true
+	err := s.bus.Publish(ctx, s.writeTopic, msg)
+	if err != nil {
+		log.Println("TimeNowService publish:", err)
+	}
+	s.record(err)
 }
 
 func (s *TimeNowService) Stop() error {
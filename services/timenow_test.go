@@ -2,6 +2,8 @@ package services
 
 import (
 	"context"
+	"errors"
+	"strconv"
 	"testing"
 	"time"
 
@@ -10,17 +12,21 @@ import (
 
 func TestTimeNowServicePublishesTime(t *testing.T) {
 	bus := messagebus.NewInMemoryMessageBus()
+	ctx := context.Background()
 	readTopic := "time:from-ws"
 	writeTopic := "time:to-ws"
 
 	service := NewTimeNowService(bus, readTopic, writeTopic)
-	service.Start(context.Background())
+	service.Start(ctx)
 
-	outputCh := bus.Subscribe(writeTopic)
+	outputCh, err := bus.Subscribe(ctx, writeTopic)
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
 
 	select {
 	case msg := <-outputCh:
-		_, err := time.Parse(time.RFC3339, string(msg))
+		_, err := time.Parse(time.RFC3339, string(msg.Payload))
 		if err != nil {
 			t.Errorf("invalid RFC3339 format: %v", err)
 		}
@@ -33,18 +39,22 @@ func TestTimeNowServicePublishesTime(t *testing.T) {
 
 func TestTimeNowServiceMultiplePublishes(t *testing.T) {
 	bus := messagebus.NewInMemoryMessageBus()
+	ctx := context.Background()
 	readTopic := "time:from-ws"
 	writeTopic := "time:to-ws"
 
 	service := NewTimeNowService(bus, readTopic, writeTopic)
-	service.Start(context.Background())
+	service.Start(ctx)
 
-	outputCh := bus.Subscribe(writeTopic)
+	outputCh, err := bus.Subscribe(ctx, writeTopic)
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
 
 	for i := 0; i < 3; i++ {
 		select {
 		case msg := <-outputCh:
-			parsed, err := time.Parse(time.RFC3339, string(msg))
+			parsed, err := time.Parse(time.RFC3339, string(msg.Payload))
 			if err != nil {
 				t.Errorf("message %d: invalid RFC3339 format: %v", i, err)
 			}
@@ -61,13 +71,17 @@ func TestTimeNowServiceMultiplePublishes(t *testing.T) {
 
 func TestTimeNowServiceStop(t *testing.T) {
 	bus := messagebus.NewInMemoryMessageBus()
+	ctx := context.Background()
 	readTopic := "time:from-ws"
 	writeTopic := "time:to-ws"
 
 	service := NewTimeNowService(bus, readTopic, writeTopic)
-	service.Start(context.Background())
+	service.Start(ctx)
 
-	outputCh := bus.Subscribe(writeTopic)
+	outputCh, err := bus.Subscribe(ctx, writeTopic)
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
 
 	select {
 	case <-outputCh:
@@ -92,15 +106,19 @@ func TestTimeNowServiceStop(t *testing.T) {
 
 func TestTimeNowServiceContextCancellation(t *testing.T) {
 	bus := messagebus.NewInMemoryMessageBus()
+	ctx := context.Background()
 	readTopic := "time:from-ws"
 	writeTopic := "time:to-ws"
 
 	service := NewTimeNowService(bus, readTopic, writeTopic)
-	ctx, cancel := context.WithCancel(context.Background())
+	serviceCtx, cancel := context.WithCancel(ctx)
 
-	service.Start(ctx)
+	service.Start(serviceCtx)
 
-	outputCh := bus.Subscribe(writeTopic)
+	outputCh, err := bus.Subscribe(ctx, writeTopic)
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
 
 	select {
 	case <-outputCh:
@@ -143,3 +161,99 @@ func TestTimeNowServiceStopBlocks(t *testing.T) {
 		t.Fatal("Stop() did not complete in time")
 	}
 }
+
+func TestTimeNowServiceRetainsLastTime(t *testing.T) {
+	bus := messagebus.NewInMemoryMessageBus()
+	ctx := context.Background()
+	writeTopic := "time:to-ws"
+
+	// A subscriber from before the service starts gets the time without
+	// waiting for the first interval.
+	early, err := bus.Subscribe(ctx, writeTopic)
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	service := NewTimeNowService(bus, "time:from-ws", writeTopic)
+	service.Start(ctx)
+	select {
+	case <-early:
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("expected the time as soon as the service starts")
+	}
+	bus.Unsubscribe(writeTopic, early)
+
+	// A later one gets the retained time without waiting for the next tick.
+	outputCh, err := bus.Subscribe(ctx, writeTopic)
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	select {
+	case <-outputCh:
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("expected the retained time immediately")
+	}
+	bus.Unsubscribe(writeTopic, outputCh)
+
+	service.Stop()
+
+	outputCh, _ = bus.Subscribe(ctx, writeTopic)
+	defer bus.Unsubscribe(writeTopic, outputCh)
+	select {
+	case msg := <-outputCh:
+		t.Errorf("expected retained time to be cleared on Stop, got '%s'", msg.Payload)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestParseTimeNowOptions(t *testing.T) {
+	opts, err := ParseTimeNowOptions(Options{"interval": "500ms", "timezone": "America/New_York", "format": "kitchen"})
+	if err != nil {
+		t.Fatalf("ParseTimeNowOptions failed: %v", err)
+	}
+	if opts.Interval != 500*time.Millisecond || opts.Location.String() != "America/New_York" || opts.Format != time.Kitchen {
+		t.Errorf("unexpected options %+v", opts)
+	}
+
+	for _, invalid := range []Options{
+		{"interval": "fast"},
+		{"interval": "10ms"},
+		{"timezone": "Nowhere/Special"},
+		{"format": ""},
+		{"intreval": "1s"},
+	} {
+		if _, err := ParseTimeNowOptions(invalid); !errors.Is(err, ErrInvalidOptions) {
+			t.Errorf("%v: expected ErrInvalidOptions, got %v", invalid, err)
+		}
+	}
+}
+
+func TestTimeNowServiceWithOptions(t *testing.T) {
+	bus := messagebus.NewInMemoryMessageBus()
+	ctx := context.Background()
+	writeTopic := "time:to-ws"
+
+	opts, err := ParseTimeNowOptions(Options{"interval": "100ms", "format": "unixmilli"})
+	if err != nil {
+		t.Fatalf("ParseTimeNowOptions failed: %v", err)
+	}
+	outputCh, err := bus.Subscribe(ctx, writeTopic)
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	service := NewTimeNowServiceWithOptions(bus, "time:from-ws", writeTopic, opts)
+	service.Start(ctx)
+	defer service.Stop()
+
+	select {
+	case msg := <-outputCh:
+		millis, err := strconv.ParseInt(string(msg.Payload), 10, 64)
+		if err != nil {
+			t.Fatalf("expected a unix timestamp, got '%s'", msg.Payload)
+		}
+		if time.Since(time.UnixMilli(millis)) > time.Second {
+			t.Errorf("timestamp too old: %d", millis)
+		}
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("expected a message after the configured interval")
+	}
+}
@@ -0,0 +1,62 @@
+package services
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/samuel1992/ws-server-with-messagebus/messagebus"
+)
+
+// Constructor creates a service of a registered type that reads readTopic
+// and writes writeTopic, configured by opts. It fails with ErrInvalidOptions
+// if opts do not validate. Constructors are also called to check options,
+// e.g. when a configuration is loaded, so they must not have side effects
+// before Start.
+type Constructor func(bus messagebus.MessageBus, readTopic, writeTopic string, opts Options) (Service, error)
+
+var (
+	typesMu sync.RWMutex
+	types   = make(map[string]Constructor)
+)
+
+// Register makes a service type available by name, e.g. to configuration
+// files. Like database/sql.Register, it is meant to be called from init and
+// panics if name is registered twice.
+func Register(name string, constructor Constructor) {
+	typesMu.Lock()
+	defer typesMu.Unlock()
+
+	if constructor == nil {
+		panic("services: Register constructor is nil")
+	}
+	if _, dup := types[name]; dup {
+		panic("services: Register called twice for type " + name)
+	}
+	types[name] = constructor
+}
+
+// Lookup returns the constructor of the service type registered as name.
+func Lookup(name string) (Constructor, error) {
+	typesMu.RLock()
+	defer typesMu.RUnlock()
+
+	constructor, ok := types[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown service type %q", name)
+	}
+	return constructor, nil
+}
+
+// Types returns the names of the registered service types, sorted.
+func Types() []string {
+	typesMu.RLock()
+	defer typesMu.RUnlock()
+
+	names := make([]string, 0, len(types))
+	for name := range types {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
@@ -1,50 +1,164 @@
 package ws
 
 import (
+	"context"
+	"io"
 	"log"
+	"maps"
+	"mime"
+	"slices"
+	"strings"
 	"sync"
 	"time"
+	"unicode/utf8"
 
+	"github.com/samuel1992/ws-server-with-messagebus/auth"
 	"github.com/samuel1992/ws-server-with-messagebus/messagebus"
 
 	"github.com/gorilla/websocket"
 )
 
 type Client struct {
-	conn         *websocket.Conn
-	messageBus   messagebus.MessageBus
-	readTopic    string
-	writeTopic   string
-	sendToWsConn chan []byte
-	done         chan struct{}
+	id            string
+	conn          *websocket.Conn
+	messageBus    messagebus.MessageBus
+	readTopic     string
+	writeTopic    string
+	replyTopic    string
+	sendToWsConn  chan messagebus.Message
+	replyToWsConn chan messagebus.Message
+	subOpts       []messagebus.SubscribeOption
+	options       ClientOptions
+	principal     *auth.Principal
+	sendOffsets   bool
+	// done is closed when Start returns, whether it failed or not.
+	done     chan struct{}
+	readDone chan struct{}
+
+	// shutdown is closed by Shutdown; drainDeadline is set before.
+	shutdown      chan struct{}
+	shutdownOnce  sync.Once
+	drainDeadline time.Time
+
+	// err is the bus failure that ended the read loop, if any.
+	err error
+}
+
+// defaultDrainTimeout bounds Shutdown when its context has no deadline.
+const defaultDrainTimeout = 10 * time.Second
+
+// NewClient creates a client that forwards readTopic, plus its own
+// per-connection reply topic, to conn and conn to writeTopic. opts configure
+// both subscriptions, e.g. their overflow policy when the connection cannot
+// keep up.
+func NewClient(conn *websocket.Conn, mb messagebus.MessageBus, readTopic, writeTopic string, opts ...messagebus.SubscribeOption) *Client {
+	return NewClientWithOptions(conn, mb, readTopic, writeTopic, ClientOptions{}, opts...)
 }
 
-func NewClient(conn *websocket.Conn, mb messagebus.MessageBus, readTopic, writeTopic string) *Client {
+// NewClientWithOptions is NewClient with the connection limits and timeouts
+// of options, which must be valid.
+func NewClientWithOptions(conn *websocket.Conn, mb messagebus.MessageBus, readTopic, writeTopic string, options ClientOptions, opts ...messagebus.SubscribeOption) *Client {
+	options = options.WithDefaults()
+	if options.SendQueueLen > 0 {
+		opts = append(slices.Clone(opts), messagebus.WithBufferSize(options.SendQueueLen))
+	}
+	id := messagebus.NewID()
 	return &Client{
+		id:         id,
 		conn:       conn,
 		messageBus: mb,
 		readTopic:  readTopic,
 		writeTopic: writeTopic,
+		replyTopic: messagebus.ConnectionTopic(readTopic, id),
+		subOpts:    opts,
+		options:    options,
 		done:       make(chan struct{}),
+		readDone:   make(chan struct{}),
+		shutdown:   make(chan struct{}),
+	}
+}
+
+// ID returns the connection ID stamped on every message this client
+// publishes.
+func (c *Client) ID() string {
+	return c.id
+}
+
+// SetPrincipal sets the authenticated user of the connection, whose ID and
+// roles are then stamped on every message the client publishes. If p
+// expires, the connection is closed with ClosePolicyViolation then. It must
+// be called before Start.
+func (c *Client) SetPrincipal(p *auth.Principal) {
+	c.principal = p
+}
+
+// SetSendOffsets makes the client start every frame carrying a message of
+// its read topic with the message's Offset header and a space, so that the
+// peer knows where to resume from. The offset is empty on backends without
+// a log. It must be called before Start.
+func (c *Client) SetSendOffsets(on bool) {
+	c.sendOffsets = on
+}
+
+// Principal returns the authenticated user of the connection, or nil.
+func (c *Client) Principal() *auth.Principal {
+	return c.principal
+}
+
+// contentType maps a WebSocket frame type to the Content-Type header.
+func contentType(messageType int) string {
+	if messageType == websocket.BinaryMessage {
+		return messagebus.ContentTypeBinary
+	}
+	return messagebus.ContentTypeText
+}
+
+// frameType is the inverse of contentType: messages without a Content-Type
+// and text-like ones are sent as text frames, unless their payload is not
+// valid UTF-8, which text frames must be; everything else is binary.
+func frameType(message messagebus.Message) int {
+	if !utf8.Valid(message.Payload) {
+		return websocket.BinaryMessage
+	}
+	header := message.Header(messagebus.HeaderContentType)
+	if header == "" {
+		return websocket.TextMessage
+	}
+	mediaType, params, err := mime.ParseMediaType(header)
+	if err != nil {
+		return websocket.BinaryMessage
 	}
+	if strings.HasPrefix(mediaType, "text/") || mediaType == "application/json" ||
+		strings.HasSuffix(mediaType, "+json") || params["charset"] != "" {
+		return websocket.TextMessage
+	}
+	return websocket.BinaryMessage
 }
 
 // readLoop reads messages from the websocket and writes them to the message bus.
-func (c *Client) readLoop() {
+func (c *Client) readLoop(ctx context.Context) {
+	defer close(c.readDone)
 	defer func() {
-		c.messageBus.Unsubscribe(c.readTopic, c.sendToWsConn)
+		if err := c.messageBus.Unsubscribe(c.readTopic, c.sendToWsConn); err != nil {
+			log.Printf("error: %v", err)
+		}
+		if err := c.messageBus.Unsubscribe(c.replyTopic, c.replyToWsConn); err != nil {
+			log.Printf("error: %v", err)
+		}
 		c.conn.Close()
 	}()
 
-	c.conn.SetReadLimit(512)
-	c.conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+	c.conn.SetReadLimit(c.options.ReadLimit)
+	c.conn.SetReadDeadline(time.Now().Add(c.options.PongWait))
 	c.conn.SetPongHandler(func(string) error {
-		c.conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+		c.conn.SetReadDeadline(time.Now().Add(c.options.PongWait))
 		return nil
 	})
 
+	remoteAddr := c.conn.RemoteAddr().String()
+
 	for {
-		_, message, err := c.conn.ReadMessage()
+		messageType, payload, err := c.conn.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err,
 				websocket.CloseNormalClosure,
@@ -54,61 +168,194 @@ func (c *Client) readLoop() {
 			}
 			break
 		}
-		c.messageBus.Publish(c.writeTopic, message)
+		message := messagebus.Message{
+			Payload: payload,
+			Headers: map[string]string{
+				messagebus.HeaderConnectionID: c.id,
+				messagebus.HeaderRemoteAddr:   remoteAddr,
+				messagebus.HeaderContentType:  contentType(messageType),
+				messagebus.HeaderReplyTo:      c.replyTopic,
+			},
+		}
+		if c.principal != nil {
+			maps.Copy(message.Headers, c.principal.Headers())
+		}
+		if err := c.messageBus.Publish(ctx, c.writeTopic, message); err != nil {
+			c.err = err
+			c.conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseInternalServerErr, ""),
+				time.Now().Add(c.options.WriteWait))
+			break
+		}
 	}
 }
 
 // writeLoop writes messages from the message bus to the websocket connection.
 func (c *Client) writeLoop() {
-	ticker := time.NewTicker(10 * time.Second)
+	ticker := time.NewTicker(c.options.PingPeriod)
 	defer func() {
 		ticker.Stop()
 		c.conn.Close()
 	}()
 
+	var expired <-chan time.Time
+	if c.principal != nil && !c.principal.Expires.IsZero() {
+		timer := time.NewTimer(time.Until(c.principal.Expires))
+		defer timer.Stop()
+		expired = timer.C
+	}
+
 	for {
+		var message messagebus.Message
+		var ok bool
+
 		select {
-		case message, ok := <-c.sendToWsConn:
-			c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-			if !ok {
-				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+		case message, ok = <-c.sendToWsConn:
+		case message, ok = <-c.replyToWsConn:
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(c.options.WriteWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
 				return
 			}
+			continue
+		case <-c.shutdown:
+			c.drain()
+			return
+		case <-expired:
+			// The peer may reconnect with fresh credentials.
+			log.Printf("Closing connection %s of %s: credentials expired", c.id, c.principal.UserID)
+			c.conn.SetWriteDeadline(time.Now().Add(c.options.WriteWait))
+			c.conn.WriteMessage(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "token expired"))
+			return
+		}
 
-			w, err := c.conn.NextWriter(websocket.TextMessage)
-			if err != nil {
-				return
-			}
-			w.Write(message)
+		c.conn.SetWriteDeadline(time.Now().Add(c.options.WriteWait))
+		if !ok {
+			// The bus closed one of our subscriptions, most likely because
+			// this connection fell behind; tell the peer it may retry.
+			c.conn.WriteMessage(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "subscription closed"))
+			return
+		}
 
-			if err := w.Close(); err != nil {
-				return
+		if err := c.write(message); err != nil {
+			return
+		}
+	}
+}
+
+// write sends message as a text or binary frame depending on its
+// Content-Type (see frameType), after its offset if SetSendOffsets was
+// called.
+func (c *Client) write(message messagebus.Message) error {
+	w, err := c.conn.NextWriter(frameType(message))
+	if err != nil {
+		return err
+	}
+	if c.sendOffsets && message.Topic == c.readTopic {
+		io.WriteString(w, message.Header(messagebus.HeaderOffset)+" ")
+	}
+	w.Write(message.Payload)
+
+	return w.Close()
+}
+
+// drain writes the messages already queued for the peer, sends a
+// CloseGoingAway frame and waits for the peer to answer it, all before the
+// drain deadline.
+func (c *Client) drain() {
+	c.conn.SetWriteDeadline(c.drainDeadline)
+
+	sends, replies := c.sendToWsConn, c.replyToWsConn
+	for sends != nil || replies != nil {
+		var message messagebus.Message
+		var ok bool
+
+		select {
+		case message, ok = <-sends:
+			if !ok {
+				sends = nil
+				continue
 			}
-		case <-ticker.C:
-			c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
-				return
+		case message, ok = <-replies:
+			if !ok {
+				replies = nil
+				continue
 			}
+		default:
+			sends, replies = nil, nil
+			continue
+		}
+
+		if err := c.write(message); err != nil {
+			return
 		}
 	}
+
+	err := c.conn.WriteMessage(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down"))
+	if err != nil {
+		return
+	}
+
+	// The read loop ends when the peer's close frame arrives.
+	timer := time.NewTimer(time.Until(c.drainDeadline))
+	defer timer.Stop()
+	select {
+	case <-c.readDone:
+	case <-timer.C:
+	}
 }
 
-func (c *Client) Start() error {
-	c.sendToWsConn = c.messageBus.Subscribe(c.readTopic)
+// Start subscribes to the read and reply topics and pumps messages in both
+// directions until the connection closes. It returns an error if a
+// subscription could not be set up or if publishing to the bus failed.
+func (c *Client) Start(ctx context.Context) error {
+	defer close(c.done)
+
+	sub, err := c.messageBus.Subscribe(ctx, c.readTopic, c.subOpts...)
+	if err != nil {
+		return err
+	}
+	c.sendToWsConn = sub
+
+	replies, err := c.messageBus.Subscribe(ctx, c.replyTopic, c.subOpts...)
+	if err != nil {
+		c.messageBus.Unsubscribe(c.readTopic, sub)
+		return err
+	}
+	c.replyToWsConn = replies
 
 	var wg sync.WaitGroup
 
 	wg.Go(c.writeLoop)
-	wg.Go(c.readLoop)
+	wg.Go(func() { c.readLoop(ctx) })
+	wg.Wait()
 
-	go func() {
-		wg.Wait()
-		close(c.done)
-	}()
+	return c.err
+}
 
-	<-c.done
+// Shutdown sends the peer what is already queued for it followed by a
+// CloseGoingAway frame, and waits for Start to return. Whatever is left
+// when ctx expires (or after 10s if it has no deadline) is cut off.
+func (c *Client) Shutdown(ctx context.Context) error {
+	c.shutdownOnce.Do(func() {
+		deadline, ok := ctx.Deadline()
+		if !ok {
+			deadline = time.Now().Add(defaultDrainTimeout)
+		}
+		c.drainDeadline = deadline
+		close(c.shutdown)
+	})
 
-	return nil
+	select {
+	case <-c.done:
+		return nil
+	case <-ctx.Done():
+		c.conn.Close()
+		return ctx.Err()
+	}
 }
 
 func (c *Client) Stop() error {
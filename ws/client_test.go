@@ -0,0 +1,250 @@
+package ws
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/samuel1992/ws-server-with-messagebus/auth"
+	"github.com/samuel1992/ws-server-with-messagebus/messagebus"
+	"github.com/samuel1992/ws-server-with-messagebus/services"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestFrameType(t *testing.T) {
+	for contentType, want := range map[string]int{
+		"":                               websocket.TextMessage,
+		messagebus.ContentTypeText:       websocket.TextMessage,
+		"text/html":                      websocket.TextMessage,
+		"application/json":               websocket.TextMessage,
+		"application/ld+json":            websocket.TextMessage,
+		"application/xml; charset=utf-8": websocket.TextMessage,
+		messagebus.ContentTypeBinary:     websocket.BinaryMessage,
+		"application/x-protobuf":         websocket.BinaryMessage,
+		"image/png":                      websocket.BinaryMessage,
+		"not a media type;":              websocket.BinaryMessage,
+	} {
+		msg := messagebus.NewMessage([]byte("payload"))
+		if contentType != "" {
+			msg = msg.WithHeader(messagebus.HeaderContentType, contentType)
+		}
+		if got := frameType(msg); got != want {
+			t.Errorf("%q: expected frame type %d, got %d", contentType, want, got)
+		}
+	}
+
+	invalid := messagebus.NewMessage([]byte{0xff, 0xfe}).WithHeader(messagebus.HeaderContentType, messagebus.ContentTypeText)
+	if frameType(invalid) != websocket.BinaryMessage {
+		t.Error("expected invalid UTF-8 to be sent as binary")
+	}
+}
+
+// newEchoServer connects every WebSocket to an EchoService on bus.
+func newEchoServer(t *testing.T, bus messagebus.MessageBus) *httptest.Server {
+	return newEchoServerWithOptions(t, bus, ClientOptions{})
+}
+
+func newEchoServerWithOptions(t *testing.T, bus messagebus.MessageBus, options ClientOptions) *httptest.Server {
+	t.Helper()
+
+	echo := services.NewEchoService(bus, "echo:in", "echo:out")
+	if err := echo.Start(context.Background()); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	t.Cleanup(func() { echo.Stop() })
+
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		NewClientWithOptions(conn, bus, "echo:out", "echo:in", options).Start(r.Context())
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestClientPreservesFrameTypes(t *testing.T) {
+	bus := messagebus.NewInMemoryMessageBus()
+	server := newEchoServer(t, bus)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+
+	frames := []struct {
+		messageType int
+		payload     []byte
+	}{
+		{websocket.TextMessage, []byte("hello")},
+		{websocket.BinaryMessage, []byte{0x08, 0x96, 0x01}},
+		{websocket.BinaryMessage, []byte("binary but valid UTF-8")},
+		{websocket.TextMessage, []byte(`{"json": true}`)},
+		{websocket.BinaryMessage, []byte{0x89, 'P', 'N', 'G', 0x00, 0xff}},
+	}
+	for _, frame := range frames {
+		conn.WriteMessage(frame.messageType, frame.payload)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	for i, frame := range frames {
+		messageType, payload, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("frame %d: ReadMessage failed: %v", i, err)
+		}
+		if messageType != frame.messageType {
+			t.Errorf("frame %d: expected frame type %d, got %d", i, frame.messageType, messageType)
+		}
+		if !bytes.Equal(payload, frame.payload) {
+			t.Errorf("frame %d: expected %v, got %v", i, frame.payload, payload)
+		}
+	}
+}
+
+func TestServicePushesBinary(t *testing.T) {
+	bus := messagebus.NewInMemoryMessageBus()
+	server := newEchoServer(t, bus)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+
+	// Wait for the client's subscription before broadcasting.
+	conn.WriteMessage(websocket.TextMessage, []byte("ready?"))
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err := conn.ReadMessage(); err != nil {
+		t.Fatalf("ReadMessage failed: %v", err)
+	}
+
+	image := []byte{0x89, 'P', 'N', 'G'}
+	bus.Publish(context.Background(), "echo:out",
+		messagebus.NewMessage(image).WithHeader(messagebus.HeaderContentType, "image/png"))
+	bus.Publish(context.Background(), "echo:out", messagebus.NewMessage([]byte("caption")))
+
+	for _, want := range []int{websocket.BinaryMessage, websocket.TextMessage} {
+		messageType, _, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("ReadMessage failed: %v", err)
+		}
+		if messageType != want {
+			t.Errorf("expected frame type %d, got %d", want, messageType)
+		}
+	}
+}
+
+func TestClientOptionsValidate(t *testing.T) {
+	if err := (ClientOptions{}).Validate(); err != nil {
+		t.Errorf("expected the defaults to be valid, got %v", err)
+	}
+	if limit := (ClientOptions{}).WithDefaults().ReadLimit; limit != 512 {
+		t.Errorf("expected the 512-byte read limit by default, got %d", limit)
+	}
+	for name, options := range map[string]ClientOptions{
+		"ping after pong wait": {PongWait: 5 * time.Second, PingPeriod: 5 * time.Second},
+		"default ping period":  {PongWait: time.Second},
+		"negative read limit":  {ReadLimit: -1},
+		"negative write wait":  {WriteWait: -time.Second},
+		"negative queue":       {SendQueueLen: -1},
+	} {
+		if err := options.Validate(); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestClientReadLimit(t *testing.T) {
+	bus := messagebus.NewInMemoryMessageBus()
+	server := newEchoServerWithOptions(t, bus, ClientOptions{ReadLimit: 4096})
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+
+	// Well above the default 512-byte limit.
+	large := bytes.Repeat([]byte("a"), 4096)
+	conn.WriteMessage(websocket.TextMessage, large)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, payload, err := conn.ReadMessage(); err != nil || len(payload) != len(large) {
+		t.Fatalf("expected the 4 KiB message echoed, got %d bytes, %v", len(payload), err)
+	}
+
+	conn.WriteMessage(websocket.TextMessage, append(large, 'b'))
+	_, _, err = conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+		t.Errorf("expected CloseMessageTooBig, got %v", err)
+	}
+}
+
+func TestClientClosesWhenCredentialsExpire(t *testing.T) {
+	bus := messagebus.NewInMemoryMessageBus()
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		client := NewClient(conn, bus, "out", "in")
+		client.SetPrincipal(&auth.Principal{UserID: "alice", Expires: time.Now().Add(200 * time.Millisecond)})
+		client.Start(r.Context())
+	}))
+	t.Cleanup(server.Close)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, _, err = conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+		t.Errorf("expected ClosePolicyViolation, got %v", err)
+	}
+}
+
+func TestShutdownReturnsWhenStartFails(t *testing.T) {
+	bus := messagebus.NewInMemoryMessageBus()
+	bus.Close()
+	upgrader := websocket.Upgrader{}
+	shutdown := make(chan error, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		client := NewClient(conn, bus, "out", "in")
+		if err := client.Start(r.Context()); err == nil {
+			t.Error("expected Start to fail on a closed bus")
+		}
+		shutdown <- client.Shutdown(context.Background())
+	}))
+	t.Cleanup(server.Close)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+
+	select {
+	case err := <-shutdown:
+		if err != nil {
+			t.Errorf("Shutdown failed: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Shutdown blocked after Start failed")
+	}
+}
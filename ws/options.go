@@ -0,0 +1,93 @@
+package ws
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ClientOptions are the limits and timeouts of a WebSocket connection. Zero
+// fields take their default.
+type ClientOptions struct {
+	// ReadLimit is the largest message accepted from the peer, in bytes;
+	// larger ones close the connection. Defaults to 512 bytes.
+	ReadLimit int64
+	// PongWait is how long the peer may stay silent, pongs included, before
+	// the connection is considered dead. Defaults to 60s.
+	PongWait time.Duration
+	// PingPeriod is how often the peer is pinged. It must be shorter than
+	// PongWait. Defaults to 10s.
+	PingPeriod time.Duration
+	// WriteWait bounds each write to the peer. Defaults to 10s.
+	WriteWait time.Duration
+	// ReadBufferSize and WriteBufferSize are the I/O buffer sizes of the
+	// upgraded connection, in bytes. They do not limit message sizes.
+	// Default to 1024.
+	ReadBufferSize  int
+	WriteBufferSize int
+	// SendQueueLen is how many messages may wait to be written to the peer
+	// before the connection counts as slow. Defaults to the bus's buffer
+	// size.
+	SendQueueLen int
+}
+
+// DefaultClientOptions returns the options used for zero fields.
+func DefaultClientOptions() ClientOptions {
+	return ClientOptions{
+		ReadLimit:       512,
+		PongWait:        60 * time.Second,
+		PingPeriod:      10 * time.Second,
+		WriteWait:       10 * time.Second,
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024,
+	}
+}
+
+// WithDefaults returns o with its zero fields set to their default.
+func (o ClientOptions) WithDefaults() ClientOptions {
+	defaults := DefaultClientOptions()
+	if o.ReadLimit == 0 {
+		o.ReadLimit = defaults.ReadLimit
+	}
+	if o.PongWait == 0 {
+		o.PongWait = defaults.PongWait
+	}
+	if o.PingPeriod == 0 {
+		o.PingPeriod = defaults.PingPeriod
+	}
+	if o.WriteWait == 0 {
+		o.WriteWait = defaults.WriteWait
+	}
+	if o.ReadBufferSize == 0 {
+		o.ReadBufferSize = defaults.ReadBufferSize
+	}
+	if o.WriteBufferSize == 0 {
+		o.WriteBufferSize = defaults.WriteBufferSize
+	}
+	return o
+}
+
+// Validate checks o once defaults are applied: no negative values, and a
+// ping period shorter than the pong wait, or the connection would time out
+// between two pings.
+func (o ClientOptions) Validate() error {
+	o = o.WithDefaults()
+
+	var errs []error
+	if o.ReadLimit < 0 {
+		errs = append(errs, fmt.Errorf("read limit %d is negative", o.ReadLimit))
+	}
+	if o.PongWait < 0 || o.PingPeriod < 0 || o.WriteWait < 0 {
+		errs = append(errs, errors.New("durations must not be negative"))
+	}
+	if o.PingPeriod >= o.PongWait {
+		errs = append(errs, fmt.Errorf("ping period %s must be shorter than pong wait %s", o.PingPeriod, o.PongWait))
+	}
+	if o.ReadBufferSize < 0 || o.WriteBufferSize < 0 || o.SendQueueLen < 0 {
+		errs = append(errs, errors.New("buffer sizes and queue length must not be negative"))
+	}
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("invalid client options: %w", err)
+	}
+	return nil
+}